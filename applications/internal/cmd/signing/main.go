@@ -357,7 +357,7 @@ func dialTCP(comm *networking.P2PComm, dst int, address string) {
 func dialRelayTLS(comm *networking.TLSComm, src int, dst int, address string, tag string) {
 	var tlsConn *tls.Conn
 	for {
-		tcpConn, sslAuthConn, readyResp, err := client.StartRelayAuthGo(strconv.Itoa(src), strconv.Itoa(dst), tag, address)
+		tcpConn, sslAuthConn, readyResp, err := client.StartRelayAuthGo("user1", strconv.Itoa(src), strconv.Itoa(dst), tag, address)
 		if err != nil {
 			log.Printf("Failed to get relay authorization: %v.", err)
 			sslAuthConn.Close()
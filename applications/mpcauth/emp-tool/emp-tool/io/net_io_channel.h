@@ -162,7 +162,7 @@ class NetIO: public IOChannel<NetIO> {
 		sprintf(partyString, "%d", party);
 		sprintf(destString, "%d",dest);
 
-		StartRelayAuth(partyString, destString, tag, addr.c_str(), port, cert_path.c_str(), &conn, &mode);
+		StartRelayAuth(user.c_str(), partyString, destString, tag, addr.c_str(), port, cert_path.c_str(), &conn, &mode);
 
 		if (GetSessionE2E(conn, mode, cert_path.c_str(), user.c_str(), partyString, destString, &ssl) != 0) { 
 			abort();
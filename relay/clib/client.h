@@ -28,6 +28,17 @@
 #define TLS_SERVER 1
 #define TLS_CLIENT 2
 
+/* Relay control protocol: | version | type | length (4 bytes, big endian) | JSON payload | */
+#define PROTOCOL_VERSION 1
+#define HEADER_SIZE 6
+
+#define MSG_HELLO    1
+#define MSG_AUTHREQ  2
+#define MSG_WAITING  3
+#define MSG_READY    4
+#define MSG_ERROR    5
+#define MSG_HANDOVER 6
+
 int OpenConnection(const char *hostname, int port)
 {   int sd;
     struct hostent *host;
@@ -249,10 +260,106 @@ int GetSessionE2EWithCerts(int conn, int mode, const char *cacert, const char *c
     return 0;
 }
 
-int StartRelayAuthWithCerts(const char* dest, const char *tag, const char* address, int port, const char *cacert, const char *cert, const char *key, int *conn, int *mode) {
+int SSLReadFull(SSL *ssl, char *buf, int len) {
+    int total = 0, bytes;
+    while (total < len) {
+        bytes = SSL_read(ssl, buf + total, len - total);
+        if (bytes <= 0) {
+            return FAIL;
+        }
+        total += bytes;
+    }
+    return total;
+}
+
+int WriteMessage(SSL *ssl, int type, const char *payload) {
+    char frame[HEADER_SIZE + MAX_SIZE];
+    int len = strlen(payload);
+
+    if (len > MAX_SIZE) {
+        fprintf(stderr, "Control message too large\n");
+        return FAIL;
+    }
+    frame[0] = PROTOCOL_VERSION;
+    frame[1] = type;
+    frame[2] = (len >> 24) & 0xff;
+    frame[3] = (len >> 16) & 0xff;
+    frame[4] = (len >> 8) & 0xff;
+    frame[5] = len & 0xff;
+    memcpy(frame + HEADER_SIZE, payload, len);
+    if (SSL_write(ssl, frame, HEADER_SIZE + len) <= 0) {
+        return FAIL;
+    }
+    return 0;
+}
+
+/* ReadMessage reads a control message into payload (NUL terminated) and returns its type */
+int ReadMessage(SSL *ssl, char *payload, int max) {
+    unsigned char header[HEADER_SIZE];
+    unsigned int len;
+
+    if (SSLReadFull(ssl, (char *)header, HEADER_SIZE) == FAIL) {
+        return FAIL;
+    }
+    if (header[0] != PROTOCOL_VERSION) {
+        fprintf(stderr, "Unsupported relay protocol version %d\n", header[0]);
+        return FAIL;
+    }
+    len = ((unsigned int)header[2] << 24) | (header[3] << 16) | (header[4] << 8) | header[5];
+    if (len >= (unsigned int)max) {
+        fprintf(stderr, "Control message too large\n");
+        return FAIL;
+    }
+    if (len > 0 && SSLReadFull(ssl, payload, len) == FAIL) {
+        return FAIL;
+    }
+    payload[len] = 0;
+    return header[1];
+}
+
+/* RequestAuth sends the auth request and waits until the relay hands the connection over */
+int RequestAuth(SSL *ssl, const char *dest, const char *tag, int *mode) {
     char json_req[MAX_SIZE];
     char json_resp[MAX_SIZE];
-    int bytes;
+    char close_buf[1];
+    int type;
+
+    snprintf(json_req, sizeof(json_req), "{\"DestParty\":\"%s\",\"Tag\":\"%s\"}", dest, tag);
+    if (WriteMessage(ssl, MSG_HELLO, "{\"Agent\":\"flock-c\"}") == FAIL ||
+        WriteMessage(ssl, MSG_AUTHREQ, json_req) == FAIL) {
+        ERR_print_errors_fp(stderr);
+        return EXIT_FAILURE;
+    }
+
+    *mode = 0;
+    for (;;) {
+        type = ReadMessage(ssl, json_resp, sizeof(json_resp));
+        switch (type) {
+        case MSG_WAITING:
+            continue;
+        case MSG_READY:
+            *mode = getModeFromResp(json_resp);
+            continue;
+        case MSG_HANDOVER:
+            if (*mode == 0) {
+                fprintf(stderr, "Relay handed over before ready\n");
+                return EXIT_FAILURE;
+            }
+            /* The relay now ends the TLS session, consume its close_notify and acknowledge it */
+            SSL_read(ssl, close_buf, sizeof(close_buf));
+            SSL_shutdown(ssl);
+            return 0;
+        case MSG_ERROR:
+            fprintf(stderr, "Relay error: %s\n", json_resp);
+            return EXIT_FAILURE;
+        default:
+            ERR_print_errors_fp(stderr);
+            return EXIT_FAILURE;
+        }
+    }
+}
+
+int StartRelayAuthWithCerts(const char* dest, const char *tag, const char* address, int port, const char *cacert, const char *cert, const char *key, int *conn, int *mode) {
     SSL *ssl;
     SSL_CTX *ctx;
 
@@ -271,42 +378,19 @@ int StartRelayAuthWithCerts(const char* dest, const char *tag, const char* addre
     }
     printf("Connected with %s encryption\n", SSL_get_cipher(ssl));
 
-    sprintf(json_req,"{\"DestParty\":\"%s\",\"Tag\":\"%s\"}", dest, tag);
-    printf("Sending : %s\n", json_req);
-
-    if (SSL_write(ssl, json_req, strlen(json_req)) == -1)
-    {
-        perror("write");
-        return EXIT_FAILURE;
-    }
-
-    bytes = SSL_read(ssl, json_resp, sizeof(json_resp)-1); /* get reply & decrypt */
-    json_resp[bytes] = 0;
-    printf("Read %d bytes\n", bytes);
-    if (bytes <= 0) {
-        ERR_print_errors_fp(stderr);
-        return EXIT_FAILURE;
-    }
-    printf("Reply from relay: %s\n", json_resp);
-    *mode = getModeFromResp(json_resp);
-    bytes = SSL_read(ssl, json_resp, sizeof(json_resp));
-    printf("read %d bytes\n", bytes);
-    return 0;
+    return RequestAuth(ssl, dest, tag, mode);
 }
 
-int StartRelayAuth(const char* name, const char* dest, const char *tag, const char* address, int port, const char *certs_folder, int *conn, int *mode) {
-    char cert[100], key[100];
-    char json_req[MAX_SIZE];
-    char json_resp[MAX_SIZE];
-    int bytes;
+int StartRelayAuth(const char *user, const char* name, const char* dest, const char *tag, const char* address, int port, const char *certs_folder, int *conn, int *mode) {
+    char cert[256], key[256];
     SSL *ssl;
     SSL_CTX *ctx;
 
     SSL_library_init();
 
     ctx = InitCTX();
-    sprintf(cert, "%s/%s/cert.pem", certs_folder, name);
-    sprintf(key, "%s/%s/key.pem", certs_folder, name);
+    sprintf(cert, "%s/%s/%s/relay-cert.pem", certs_folder, user, name);
+    sprintf(key, "%s/%s/%s/relay-key.pem", certs_folder, user, name);
 
     LoadCertificates(ctx, cert, key); /* load certs */
     *conn = OpenConnection(address, port);
@@ -318,21 +402,5 @@ int StartRelayAuth(const char* name, const char* dest, const char *tag, const ch
         return EXIT_FAILURE;
     }
 
-    sprintf(json_req,"{\"DestParty\":\"%s\",\"Tag\":\"%s\"}", dest, tag);
-
-    if (SSL_write(ssl, json_req, strlen(json_req)) == -1)
-    {
-        perror("write");
-        return EXIT_FAILURE;
-    }
-
-    bytes = SSL_read(ssl, json_resp, sizeof(json_resp)-1); /* get reply & decrypt */
-    json_resp[bytes] = 0;
-    if (bytes <= 0) {
-        ERR_print_errors_fp(stderr);
-        return EXIT_FAILURE;
-    }
-    *mode = getModeFromResp(json_resp);
-    bytes = SSL_read(ssl, json_resp, sizeof(json_resp));
-    return 0;
+    return RequestAuth(ssl, dest, tag, mode);
 }
@@ -173,6 +173,19 @@ func direct_server(target string, user, party string) (*tls.Conn, error) {
 	return nil, err
 }
 
+// startRelaySession pairs with dest under tag on a stream of m, or on a connection of its own when m is nil
+func startRelaySession(m *client.Mux, dest, tag, relay, cacert, cert, key string) (net.Conn, *api.Ready, error) {
+	if m != nil {
+		stream, readyResp, err := m.OpenStream(dest, tag)
+		if err != nil {
+			return nil, nil, err
+		}
+		return stream, readyResp, nil
+	}
+	tcpConn, _, readyResp, err := client.StartRelayAuthWithCerts(dest, tag, relay, cacert, cert, key)
+	return tcpConn, readyResp, err
+}
+
 func main() {
 	relay := os.Getenv("RELAY")
 	dest := os.Getenv("DEST")
@@ -188,10 +201,23 @@ func main() {
 	cacertUser := os.Getenv("USER_CA")
 	certParty := os.Getenv("PARTY_CERT")
 	keyParty := os.Getenv("PARTY_KEY")
+	crlUser := os.Getenv("USER_CRL")
 
 	tag := os.Getenv("TAG")
 	test := os.Getenv("TEST")
 
+	// MUX opens the streams of every operation over a single connection to the relay
+	var muxSession *client.Mux
+	if os.Getenv("MUX") != "" {
+		var err error
+		muxSession, err = client.OpenMuxWithCerts(relay, cacert, cert, key)
+		if err != nil {
+			fmt.Printf("Failed to open multiplexed session: %v.\n", err)
+			return
+		}
+		defer muxSession.Close()
+	}
+
 	buf := make([]byte, 14500)
 	var wg sync.WaitGroup
 
@@ -227,18 +253,16 @@ func main() {
 			m := 0
 			for i := 0; i < 10; {
 				startTime := time.Now()
-				tcpConn, sslAuthConn, readyResp, err := client.StartRelayAuthWithCerts(dest, tag, relay, cacert, cert, key)
+				tcpConn, readyResp, err := startRelaySession(muxSession, dest, tag, relay, cacert, cert, key)
 				if err != nil {
 					fmt.Printf("Failed to get relay authorization: %v.\n", err)
 					break
 				}
 				timeAuth := time.Now()
-				defer sslAuthConn.Close()
 				defer tcpConn.Close()
-				tlsConn, err := client.GetSessionE2EGoWithCerts(tcpConn, readyResp, dest, cacertUser, certParty, keyParty)
+				tlsConn, err := client.GetSessionE2EGoWithCerts(tcpConn, readyResp, dest, cacertUser, certParty, keyParty, crlUser)
 				if err != nil {
 					fmt.Printf("Failed to get E2E session: %v.\n", err)
-					sslAuthConn.Close()
 					tcpConn.Close()
 					continue
 				}
@@ -252,7 +276,6 @@ func main() {
 					time.Sleep(1 * time.Second)
 				}
 				sendBytes(tlsConn, buf)
-				sslAuthConn.Close()
 				tcpConn.Close()
 				i++
 			}
@@ -268,19 +291,17 @@ func main() {
 	for i := 0; i < ops; i++ {
 		wg.Add(1)
 		go func(i int) {
-			tcpConn, sslAuthConn, readyResp, err := client.StartRelayAuthWithCerts(dest, tag+strconv.Itoa(i), relay, cacert, cert, key)
+			tcpConn, readyResp, err := startRelaySession(muxSession, dest, tag+strconv.Itoa(i), relay, cacert, cert, key)
 			if err != nil {
 				fmt.Printf("Failed to get relay authorization: %v.\n", err)
 				wg.Done()
 				return
 			}
 			//time_auth := time.Now()
-			defer sslAuthConn.Close()
 			defer tcpConn.Close()
-			tlsConn, err := client.GetSessionE2EGoWithCerts(tcpConn, readyResp, dest, cacertUser, certParty, keyParty)
+			tlsConn, err := client.GetSessionE2EGoWithCerts(tcpConn, readyResp, dest, cacertUser, certParty, keyParty, crlUser)
 			if err != nil {
 				fmt.Printf("Failed to get E2E session: %v.\n", err)
-				sslAuthConn.Close()
 				tcpConn.Close()
 				wg.Done()
 				return
@@ -0,0 +1,155 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the relay, user and party certificates",
+	Long:  `List the relay, user and party certificates of the certs directory, with their expiry and status`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		user, _ := cmd.Flags().GetString("user")
+		certs, err := api.ListCertificates()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "USER\tNAME\tKIND\tSERIAL\tEXPIRES\tSTATUS\tPATH")
+		for _, c := range certs {
+			if user != "" && c.User != user {
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", c.User, c.Name, c.Kind, c.Serial,
+				c.NotAfter.Format(time.DateOnly), c.Status(), c.Path)
+		}
+		return w.Flush()
+	},
+}
+
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <cert.pem>",
+	Short: "Show the details of a certificate",
+	Long:  `Show the subject, SANs, issuer, validity and chain of a certificate`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := api.InspectCertificate(args[0])
+		if err != nil {
+			return err
+		}
+		chain := "valid, signed by " + c.TrustedBy
+		if c.ChainError != "" {
+			chain = "invalid: " + c.ChainError
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintf(w, "Subject:\t%s\n", c.Subject)
+		fmt.Fprintf(w, "SANs:\t%s\n", strings.Join(c.DNSNames, ", "))
+		fmt.Fprintf(w, "Issuer:\t%s\n", c.Issuer)
+		fmt.Fprintf(w, "Serial:\t%s\n", c.Serial)
+		fmt.Fprintf(w, "CA:\t%t\n", c.IsCA)
+		fmt.Fprintf(w, "Not before:\t%s\n", c.NotBefore.Format(time.RFC3339))
+		fmt.Fprintf(w, "Not after:\t%s (%s)\n", c.NotAfter.Format(time.RFC3339), expiry(c.NotAfter))
+		fmt.Fprintf(w, "Chain:\t%s\n", chain)
+		fmt.Fprintf(w, "Revoked:\t%t\n", c.Revoked)
+		fmt.Fprintf(w, "Status:\t%s\n", c.Status())
+		return w.Flush()
+	},
+}
+
+var renewCmd = &cobra.Command{
+	Use:   "renew",
+	Short: "Renew a relay/user/party",
+	Long:  `Re-issue the certificates of a relay/user/party with the same identity and keys, and a new validity period`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+	},
+}
+
+var renewRelayCmd = &cobra.Command{
+	Use:   "relay",
+	Short: "Renew the relay CA and the relay certificate",
+	Long:  `Renew the relay CA and the relay certificate`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return api.RenewRelay()
+	},
+}
+
+var renewUserCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Renew the CA of a user domain",
+	Long:  `Renew the CA of a user domain`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+		return api.RenewUser(name)
+	},
+}
+
+var renewPartyCmd = &cobra.Command{
+	Use:   "party",
+	Short: "Renew the relay and E2E certificates of a party",
+	Long:  `Renew the relay and E2E certificates of a party`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+		user, _ := cmd.Flags().GetString("user")
+		force, _ := cmd.Flags().GetBool("force")
+		return api.RenewParty(name, user, force)
+	},
+}
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Move the relay certificates of parties into the directory of their user",
+	Long:  `Move the relay certificates of parties from certs/<party> into certs/<user>/<party>, the user being read from each certificate`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return api.MigrateLegacyParties()
+	},
+}
+
+// expiry describes how long until t, or since t
+func expiry(t time.Time) string {
+	d := time.Until(t).Round(time.Hour)
+	if d < 0 {
+		return fmt.Sprintf("expired %s ago", -d)
+	}
+	return fmt.Sprintf("expires in %d days", int(d.Hours()/24))
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+	listCmd.Flags().String("user", "", "Only list the certificates of this user.")
+	rootCmd.AddCommand(inspectCmd)
+	rootCmd.AddCommand(renewCmd)
+	renewCmd.AddCommand(renewRelayCmd)
+	renewCmd.AddCommand(renewUserCmd)
+	renewUserCmd.Flags().String("name", "", "User name.")
+	renewUserCmd.MarkFlagRequired("name")
+	renewCmd.AddCommand(renewPartyCmd)
+	renewPartyCmd.Flags().String("name", "", "Party name.")
+	renewPartyCmd.Flags().String("user", "", "User name associated.")
+	renewPartyCmd.Flags().Bool("force", false, "Renew a revoked party, issuing its certificates with new keys.")
+	renewPartyCmd.MarkFlagRequired("name")
+	renewPartyCmd.MarkFlagRequired("user")
+	rootCmd.AddCommand(migrateCmd)
+}
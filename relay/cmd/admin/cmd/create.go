@@ -14,6 +14,10 @@
 package admin
 
 import (
+	"errors"
+	"fmt"
+	"os"
+
 	"github.com/flock-org/flock/relay/pkg/api"
 	"github.com/spf13/cobra"
 )
@@ -31,8 +35,9 @@ var createRelayCmd = &cobra.Command{
 	Use:   "relay",
 	Short: "Create a relay",
 	Long:  `Create a relay `,
-	Run: func(cmd *cobra.Command, args []string) {
-		api.CreateRelay()
+	RunE: func(cmd *cobra.Command, args []string) error {
+		force, _ := cmd.Flags().GetBool("force")
+		return overwriteHint(api.CreateRelay(force))
 	},
 }
 
@@ -40,9 +45,10 @@ var createUserCmd = &cobra.Command{
 	Use:   "user",
 	Short: "Create a user domain",
 	Long:  `Create a user domain `,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		name, _ := cmd.Flags().GetString("name")
-		api.CreateUser(name)
+		force, _ := cmd.Flags().GetBool("force")
+		return overwriteHint(api.CreateUser(name, force))
 	},
 }
 
@@ -50,19 +56,32 @@ var createPartyCmd = &cobra.Command{
 	Use:   "party",
 	Short: "Create a party within user domain",
 	Long:  `Create a party within user domain`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		name, _ := cmd.Flags().GetString("name")
 		user, _ := cmd.Flags().GetString("user")
-		api.CreateParty(name, user)
+		force, _ := cmd.Flags().GetBool("force")
+		return overwriteHint(api.CreateParty(name, user, force))
 	},
 }
 
+// overwriteHint tells how to replace existing certificates when a create command refuses to overwrite them
+func overwriteHint(err error) error {
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%v, use --force to overwrite it", err)
+	}
+	return err
+}
+
 func init() {
 	rootCmd.AddCommand(createCmd)
+	createCmd.PersistentFlags().Bool("force", false, "Overwrite existing certificates and keys.")
 	createCmd.AddCommand(createRelayCmd)
 	createCmd.AddCommand(createUserCmd)
 	createUserCmd.Flags().String("name", "", "User name.")
+	createUserCmd.MarkFlagRequired("name")
 	createCmd.AddCommand(createPartyCmd)
 	createPartyCmd.Flags().String("name", "", "Party name.")
 	createPartyCmd.Flags().String("user", "", "User name associated.")
+	createPartyCmd.MarkFlagRequired("name")
+	createPartyCmd.MarkFlagRequired("user")
 }
@@ -0,0 +1,41 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"fmt"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+var reloadCmd = &cobra.Command{
+	Use:   "reload",
+	Short: "Reload the certificate and trusted CAs of a running relay",
+	Long:  `Reload the certificate and trusted CAs of a running relay through its admin API, the sessions keep running`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		relay, _ := cmd.Flags().GetString("relay")
+		if err := api.ReloadCredentials(relay); err != nil {
+			return err
+		}
+		fmt.Println("Relay credentials reloaded.")
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(reloadCmd)
+	reloadCmd.Flags().String("relay", "127.0.0.1:9443", "Address of the relay admin API.")
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke",
+	Short: "Revoke a party",
+	Long:  `Revoke a party `,
+	Run: func(cmd *cobra.Command, args []string) {
+
+	},
+}
+
+var revokePartyCmd = &cobra.Command{
+	Use:   "party",
+	Short: "Revoke the relay and E2E certificates of a party",
+	Long:  `Revoke the relay and E2E certificates of a party and publish the relay and user CRLs`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		name, _ := cmd.Flags().GetString("name")
+		user, _ := cmd.Flags().GetString("user")
+		return api.RevokeParty(name, user)
+	},
+}
+
+var publishCmd = &cobra.Command{
+	Use:   "publish",
+	Short: "Publish revocation lists",
+	Long:  `Publish revocation lists `,
+	Run: func(cmd *cobra.Command, args []string) {
+
+	},
+}
+
+var publishCRLCmd = &cobra.Command{
+	Use:   "crl",
+	Short: "Publish the CRL of the relay CA, or of a user CA",
+	Long:  `Publish the CRL of the relay CA, or of the CA of a user with --user, renewing its validity`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		user, _ := cmd.Flags().GetString("user")
+		if user == "" {
+			return api.PublishRelayCRL()
+		}
+		return api.PublishUserCRL(user)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(revokeCmd)
+	revokeCmd.AddCommand(revokePartyCmd)
+	revokePartyCmd.Flags().String("name", "", "Party name.")
+	revokePartyCmd.Flags().String("user", "", "User name associated.")
+	revokePartyCmd.MarkFlagRequired("name")
+	revokePartyCmd.MarkFlagRequired("user")
+	rootCmd.AddCommand(publishCmd)
+	publishCmd.AddCommand(publishCRLCmd)
+	publishCRLCmd.Flags().String("user", "", "User name, the relay CRL is published if empty.")
+}
@@ -17,6 +17,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/flock-org/flock/relay/config"
 	"github.com/spf13/cobra"
 )
 
@@ -28,11 +29,22 @@ var rootCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 
 	},
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		certsDir, _ := cmd.Flags().GetString("certs-dir")
+		config.SetCertsDirectory(certsDir)
+	},
+	// Execute reports the error, usage is only printed on request
+	SilenceErrors: true,
+	SilenceUsage:  true,
 }
 
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Fprintf(os.Stderr, "Whoops. There was an error while executing your CLI '%s'", err)
+		fmt.Fprintf(os.Stderr, "Whoops. There was an error while executing your CLI '%s'\n", err)
 		os.Exit(1)
 	}
 }
+
+func init() {
+	rootCmd.PersistentFlags().String("certs-dir", config.BaseDirectory(), "Directory of the relay and user certificates, also set by "+config.CertsDirectoryEnv)
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package admin
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/spf13/cobra"
+)
+
+var sessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "Manage the sessions of a running relay",
+	Long:  `Manage the sessions of a running relay through its admin API`,
+	Run: func(cmd *cobra.Command, args []string) {
+
+	},
+}
+
+var listSessionsCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the parked and paired sessions",
+	Long:  `List the parked and paired sessions`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		relay, _ := cmd.Flags().GetString("relay")
+		user, _ := cmd.Flags().GetString("user")
+		sessions, err := api.ListSessions(relay, user)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "USER\tSRC\tDST\tTAG\tSTATE\tSRC ADDR\tDST ADDR\tAGE\tSRC BYTES\tDST BYTES")
+		for _, s := range sessions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%d\n", s.User, s.SrcParty, s.DstParty, s.Tag, s.State,
+				s.SrcAddr, s.DstAddr, s.Age, s.SrcBytes, s.DstBytes)
+		}
+		return w.Flush()
+	},
+}
+
+var terminateSessionsCmd = &cobra.Command{
+	Use:   "terminate",
+	Short: "Terminate a session, or every session of a user",
+	Long:  `Terminate a session, or every session of a user when no party or tag is given`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		relay, _ := cmd.Flags().GetString("relay")
+		user, _ := cmd.Flags().GetString("user")
+		src, _ := cmd.Flags().GetString("src")
+		dst, _ := cmd.Flags().GetString("dst")
+		tag, _ := cmd.Flags().GetString("tag")
+		terminated, err := api.TerminateSessions(relay, user, src, dst, tag)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Terminated %d session(s).\n", terminated)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(sessionsCmd)
+	sessionsCmd.PersistentFlags().String("relay", "127.0.0.1:9443", "Address of the relay admin API.")
+	sessionsCmd.AddCommand(listSessionsCmd)
+	listSessionsCmd.Flags().String("user", "", "Only list the sessions of this user.")
+	sessionsCmd.AddCommand(terminateSessionsCmd)
+	terminateSessionsCmd.Flags().String("user", "", "User whose sessions are terminated.")
+	terminateSessionsCmd.Flags().String("src", "", "Only terminate the sessions of this party.")
+	terminateSessionsCmd.Flags().String("dst", "", "Only terminate the sessions with this peer party.")
+	terminateSessionsCmd.Flags().String("tag", "", "Only terminate the sessions with this tag.")
+	terminateSessionsCmd.MarkFlagRequired("user")
+}
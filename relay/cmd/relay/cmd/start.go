@@ -14,37 +14,87 @@
 package relay
 
 import (
+	"context"
 	"fmt"
+	"net"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"github.com/clusterlink-net/clusterlink/pkg/util"
 	"github.com/flock-org/flock/relay/config"
 	relay "github.com/flock-org/flock/relay/pkg/core"
+	"github.com/flock-org/flock/relay/pkg/policy"
+	"github.com/flock-org/flock/relay/pkg/server"
+	"github.com/flock-org/flock/relay/pkg/webhook"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var rel relay.Relay
 
+// envPrefix prefixes the environment variables overriding the start flags, e.g. FLOCK_RELAY_PORT
+const envPrefix = "FLOCK_RELAY_"
+
+// policyReloadInterval is how often the policy file is checked for changes
+const policyReloadInterval = 5 * time.Second
+
+// credentialsReloadInterval is how often the relay certificate and CA files are checked for changes
+const credentialsReloadInterval = 5 * time.Second
+
 // startCmd represents the start command
 var startCmd = &cobra.Command{
 	Use:   "start",
 	Short: "Start command starts the flock relay on the specified port",
 	Long:  `Start command starts the flow relay on the specific port`,
 	Run: func(cmd *cobra.Command, args []string) {
+		if err := config.LoadSettings(cmd.Flags(), envPrefix); err != nil {
+			fmt.Printf("Unable to load settings: %v\n", err)
+			os.Exit(1)
+		}
 		ip, _ := cmd.Flags().GetString("ip")
 		port, _ := cmd.Flags().GetString("port")
+		addresses, _ := cmd.Flags().GetStringSlice("listen")
+		metricsPort, _ := cmd.Flags().GetString("metrics-port")
+		apiPort, _ := cmd.Flags().GetString("api-port")
+		adminPort, _ := cmd.Flags().GetString("admin-port")
+		relayTarget, _ := cmd.Flags().GetString("relay-target")
+		policyFile, _ := cmd.Flags().GetString("policy")
 		debug, _ := cmd.Flags().GetBool("debug")
+		logFormat, _ := cmd.Flags().GetString("log-format")
+		certsDir, _ := cmd.Flags().GetString("certs-dir")
+		rendezvousTimeout, _ := cmd.Flags().GetDuration("rendezvous-timeout")
+		handshakeTimeout, _ := cmd.Flags().GetDuration("handshake-timeout")
+		handshakeWorkers, _ := cmd.Flags().GetInt("handshake-workers")
+		maxPendingHandshakes, _ := cmd.Flags().GetInt("max-pending-handshakes")
+		idleTimeout, _ := cmd.Flags().GetDuration("idle-timeout")
+		maxSessionLifetime, _ := cmd.Flags().GetDuration("max-session-lifetime")
+		drainTimeout, _ := cmd.Flags().GetDuration("drain-timeout")
+		trustedCAs, _ := cmd.Flags().GetStringSlice("trusted-ca")
+		peers, _ := cmd.Flags().GetStringSlice("peer")
+		webhookCIDRs, _ := cmd.Flags().GetStringSlice("webhook-network")
+		mailboxSize, _ := cmd.Flags().GetInt("mailbox-size")
+		mailboxTTL, _ := cmd.Flags().GetDuration("mailbox-ttl")
+		mailboxUserSize, _ := cmd.Flags().GetInt("mailbox-user-size")
+		mailboxPartySize, _ := cmd.Flags().GetInt("mailbox-party-size")
+		maxUserMailboxes, _ := cmd.Flags().GetInt("max-user-mailboxes")
+		maxPartyMailboxes, _ := cmd.Flags().GetInt("max-party-mailboxes")
 		ll := logrus.InfoLevel
 		if debug == true {
 			ll = logrus.DebugLevel
 		}
-		rel.Init(ip, port, ll)
+		if err := rel.Init(ip, port, ll, logFormat); err != nil {
+			fmt.Printf("Unable to initialize relay: %v\n", err)
+			os.Exit(1)
+		}
+		config.SetCertsDirectory(certsDir)
 
 		relayDirectory := config.FlockrelayCADirectory()
 
 		// parse TLS files
-		parsedCertData, err := util.ParseTLSFiles(config.FrCAFileRoot,
+		parsedCertData, err := util.ParseTLSFiles(config.FrCAFile(),
 			filepath.Join(relayDirectory, config.CertificateFileName),
 			filepath.Join(relayDirectory, config.PrivateKeyFileName))
 		if err != nil {
@@ -52,18 +102,119 @@ var startCmd = &cobra.Command{
 			return
 		}
 
-		rel.StartRelay(parsedCertData, port)
+		webhookNetworks, err := webhook.ParseNetworks(webhookCIDRs)
+		if err != nil {
+			fmt.Printf("Unable to parse webhook networks: %v", err)
+			return
+		}
+
+		credentials, err := server.NewCredentials(trustedCAs)
+		if err != nil {
+			fmt.Printf("Unable to load relay credentials: %v", err)
+			return
+		}
+
+		var policyEngine *policy.Engine
+		if policyFile != "" {
+			policyEngine, err = policy.NewEngine(policyFile)
+		} else {
+			// The policies and webhooks set over the API are kept with the certificates, so they survive restarts
+			policyEngine, err = policy.OpenEngine(config.DefaultPolicyFile())
+		}
+		if err != nil {
+			fmt.Printf("Unable to load policy: %v", err)
+			return
+		}
+		go policyEngine.Watch(policyReloadInterval)
 
-		// TODO: Start API Server which integrates with the application provider to hand out certificates
+		// Start API Server which integrates with the application provider to hand out certificates
+		if apiPort != "" {
+			go rel.StartAPIServer(parsedCertData, apiPort, relayTarget, policyEngine, credentials, webhookNetworks)
+		}
 
-		// apiServer := server.NewAPIServer(parsedCertData)
-		// apiServer.StartFlockAPIServer()
+		if len(addresses) == 0 {
+			addresses = []string{net.JoinHostPort(ip, port)}
+		}
+		// SIGTERM or an interrupt drains the relay, a second one exits immediately
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
+		// New handshakes use the rotated certificate and CAs, reloaded when their files change or on SIGHUP
+		go credentials.Watch(ctx, credentialsReloadInterval)
+		go reloadOnHangup(ctx, credentials)
+		if err := rel.StartRelay(ctx, parsedCertData, addresses, metricsPort, adminPort, server.Options{
+			RendezvousTimeout:    rendezvousTimeout,
+			HandshakeTimeout:     handshakeTimeout,
+			HandshakeWorkers:     handshakeWorkers,
+			MaxPendingHandshakes: maxPendingHandshakes,
+			IdleTimeout:          idleTimeout,
+			MaxSessionLifetime:   maxSessionLifetime,
+			DrainTimeout:         drainTimeout,
+			Credentials:          credentials,
+			Policy:               policyEngine,
+			MailboxSize:          mailboxSize,
+			MailboxTTL:           mailboxTTL,
+			MailboxUserSize:      mailboxUserSize,
+			MailboxPartySize:     mailboxPartySize,
+			MaxUserMailboxes:     maxUserMailboxes,
+			MaxPartyMailboxes:    maxPartyMailboxes,
+			Peers:                peers,
+			WebhookNetworks:      webhookNetworks,
+		}); err != nil {
+			fmt.Printf("Relay stopped: %v\n", err)
+			os.Exit(1)
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(startCmd)
-	startCmd.Flags().String("ip", "", "Optional IP address to bind the flock relay")
+	startCmd.Flags().String(config.ConfigFlag, "", "Optional YAML settings file, keyed by flag name; flags and FLOCK_RELAY_* environment variables take precedence")
+	startCmd.Flags().String("certs-dir", config.BaseDirectory(), "Directory of the relay and user certificates")
+	startCmd.Flags().String("log-format", "text", "Log format, text or json")
+	startCmd.Flags().String("ip", "", "Optional IP address to bind the flock relay, and its metrics, API and admin servers")
 	startCmd.Flags().String("port", "9000", "Port to bind the flock relay (default:9000)")
+	startCmd.Flags().StringSlice("listen", nil, "Addresses to bind the flock relay, host:port, unix:<socket path>, or ws://host:port/path and wss://host:port/path for WebSocket upgrades, repeatable (default: ip:port)")
+	startCmd.Flags().String("metrics-port", "", "Optional port to serve Prometheus metrics at /metrics")
+	startCmd.Flags().String("api-port", "", "Optional port to serve the user/party provisioning API over HTTPS")
+	startCmd.Flags().String("admin-port", "", "Optional port to serve the session admin API over HTTPS, authenticated with the relay certificate")
+	startCmd.Flags().String("relay-target", "", "Relay address handed out to provisioned parties (default: ip:port)")
+	startCmd.Flags().String("policy", "", "Optional access-control policy file (JSON), reloaded when it changes (default: policy.json in the certs directory, if it exists)")
 	startCmd.Flags().Bool("debug", false, "Debug mode with verbose prints")
+	startCmd.Flags().Duration("rendezvous-timeout", server.DefaultRendezvousTimeout, "Time a party waits for its peer before it is evicted")
+	startCmd.Flags().Duration("handshake-timeout", server.DefaultHandshakeTimeout, "Time allowed for a party's TLS handshake and auth request")
+	startCmd.Flags().Int("handshake-workers", server.DefaultHandshakeWorkers, "Number of TLS handshakes run concurrently")
+	startCmd.Flags().Int("max-pending-handshakes", server.DefaultMaxPendingHandshakes, "Accepted connections queued for a handshake before new ones are rejected")
+	startCmd.Flags().Duration("idle-timeout", server.DefaultIdleTimeout, "Time a forwarded session may carry no data before it is closed (0 disables)")
+	startCmd.Flags().Duration("max-session-lifetime", 0, "Maximum duration of a forwarded session (0 disables)")
+	startCmd.Flags().StringSlice("trusted-ca", nil, "Additional CA bundles trusted for party certificates, e.g. while rotating the relay CA, repeatable")
+	startCmd.Flags().Int("mailbox-size", server.DefaultMailboxSize, "Bytes of messages buffered in each mailbox for a party that is not connected (0 disables the mailbox)")
+	startCmd.Flags().Duration("mailbox-ttl", server.DefaultMailboxTTL, "Time a mailbox message is kept for its party to attach")
+	startCmd.Flags().Int("mailbox-user-size", server.DefaultMailboxUserSize, "Bytes of messages buffered in all the mailboxes of a user (0 is unlimited)")
+	startCmd.Flags().Int("mailbox-party-size", server.DefaultMailboxPartySize, "Bytes of messages buffered in all the mailboxes a party sends to (0 is unlimited)")
+	startCmd.Flags().Int("max-user-mailboxes", server.DefaultMaxUserMailboxes, "Mailboxes holding messages of a user (0 is unlimited)")
+	startCmd.Flags().Int("max-party-mailboxes", server.DefaultMaxPartyMailboxes, "Mailboxes holding messages sent by a party (0 is unlimited)")
+	startCmd.Flags().StringSlice("webhook-network", nil, "Network in CIDR notation that webhooks may target besides public addresses, e.g. an internal function platform, repeatable")
+	startCmd.Flags().StringSlice("peer", nil, "Address of a peer relay, host:port or unix:<socket path>, whose parties may be paired with the parties of this relay, repeatable")
+	startCmd.Flags().Duration("drain-timeout", server.DefaultDrainTimeout, "Time the forwarded sessions may run on SIGTERM before the relay closes them and exits")
+}
+
+// reloadOnHangup reloads the relay credentials on SIGHUP, until ctx is done
+func reloadOnHangup(ctx context.Context, credentials *server.Credentials) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			if err := credentials.Reload(); err != nil {
+				fmt.Printf("Unable to reload relay credentials: %v\n", err)
+			}
+		}
+	}
 }
@@ -13,48 +13,114 @@
 
 package config
 
-import "path/filepath"
+import (
+	"os"
+	"path/filepath"
+)
 
 const (
 	//FlockrelayServerName is the servername used in flockrelay router
 	FlockrelayServerName = "flockrelay"
-	//CertsRootDirectory is the directory for storing all certs it can be changed to /etc/ssl/certs
-	CertsRootDirectory = "certs"
-	//CertsDirectory is the directory for storing all certs it can be changed to /etc/ssl/certs
-	CertsDirectory = "certs"
-	// FrCAFile is the path to the certificate authority file.
-	FrCAFile = CertsRootDirectory + "/flockrelay-ca.pem"
-	// FrCAFileRoot is the path to the certificate authority file.
-	FrCAFileRoot = CertsDirectory + "/flockrelay-ca.pem"
-	// FrKeyFile is the path to the private-key file.
-	FrKeyFile = CertsDirectory + "/flockrelay-key.pem"
+	// DefaultCertsDirectory is the directory storing all certs unless another one is configured
+	DefaultCertsDirectory = "certs"
+	// CertsDirectoryEnv is the environment variable overriding the certs directory
+	CertsDirectoryEnv = "FLOCK_CERTS_DIR"
+	// FrCAFileName is the filename of the certificate authority file.
+	FrCAFileName = "flockrelay-ca.pem"
+	// FrKeyFileName is the filename of the private-key file of the certificate authority.
+	FrKeyFileName = "flockrelay-key.pem"
+	// FrCRLFileName is the filename of the revocation list of the certificate authority.
+	FrCRLFileName = "flockrelay-crl.pem"
 
 	// PrivateKeyFileName is the filename used by private key files.
 	PrivateKeyFileName = "key.pem"
 	// CertificateFileName is the filename used by certificate files.
 	CertificateFileName = "cert.pem"
+	// RelayPrivateKeyFileName is the filename of the private key of the relay certificate of a party.
+	RelayPrivateKeyFileName = "relay-key.pem"
+	// RelayCertificateFileName is the filename of the relay certificate of a party.
+	RelayCertificateFileName = "relay-cert.pem"
+	// OpenedSeqFilePrefix prefixes the file, named after the peer, of the sequence numbers of the mailbox messages a party opened.
+	OpenedSeqFilePrefix = "opened-"
+	// PendingBundleFileName marks a party provisioned over the API whose bundle was not fetched yet.
+	PendingBundleFileName = "bundle-pending"
 
 	// UserCAFile is the path to CA cert of the user
 	UserCAFile = "user-ca.pem"
 	// UserKeyFile is the private key file
 	UserKeyFile = "user-key.pem"
+	// UserCRLFile is the revocation list of the CA of the user
+	UserCRLFile = "user-crl.pem"
+
+	// PolicyFileName is the filename of the policy file kept with the certificates when none is configured.
+	PolicyFileName = "policy.json"
 )
 
+// certsDirectory is the base path of all certificates, relative paths are resolved from the working directory
+var certsDirectory = DefaultCertsDirectory
+
+func init() {
+	if dir := os.Getenv(CertsDirectoryEnv); dir != "" {
+		certsDirectory = dir
+	}
+}
+
+// SetCertsDirectory changes the base path of all certificates, it must be called before any certificate is used.
+func SetCertsDirectory(dir string) {
+	certsDirectory = dir
+}
+
 // BaseDirectory returns the base path of the fabric certificates.
 func BaseDirectory() string {
-	return CertsRootDirectory
+	return certsDirectory
+}
+
+// FrCAFile returns the path to the certificate authority file.
+func FrCAFile() string {
+	return filepath.Join(BaseDirectory(), FrCAFileName)
+}
+
+// FrKeyFile returns the path to the private-key file of the certificate authority.
+func FrKeyFile() string {
+	return filepath.Join(BaseDirectory(), FrKeyFileName)
 }
 
-// BaseDirectoryRelay returns the base path of the fabric certificates.
-func BaseDirectoryRelay() string {
-	return CertsDirectory
+// FrCRLFile returns the path to the revocation list of the certificate authority.
+func FrCRLFile() string {
+	return filepath.Join(BaseDirectory(), FrCRLFileName)
 }
 
-// PartyDirectory returns the base path for a specific party within the relay's domain for auth.
-func PartyDirectory(party string) string {
+// DefaultPolicyFile returns the path to the policy file used when none is configured.
+func DefaultPolicyFile() string {
+	return filepath.Join(BaseDirectory(), PolicyFileName)
+}
+
+// LegacyPartyDirectory returns the path where the relay certificate of a party was stored before it was
+// moved next to its E2E certificate, a path the parties of the same name of every user collided on.
+func LegacyPartyDirectory(party string) string {
 	return filepath.Join(BaseDirectory(), party)
 }
 
+// PartyRelayCertFile returns the path to the relay certificate of a party of a user.
+func PartyRelayCertFile(user string, party string) string {
+	return filepath.Join(UserPartyDirectory(user, party), RelayCertificateFileName)
+}
+
+// PartyRelayKeyFile returns the path to the private key of the relay certificate of a party of a user.
+func PartyRelayKeyFile(user string, party string) string {
+	return filepath.Join(UserPartyDirectory(user, party), RelayPrivateKeyFileName)
+}
+
+// PartyPendingBundleFile returns the path to the marker of the bundle of a party that was not fetched yet.
+func PartyPendingBundleFile(user string, party string) string {
+	return filepath.Join(UserPartyDirectory(user, party), PendingBundleFileName)
+}
+
+// PartyOpenedSeqFile returns the path to the sequence numbers of the mailbox messages a party opened from peer.
+func PartyOpenedSeqFile(user string, party string, peer string) string {
+	return filepath.Join(UserPartyDirectory(user, party), OpenedSeqFilePrefix+peer+".json")
+}
+
 // UserDirectory returns the base path for a specific party.
 func UserDirectory(user string) string {
 	return filepath.Join(BaseDirectory(), user)
@@ -72,5 +138,5 @@ func FlockrelayDirectory() string {
 
 // FlockrelayCADirectory returns the base path for a relay
 func FlockrelayCADirectory() string {
-	return filepath.Join(BaseDirectoryRelay(), FlockrelayServerName)
+	return FlockrelayDirectory()
 }
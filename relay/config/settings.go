@@ -0,0 +1,97 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFlag is the flag naming the settings file
+const ConfigFlag = "config"
+
+// LoadSettings fills the flags that were not set on the command line, first from the environment and
+// then from the YAML settings file named by the config flag, leaving the remaining flags at their defaults.
+// A flag such as --idle-timeout is read from the environment variable <envPrefix>IDLE_TIMEOUT,
+// and from the idle-timeout key of the settings file.
+func LoadSettings(flags *pflag.FlagSet, envPrefix string) error {
+	file, _ := flags.GetString(ConfigFlag)
+	if !flags.Changed(ConfigFlag) {
+		if env, ok := os.LookupEnv(envName(envPrefix, ConfigFlag)); ok {
+			file = env
+		}
+	}
+	settings, err := readSettings(file)
+	if err != nil {
+		return err
+	}
+	for name := range settings {
+		if name == ConfigFlag || flags.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q in %s", name, file)
+		}
+	}
+
+	var setErr error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if setErr != nil || f.Changed || f.Name == ConfigFlag {
+			return
+		}
+		values, source := []string{}, envName(envPrefix, f.Name)
+		if env, ok := os.LookupEnv(source); ok {
+			values = append(values, env)
+		} else if setting, ok := settings[f.Name]; ok {
+			source = file
+			// The values of a list are added one by one to a repeatable flag
+			if list, ok := setting.([]interface{}); ok {
+				for _, v := range list {
+					values = append(values, fmt.Sprint(v))
+				}
+			} else {
+				values = append(values, fmt.Sprint(setting))
+			}
+		}
+		for _, value := range values {
+			if err := flags.Set(f.Name, value); err != nil {
+				setErr = fmt.Errorf("invalid %s in %s: %v", f.Name, source, err)
+				return
+			}
+		}
+	})
+	return setErr
+}
+
+// readSettings reads a YAML settings file, no file means no settings
+func readSettings(file string) (map[string]interface{}, error) {
+	settings := map[string]interface{}{}
+	if file == "" {
+		return settings, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read settings file: %v", err)
+	}
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("unable to parse settings file %s: %v", file, err)
+	}
+	return settings, nil
+}
+
+// envName returns the environment variable of a flag, e.g. FLOCK_RELAY_IDLE_TIMEOUT for idle-timeout
+func envName(envPrefix, flag string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
@@ -23,36 +23,26 @@ import (
 	"github.com/flock-org/flock/relay/config"
 )
 
-func createFlockrelayCerts(entity string) {
+func createFlockrelayCerts(entity, user string) error {
 	fmt.Printf("Creating Party %s certs for Flock relay auth.\n", entity)
-	partyDirectory := config.PartyDirectory(entity)
-	if err := os.MkdirAll(partyDirectory, 0755); err != nil {
-		fmt.Printf("Unable to create directory :%v\n", err)
-		return
+	if err := os.MkdirAll(config.UserPartyDirectory(user, entity), 0755); err != nil {
+		return fmt.Errorf("unable to create directory: %v", err)
 	}
-	err := util.CreateCertificate(&util.CertificateConfig{
-		Name:              entity,
-		IsClient:          true,
-		DNSNames:          []string{entity},
-		CAPath:            config.FrCAFile,
-		CAKeyPath:         config.FrKeyFile,
-		CertOutPath:       filepath.Join(partyDirectory, config.CertificateFileName),
-		PrivateKeyOutPath: filepath.Join(partyDirectory, config.PrivateKeyFileName),
-	})
+	// Tagged with the user domain
+	err := createRelayCertificate(entity, user, false, config.PartyRelayCertFile(user, entity), config.PartyRelayKeyFile(user, entity))
 	if err != nil {
-		fmt.Printf("Unable to generate certficate/key :%v\n", err)
-		return
+		return fmt.Errorf("unable to generate certficate/key: %v", err)
 	}
+	return nil
 }
 
-func createUserCerts(user, party string) {
-	fmt.Printf("Creating Party %s certs for multi-party comms for user %s\n", user, party)
+func createUserCerts(user, party string) error {
+	fmt.Printf("Creating Party %s certs for multi-party comms for user %s\n", party, user)
 	partyDirectory := config.UserPartyDirectory(user, party)
 	userDirectory := config.UserDirectory(user)
 
 	if err := os.MkdirAll(partyDirectory, 0755); err != nil {
-		fmt.Printf("Unable to create directory :%v\n", err)
-		return
+		return fmt.Errorf("unable to create directory: %v", err)
 	}
 	err := util.CreateCertificate(&util.CertificateConfig{
 		Name:              party,
@@ -65,17 +55,82 @@ func createUserCerts(user, party string) {
 		PrivateKeyOutPath: filepath.Join(partyDirectory, config.PrivateKeyFileName),
 	})
 	if err != nil {
-		fmt.Printf("Unable to generate certficate/key :%v\n", err)
-		return
+		return fmt.Errorf("unable to generate certficate/key: %v", err)
 	}
+	return nil
 }
 
-func CreateUser(name string) {
-	fmt.Printf("Creating CA Cert for user %s.\n", name)
+// migrateLegacyParty moves the relay certificate of a party of user from its legacy directory, shared by the
+// parties of the same name of every user, next to its E2E certificate. A legacy certificate of another user
+// is left in place, so it is never read, renewed or overwritten on behalf of this user.
+func migrateLegacyParty(user, party string) error {
+	legacyDirectory := config.LegacyPartyDirectory(party)
+	legacyCert := filepath.Join(legacyDirectory, config.CertificateFileName)
+	if !exists(legacyCert) || exists(config.PartyRelayCertFile(user, party)) {
+		return nil
+	}
+	cert, err := loadCertificate(legacyCert)
+	if err != nil {
+		return fmt.Errorf("unable to read legacy relay certificate of party %s: %v", party, err)
+	}
+	if len(cert.Subject.OrganizationalUnit) == 0 || cert.Subject.OrganizationalUnit[0] != user {
+		return nil
+	}
+	fmt.Printf("Moving the relay certs of Party %s of user %s out of %s.\n", party, user, legacyDirectory)
+	if err := os.MkdirAll(config.UserPartyDirectory(user, party), 0755); err != nil {
+		return fmt.Errorf("unable to create directory: %v", err)
+	}
+	if err := os.Rename(filepath.Join(legacyDirectory, config.PrivateKeyFileName), config.PartyRelayKeyFile(user, party)); err != nil {
+		return fmt.Errorf("unable to move legacy relay key of party %s: %v", party, err)
+	}
+	if err := os.Rename(legacyCert, config.PartyRelayCertFile(user, party)); err != nil {
+		return fmt.Errorf("unable to move legacy relay certificate of party %s: %v", party, err)
+	}
+	// Only removed once empty
+	os.Remove(legacyDirectory)
+	return nil
+}
+
+// MigrateLegacyParties moves the relay certificates of every party out of the legacy layout, see migrateLegacyParty
+func MigrateLegacyParties() error {
+	entries, err := os.ReadDir(config.BaseDirectory())
+	if err != nil {
+		return fmt.Errorf("unable to read certificates directory: %v", err)
+	}
+	for _, entry := range entries {
+		legacyCert := filepath.Join(config.LegacyPartyDirectory(entry.Name()), config.CertificateFileName)
+		if !entry.IsDir() || entry.Name() == config.FlockrelayServerName || !exists(legacyCert) {
+			continue
+		}
+		cert, err := loadCertificate(legacyCert)
+		if err != nil {
+			return fmt.Errorf("unable to read legacy relay certificate of party %s: %v", entry.Name(), err)
+		}
+		if len(cert.Subject.OrganizationalUnit) == 0 {
+			fmt.Printf("Skipping Party %s, its relay certs carry no user domain and must be re-created.\n", entry.Name())
+			continue
+		}
+		if err := migrateLegacyParty(cert.Subject.OrganizationalUnit[0], entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateUser creates the CA of a user domain, refusing to overwrite an existing one unless force is set
+func CreateUser(name string, force bool) error {
+	// The user domain of a party is its organizational unit, which identifies the relay for this name
+	if name == config.FlockrelayServerName {
+		return fmt.Errorf("user name %s is reserved for the relay", name)
+	}
 	userDirectory := config.UserDirectory(name)
+	if err := checkOverwrite(force, filepath.Join(userDirectory, config.UserCAFile),
+		filepath.Join(userDirectory, config.UserKeyFile)); err != nil {
+		return err
+	}
+	fmt.Printf("Creating CA Cert for user %s.\n", name)
 	if err := os.MkdirAll(userDirectory, 0755); err != nil {
-		fmt.Printf("Unable to create directory :%v\n", err)
-		return
+		return fmt.Errorf("unable to create directory: %v", err)
 	}
 	err := util.CreateCertificate(&util.CertificateConfig{
 		Name:              name,
@@ -84,52 +139,221 @@ func CreateUser(name string) {
 		PrivateKeyOutPath: filepath.Join(userDirectory, config.UserKeyFile),
 	})
 	if err != nil {
-		fmt.Printf("Unable to generate CA certficate :%v\n", err)
-		return
+		return fmt.Errorf("unable to generate CA certficate: %v", err)
+	}
+	return PublishUserCRL(name)
+}
+
+// CreateParty creates the certificates of a party under both the relay CA and the user CA,
+// refusing to overwrite existing ones unless force is set
+func CreateParty(party string, user string, force bool) error {
+	// The relay tells peer relays from parties by this Common Name
+	if party == config.FlockrelayServerName {
+		return fmt.Errorf("party name %s is reserved for the relay", party)
+	}
+	if err := migrateLegacyParty(user, party); err != nil {
+		return err
+	}
+	userPartyDirectory := config.UserPartyDirectory(user, party)
+	err := checkOverwrite(force, config.PartyRelayCertFile(user, party), config.PartyRelayKeyFile(user, party),
+		filepath.Join(userPartyDirectory, config.CertificateFileName),
+		filepath.Join(userPartyDirectory, config.PrivateKeyFileName))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filepath.Join(config.UserDirectory(user), config.UserCAFile)); err != nil {
+		return fmt.Errorf("unable to find CA of user %s, create the user first: %v", user, err)
+	}
+	// Create certs using Flock relay's CA cert, tagged with the user domain
+	if err := createFlockrelayCerts(party, user); err != nil {
+		return err
+	}
+	return createUserCerts(user, party)
+}
+
+// ReadPartyBundle reads the certificates and keys of a party created by CreateParty
+func ReadPartyBundle(party string, user string) (*PartyBundle, error) {
+	if err := migrateLegacyParty(user, party); err != nil {
+		return nil, err
+	}
+	userPartyDirectory := config.UserPartyDirectory(user, party)
+	bundle := &PartyBundle{}
+	for path, dst := range map[string]*string{
+		config.FrCAFile():                                             &bundle.RelayCA,
+		config.PartyRelayCertFile(user, party):                        &bundle.RelayCert,
+		config.PartyRelayKeyFile(user, party):                         &bundle.RelayKey,
+		filepath.Join(config.UserDirectory(user), config.UserCAFile):  &bundle.UserCA,
+		filepath.Join(userPartyDirectory, config.CertificateFileName): &bundle.PartyCert,
+		filepath.Join(userPartyDirectory, config.PrivateKeyFileName):  &bundle.PartyKey,
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %v", path, err)
+		}
+		*dst = string(data)
+	}
+	return bundle, nil
+}
+
+// RevokeParty revokes the certificates of a party under both the relay CA and the user CA, and publishes the updated CRLs
+func RevokeParty(party string, user string) error {
+	if err := migrateLegacyParty(user, party); err != nil {
+		return err
+	}
+	relayCert, err := loadCertificate(config.PartyRelayCertFile(user, party))
+	if err != nil {
+		return fmt.Errorf("unable to read relay certificate of party %s: %v", party, err)
+	}
+	userCert, err := loadCertificate(filepath.Join(config.UserPartyDirectory(user, party), config.CertificateFileName))
+	if err != nil {
+		return fmt.Errorf("unable to read certificate of party %s of user %s: %v", party, user, err)
+	}
+	fmt.Printf("Revoking Party %s certs (serials %s, %s).\n", party, relayCert.SerialNumber, userCert.SerialNumber)
+	if err := publishCRL(config.FrCAFile(), config.FrKeyFile(), config.FrCRLFile(), relayCert); err != nil {
+		return fmt.Errorf("unable to publish relay CRL: %v", err)
+	}
+	userDirectory := config.UserDirectory(user)
+	err = publishCRL(filepath.Join(userDirectory, config.UserCAFile), filepath.Join(userDirectory, config.UserKeyFile),
+		filepath.Join(userDirectory, config.UserCRLFile), userCert)
+	if err != nil {
+		return fmt.Errorf("unable to publish CRL of user %s: %v", user, err)
 	}
+	return nil
 }
 
-func CreateParty(party string, user string) {
-	// Create certs using Flock relay's CA cert
-	createFlockrelayCerts(party)
-	createUserCerts(user, party)
+// PublishRelayCRL (re)publishes the CRL of the relay CA with a renewed validity
+func PublishRelayCRL() error {
+	if err := publishCRL(config.FrCAFile(), config.FrKeyFile(), config.FrCRLFile()); err != nil {
+		return fmt.Errorf("unable to publish relay CRL: %v", err)
+	}
+	return nil
+}
+
+// PublishUserCRL (re)publishes the CRL of the CA of user with a renewed validity
+func PublishUserCRL(user string) error {
+	userDirectory := config.UserDirectory(user)
+	err := publishCRL(filepath.Join(userDirectory, config.UserCAFile), filepath.Join(userDirectory, config.UserKeyFile),
+		filepath.Join(userDirectory, config.UserCRLFile))
+	if err != nil {
+		return fmt.Errorf("unable to publish CRL of user %s: %v", user, err)
+	}
+	return nil
+}
+
+// partyRevoked reports whether the relay CRL or the CRL of the user lists a certificate of the party
+func partyRevoked(party string, user string) (bool, error) {
+	relayCert, err := loadCertificate(config.PartyRelayCertFile(user, party))
+	if err != nil {
+		return false, fmt.Errorf("unable to read relay certificate of party %s: %v", party, err)
+	}
+	userCert, err := loadCertificate(filepath.Join(config.UserPartyDirectory(user, party), config.CertificateFileName))
+	if err != nil {
+		return false, fmt.Errorf("unable to read certificate of party %s of user %s: %v", party, user, err)
+	}
+	revoked, err := isRevoked(config.FrCRLFile(), relayCert)
+	if err != nil || revoked {
+		return revoked, err
+	}
+	return isRevoked(filepath.Join(config.UserDirectory(user), config.UserCRLFile), userCert)
 }
 
-func CreateRelay() {
+// CreateRelay creates the relay CA and the relay server certificate, refusing to overwrite existing ones
+// unless force is set
+func CreateRelay(force bool) error {
+	flockrelayDirectory := config.FlockrelayCADirectory()
+	err := checkOverwrite(force, config.FrCAFile(), config.FrKeyFile(),
+		filepath.Join(flockrelayDirectory, config.CertificateFileName),
+		filepath.Join(flockrelayDirectory, config.PrivateKeyFileName))
+	if err != nil {
+		return err
+	}
 	fmt.Printf("Creating Flock relay CA Cert.\n")
 	if err := os.MkdirAll(config.BaseDirectory(), 0755); err != nil {
-		fmt.Printf("Unable to create directory :%v\n", err)
-		return
+		return fmt.Errorf("unable to create directory: %v", err)
 	}
-	err := util.CreateCertificate(&util.CertificateConfig{
+	err = util.CreateCertificate(&util.CertificateConfig{
 		Name:              config.FlockrelayServerName,
 		IsCA:              true,
-		CertOutPath:       config.FrCAFile,
-		PrivateKeyOutPath: config.FrKeyFile,
+		CertOutPath:       config.FrCAFile(),
+		PrivateKeyOutPath: config.FrKeyFile(),
 	})
 	if err != nil {
-		fmt.Printf("Unable to generate CA certficate :%v\n", err)
-		return
+		return fmt.Errorf("unable to generate CA certficate: %v", err)
 	}
 	fmt.Printf("Generating Certs/Key using CA.\n")
 
-	flockrelayDirectory := config.FlockrelayCADirectory()
 	if err := os.MkdirAll(flockrelayDirectory, 0755); err != nil {
-		fmt.Printf("Unable to create directory :%v\n", err)
-		return
+		return fmt.Errorf("unable to create directory: %v", err)
 	}
-	err = util.CreateCertificate(&util.CertificateConfig{
-		Name:              config.FlockrelayServerName,
-		IsServer:          true,
-		IsClient:          true,
-		DNSNames:          []string{config.FlockrelayServerName},
-		CAPath:            config.FrCAFileRoot,
-		CAKeyPath:         config.FrKeyFile,
-		CertOutPath:       filepath.Join(flockrelayDirectory, config.CertificateFileName),
-		PrivateKeyOutPath: filepath.Join(flockrelayDirectory, config.PrivateKeyFileName),
-	})
+	// The relay certificate carries the relay name as its user domain, which no party may have
+	err = createRelayCertificate(config.FlockrelayServerName, config.FlockrelayServerName, true,
+		filepath.Join(flockrelayDirectory, config.CertificateFileName),
+		filepath.Join(flockrelayDirectory, config.PrivateKeyFileName))
+	if err != nil {
+		return fmt.Errorf("unable to generate certficate/key: %v", err)
+	}
+	return PublishRelayCRL()
+}
+
+// RenewRelay re-issues the relay CA and the relay server certificate with their identity and keys,
+// so the certificates the relay CA already signed remain valid. The relay certificate is re-issued with
+// the relay user domain, which relay certificates created before it was introduced lack.
+func RenewRelay() error {
+	fmt.Printf("Renewing Flock relay CA Cert.\n")
+	if err := renewCertificate(config.FrCAFile(), config.FrKeyFile(), "", "", "", false); err != nil {
+		return fmt.Errorf("unable to renew relay CA certificate: %v", err)
+	}
+	flockrelayDirectory := config.FlockrelayCADirectory()
+	err := renewCertificate(filepath.Join(flockrelayDirectory, config.CertificateFileName),
+		filepath.Join(flockrelayDirectory, config.PrivateKeyFileName), config.FrCAFile(), config.FrKeyFile(), config.FlockrelayServerName, false)
+	if err != nil {
+		return fmt.Errorf("unable to renew relay certificate: %v", err)
+	}
+	return nil
+}
+
+// RenewUser re-issues the CA of a user domain with its identity and key
+func RenewUser(name string) error {
+	fmt.Printf("Renewing CA Cert for user %s.\n", name)
+	userDirectory := config.UserDirectory(name)
+	err := renewCertificate(filepath.Join(userDirectory, config.UserCAFile), filepath.Join(userDirectory, config.UserKeyFile), "", "", "", false)
+	if err != nil {
+		return fmt.Errorf("unable to renew CA certificate of user %s: %v", name, err)
+	}
+	return nil
+}
+
+// RenewParty re-issues the certificates of a party under both the relay CA and the user CA with their identity and keys.
+// A party whose certificates were revoked is only renewed with force, and then with new keys, so that a revoked key
+// never gets a valid certificate again.
+func RenewParty(party string, user string, force bool) error {
+	if err := migrateLegacyParty(user, party); err != nil {
+		return err
+	}
+	userDirectory := config.UserDirectory(user)
+	userPartyDirectory := config.UserPartyDirectory(user, party)
+	revoked, err := partyRevoked(party, user)
+	if err != nil {
+		return err
+	}
+	if revoked && !force {
+		return fmt.Errorf("certificates of party %s of user %s are revoked, renew them with --force to issue them with new keys", party, user)
+	}
+	if revoked {
+		fmt.Printf("Renewing revoked Party %s certs of user %s with new keys.\n", party, user)
+	} else {
+		fmt.Printf("Renewing Party %s certs of user %s.\n", party, user)
+	}
+	err = renewCertificate(config.PartyRelayCertFile(user, party), config.PartyRelayKeyFile(user, party),
+		config.FrCAFile(), config.FrKeyFile(), "", revoked)
+	if err != nil {
+		return fmt.Errorf("unable to renew relay certificate of party %s: %v", party, err)
+	}
+	err = renewCertificate(filepath.Join(userPartyDirectory, config.CertificateFileName),
+		filepath.Join(userPartyDirectory, config.PrivateKeyFileName),
+		filepath.Join(userDirectory, config.UserCAFile), filepath.Join(userDirectory, config.UserKeyFile), "", revoked)
 	if err != nil {
-		fmt.Printf("Unable to generate certficate/key :%v\n", err)
-		return
+		return fmt.Errorf("unable to renew certificate of party %s of user %s: %v", party, user, err)
 	}
+	return nil
 }
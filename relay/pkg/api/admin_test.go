@@ -0,0 +1,127 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flock-org/flock/relay/config"
+)
+
+// partyCerts loads the relay and E2E certificates of a party
+func partyCerts(t *testing.T, party, user string) (*x509.Certificate, *x509.Certificate) {
+	relayCert, err := loadCertificate(config.PartyRelayCertFile(user, party))
+	if err != nil {
+		t.Fatal(err)
+	}
+	userCert, err := loadCertificate(filepath.Join(config.UserPartyDirectory(user, party), config.CertificateFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return relayCert, userCert
+}
+
+func samePublicKey(a, b *x509.Certificate) bool {
+	return a.PublicKey.(*rsa.PublicKey).Equal(b.PublicKey)
+}
+
+func TestRenewRevokedParty(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates certificates")
+	}
+	defer config.SetCertsDirectory(config.BaseDirectory())
+	config.SetCertsDirectory(filepath.Join(t.TempDir(), "certs"))
+	if err := CreateRelay(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateUser("user1", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreateParty("0", "user1", false); err != nil {
+		t.Fatal(err)
+	}
+	relayCert, userCert := partyCerts(t, "0", "user1")
+
+	if err := RenewParty("0", "user1", false); err != nil {
+		t.Fatal(err)
+	}
+	renewedRelay, renewedUser := partyCerts(t, "0", "user1")
+	if renewedRelay.SerialNumber.Cmp(relayCert.SerialNumber) == 0 || !samePublicKey(renewedRelay, relayCert) || !samePublicKey(renewedUser, userCert) {
+		t.Fatal("expected a party to be renewed with a new serial and the same keys")
+	}
+
+	if err := RevokeParty("0", "user1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RenewParty("0", "user1", false); err == nil {
+		t.Fatal("expected a revoked party not to be renewed without force")
+	}
+	if err := RenewParty("0", "user1", true); err != nil {
+		t.Fatal(err)
+	}
+	rekeyedRelay, rekeyedUser := partyCerts(t, "0", "user1")
+	if samePublicKey(rekeyedRelay, relayCert) || samePublicKey(rekeyedUser, userCert) {
+		t.Fatal("expected a revoked party to be renewed with new keys")
+	}
+	if revoked, err := partyRevoked("0", "user1"); err != nil || revoked {
+		t.Fatalf("expected the renewed certificates not to be revoked: %v", err)
+	}
+	// The renewed party may be renewed again as usual
+	if err := RenewParty("0", "user1", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenewCertificateKeepsSANs(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, _ := url.Parse("spiffe://flock/user1/0")
+	err = issueCertificate(&x509.Certificate{
+		SerialNumber:   big.NewInt(1),
+		NotBefore:      time.Now(),
+		NotAfter:       time.Now().Add(time.Hour),
+		Subject:        pkix.Name{CommonName: "0"},
+		DNSNames:       []string{"party0"},
+		EmailAddresses: []string{"party0@flock"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+		URIs:           []*url.URL{uri},
+	}, key, "", "", certPath, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := renewCertificate(certPath, keyPath, "", "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	renewed, err := loadCertificate(certPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renewed.DNSNames) != 1 || len(renewed.EmailAddresses) != 1 || len(renewed.URIs) != 1 ||
+		renewed.URIs[0].String() != uri.String() || len(renewed.IPAddresses) != 1 || !renewed.IPAddresses[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("expected the SANs to be kept, got %v %v %v %v", renewed.DNSNames, renewed.EmailAddresses, renewed.IPAddresses, renewed.URIs)
+	}
+}
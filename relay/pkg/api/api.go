@@ -13,6 +13,11 @@
 
 package api
 
+import (
+	"fmt"
+	"time"
+)
+
 // TLSMode represents the role the party must take for E2E
 type TLSMode int
 
@@ -39,22 +44,218 @@ type UserResp struct {
 type PartyInfo struct {
 	// PartyIDs specifies the UUIDs to be used for the Parties/functions
 	PartyID string
-	// Certificates are sent over separately as octets with partyID-cert.pem & pertyID-key.pem
+	// BundleURL is the API path from which the party's PartyBundle is downloaded
+	BundleURL string
+}
+
+// PartyBundle contains the PEM encoded certificates and keys a party needs to use the relay
+type PartyBundle struct {
+	// RelayCA, RelayCert and RelayKey authenticate the party to the relay
+	RelayCA   string
+	RelayCert string
+	RelayKey  string
+	// UserCA, PartyCert and PartyKey authenticate the party end-to-end to its peers
+	UserCA    string
+	PartyCert string
+	PartyKey  string
 }
 
-// UserSpec contains all the party attributes and access group
+// UserSpec contains all the party attributes and access group.
+// The parties of an access group may be paired with each other.
 type UserSpec struct {
+	// Party lists the parties of the access group, "*" matches any party
 	Party       []string
 	AccessGroup string
+	// TagPrefixes restricts the tags the access group may pair on, empty allows any tag
+	TagPrefixes []string `json:",omitempty"`
+}
+
+// Quota limits the relay resources used by a user and by each of its parties, zero values are unlimited
+type Quota struct {
+	// MaxSessions and MaxParked bound the paired sessions and the parked rendezvous of the user
+	MaxSessions int `json:",omitempty"`
+	MaxParked   int `json:",omitempty"`
+	// Bandwidth bounds the bytes per second forwarded for the user, in both directions
+	Bandwidth int64 `json:",omitempty"`
+	// MaxPartySessions, MaxPartyParked and PartyBandwidth apply the same limits to each party of the user
+	MaxPartySessions int   `json:",omitempty"`
+	MaxPartyParked   int   `json:",omitempty"`
+	PartyBandwidth   int64 `json:",omitempty"`
+}
+
+// Policy contains the access groups of every user, as stored in the relay policy file
+type Policy struct {
+	// DefaultDeny denies every pairing of the users that have no access groups
+	DefaultDeny bool
+	Users       map[string][]UserSpec
+	// DefaultQuota applies to the users that have no entry in Quotas
+	DefaultQuota Quota
+	Quotas       map[string]Quota `json:",omitempty"`
+	// Webhooks invoke the parties of a user that are not connected when their peer waits for them
+	Webhooks map[string]Webhook `json:",omitempty"`
+}
+
+// Webhook is the endpoint the relay posts an Invocation to, signed with the secret of the user
+type Webhook struct {
+	URL    string
+	Secret string `json:",omitempty"`
+}
+
+// Invocation asks the webhook of a user to start Party, which Requester waits for on Tag until Deadline
+type Invocation struct {
+	User      string
+	Party     string
+	Requester string
+	Tag       string
+	Deadline  time.Time
+	// Attempt numbers the deliveries of the invocation, starting at 1
+	Attempt int
+}
+
+// Session describes a parked party, or a pair of parties being forwarded, as listed by the admin API
+type Session struct {
+	User     string
+	SrcParty string
+	DstParty string
+	Tag      string
+	// State is "parked" while SrcParty waits for DstParty, then "paired"
+	State   string
+	SrcAddr string
+	DstAddr string `json:",omitempty"`
+	// Since is the time the session was parked or paired
+	Since time.Time
+	Age   string
+	// SrcBytes and DstBytes are the bytes forwarded so far from SrcParty and from DstParty
+	SrcBytes int64
+	DstBytes int64
+}
+
+// TerminateResp reports the sessions ended by a terminate request of the admin API
+type TerminateResp struct {
+	Terminated int
 }
 
 // AuthReq contains the access authorization message sent by a party to the relay
 type AuthReq struct {
 	DestParty string
 	Tag       string // Optional if establishing a specific connection using a tag
+	// Mailbox asks for a mailbox session with DestParty instead of pairing with it
+	Mailbox bool `json:",omitempty"`
+	// Group joins a group rendezvous instead of pairing with DestParty
+	Group *GroupJoin `json:",omitempty"`
+	// Mux keeps the connection as a multiplexed session whose streams each pair with a peer, DestParty and Tag
+	// are then set by each stream
+	Mux bool `json:",omitempty"`
+}
+
+// GroupJoin is the connection or the stream of member Index of a group rendezvous of Size members to member Peer.
+// Each member opens one to every other member, and the relay pairs them once all are present.
+type GroupJoin struct {
+	ID    string
+	Index int
+	Size  int
+	Peer  int
+}
+
+// Hello opens the control session of a party
+type Hello struct {
+	// Agent optionally identifies the client implementation
+	Agent string `json:",omitempty"`
+}
+
+// Waiting is sent to a party that is parked until its peer arrives
+type Waiting struct {
+	// Deadline is the time by which the peer must arrive
+	Deadline time.Time
 }
 
 // Ready contains the message that is sent to party when the connection is ready
 type Ready struct {
 	Mode TLSMode
+	// Peer is the party of the peer in a group rendezvous
+	Peer string `json:",omitempty"`
+	// Error is only set in the unframed reply sent to legacy clients, framed replies use MsgError
+	Error *Error `json:",omitempty"`
+}
+
+// Handover is the last control message, after which the relay ends the TLS session
+type Handover struct{}
+
+// Rendezvous identifies a party parked on a relay, SrcParty waiting for DstParty of the same user
+type Rendezvous struct {
+	User     string
+	SrcParty string
+	DstParty string
+	Tag      string
+}
+
+// Parked lists rendezvous parked on a peer relay. A snapshot replaces the rendezvous previously
+// received from the peer, otherwise the rendezvous were just parked.
+type Parked struct {
+	Rendezvous []Rendezvous
+	Snapshot   bool `json:",omitempty"`
+}
+
+// Claim asks a peer relay to pair its parked party SrcParty, waiting for DstParty, with the party of the claiming relay
+type Claim struct {
+	Rendezvous
+}
+
+// Mailbox is sent to a party when its mailbox session starts
+type Mailbox struct {
+	// Pending is the number of messages waiting for the party, delivered next
+	Pending int
+	// MaxBytes bounds the messages buffered for the peer, which are kept for up to TTL
+	MaxBytes int
+	TTL      time.Duration
+}
+
+// Mux is sent to a party when its multiplexed session starts
+type Mux struct {
+	// MaxStreams bounds the streams open at once over the session
+	MaxStreams int
+	// Window is the number of bytes either side may send on a stream before the other side reads them
+	Window int
+}
+
+// MailAck acknowledges the mailbox messages a party received, up to Seq, which the relay then drops
+type MailAck struct {
+	Seq uint64
+}
+
+// ErrorCode identifies why the relay refused or gave up on a request
+type ErrorCode int
+
+const (
+	// ErrPeerTimeout is sent when the destination party did not arrive before the rendezvous deadline
+	ErrPeerTimeout ErrorCode = 1
+	// ErrAccessDenied is sent when the policy of the user does not allow the pairing
+	ErrAccessDenied ErrorCode = 2
+	// ErrUnsupportedVersion is sent to clients speaking another version of the control protocol
+	ErrUnsupportedVersion ErrorCode = 3
+	// ErrBadRequest is sent when a control message is malformed or unexpected
+	ErrBadRequest ErrorCode = 4
+	// ErrAlreadyWaiting is sent when the same party is already parked for the same peer and tag
+	ErrAlreadyWaiting ErrorCode = 5
+	// ErrTerminated is sent when an operator terminates the session of a parked party
+	ErrTerminated ErrorCode = 6
+	// ErrQuotaExceeded is sent when the user or the party already uses all the sessions or rendezvous of its quota,
+	// or all the mailboxes or mailbox bytes of the relay limits
+	ErrQuotaExceeded ErrorCode = 7
+	// ErrShuttingDown is sent to the parties parked or arriving while the relay shuts down, which may retry on another relay
+	ErrShuttingDown ErrorCode = 8
+	// ErrNotParked is sent to a peer relay claiming a party that is no longer parked
+	ErrNotParked ErrorCode = 9
+	// ErrMailboxFull is sent when a mailbox message does not fit in the mailbox of the peer
+	ErrMailboxFull ErrorCode = 10
+)
+
+// Error contains the structured failure reply sent by the relay to a party
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("relay error %d: %s", e.Code, e.Message)
 }
@@ -0,0 +1,273 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/flock-org/flock/relay/config"
+)
+
+// createRelayCertificate creates a certificate signed by the relay CA for client authentication, and also for
+// server authentication if isServer is set. It carries the user domain as its organizational unit, which
+// util.CreateCertificate has no field for.
+func createRelayCertificate(name, user string, isServer bool, certOutPath, keyOutPath string) error {
+	key, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return err
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	cert := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		Subject:      pkix.Name{CommonName: name, OrganizationalUnit: []string{user}},
+		DNSNames:     []string{name},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if isServer {
+		cert.ExtKeyUsage = append(cert.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	}
+	return issueCertificate(cert, key, config.FrCAFile(), config.FrKeyFile(), certOutPath, keyOutPath)
+}
+
+// newSerialNumber returns a random 128 bit certificate serial number, unique enough to be revoked by serial
+func newSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+// issueCertificate signs the certificate template with the CA (or self-signs it if caPath is empty),
+// and saves the certificate, followed by its CA certificate, and its private key.
+func issueCertificate(cert *x509.Certificate, key *rsa.PrivateKey, caPath, caKeyPath, certOutPath, keyOutPath string) error {
+	ca, caKey := cert, key
+	if caPath != "" {
+		var err error
+		ca, caKey, err = loadCA(caPath, caKeyPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	certBytes, err := x509.CreateCertificate(rand.Reader, cert, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := new(bytes.Buffer)
+	if err := pem.Encode(certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes}); err != nil {
+		return err
+	}
+	if ca != cert {
+		// append CA certificate
+		if err := pem.Encode(certPEM, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}); err != nil {
+			return err
+		}
+	}
+
+	if err := os.WriteFile(keyOutPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	return os.WriteFile(certOutPath, certPEM.Bytes(), 0600)
+}
+
+// renewCertificate re-issues the certificate at certPath with the same subject, SANs, usages and private key,
+// and a new serial number and validity period. A non-empty unit replaces the organizational unit of the subject.
+// With newKey, the certificate is issued for a new private key of the same size, which replaces the one at keyPath.
+func renewCertificate(certPath, keyPath, caPath, caKeyPath, unit string, newKey bool) error {
+	old, err := loadCertificate(certPath)
+	if err != nil {
+		return err
+	}
+	key, err := loadPrivateKey(keyPath)
+	if err != nil {
+		return err
+	}
+	if newKey {
+		if key, err = rsa.GenerateKey(rand.Reader, key.N.BitLen()); err != nil {
+			return err
+		}
+	}
+	serial, err := newSerialNumber()
+	if err != nil {
+		return err
+	}
+	cert := &x509.Certificate{
+		SerialNumber:          serial,
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  old.IsCA,
+		BasicConstraintsValid: old.BasicConstraintsValid,
+		Subject:               old.Subject,
+		DNSNames:              old.DNSNames,
+		EmailAddresses:        old.EmailAddresses,
+		IPAddresses:           old.IPAddresses,
+		URIs:                  old.URIs,
+		PermittedDNSDomains:   old.PermittedDNSDomains,
+		KeyUsage:              old.KeyUsage,
+		ExtKeyUsage:           old.ExtKeyUsage,
+	}
+	if unit != "" {
+		cert.Subject.OrganizationalUnit = []string{unit}
+	}
+	return issueCertificate(cert, key, caPath, caKeyPath, certPath, keyPath)
+}
+
+// checkOverwrite fails with an os.ErrExist error if any of the paths exists, unless force is set
+func checkOverwrite(force bool, paths ...string) error {
+	if force {
+		return nil
+	}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return &os.PathError{Op: "create", Path: path, Err: os.ErrExist}
+		}
+	}
+	return nil
+}
+
+// crlValidity is how long a published CRL is valid, fr-adm publish crl renews it
+const crlValidity = 365 * 24 * time.Hour
+
+// loadCertificate reads the first certificate of a PEM file
+func loadCertificate(certPath string) (*x509.Certificate, error) {
+	raw, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("certificate file %s is not in PEM format", certPath)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// isRevoked reports whether the CRL at crlPath lists cert, a missing CRL listing none
+func isRevoked(crlPath string, cert *x509.Certificate) (bool, error) {
+	crl, err := loadCRL(crlPath)
+	if err != nil || crl == nil {
+		return false, err
+	}
+	return revoked(crl, cert), nil
+}
+
+// loadCRL reads the PEM encoded CRL at crlPath, returning nil if there is none yet
+func loadCRL(crlPath string) (*x509.RevocationList, error) {
+	raw, err := os.ReadFile(crlPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("CRL file %s is not in PEM format", crlPath)
+	}
+	return x509.ParseRevocationList(block.Bytes)
+}
+
+// publishCRL signs a new CRL with the CA, listing the certificates already revoked in crlPath and the
+// given certificates, and atomically replaces crlPath with it
+func publishCRL(caPath, caKeyPath, crlPath string, certs ...*x509.Certificate) error {
+	ca, caKey, err := loadCA(caPath, caKeyPath)
+	if err != nil {
+		return err
+	}
+	previous, err := loadCRL(crlPath)
+	if err != nil {
+		return fmt.Errorf("unable to read CRL: %v", err)
+	}
+
+	now := time.Now()
+	number := big.NewInt(1)
+	var revoked []pkix.RevokedCertificate
+	listed := make(map[string]bool)
+	if previous != nil {
+		number.Add(previous.Number, number)
+		for _, entry := range previous.RevokedCertificates {
+			revoked = append(revoked, entry)
+			listed[entry.SerialNumber.String()] = true
+		}
+	}
+	for _, cert := range certs {
+		if !listed[cert.SerialNumber.String()] {
+			revoked = append(revoked, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: now})
+			listed[cert.SerialNumber.String()] = true
+		}
+	}
+
+	crlBytes, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:              number,
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(crlValidity),
+		RevokedCertificates: revoked,
+	}, ca, caKey)
+	if err != nil {
+		return fmt.Errorf("unable to sign CRL: %v", err)
+	}
+	tmp := crlPath + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlBytes}), 0644); err != nil {
+		return err
+	}
+	// Rename is atomic, so the relay never reads a partially written CRL
+	return os.Rename(tmp, crlPath)
+}
+
+// loadCA reads a PEM encoded CA certificate and its PKCS1 private key
+func loadCA(caPath, caKeyPath string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	rawCA, err := os.ReadFile(caPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(rawCA)
+	if block == nil {
+		return nil, nil, fmt.Errorf("CA certificate file is not in PEM format")
+	}
+	ca, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	caKey, err := loadPrivateKey(caKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, caKey, nil
+}
+
+// loadPrivateKey reads a PEM encoded PKCS1 private key
+func loadPrivateKey(keyPath string) (*rsa.PrivateKey, error) {
+	rawKey, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(rawKey)
+	if block == nil {
+		return nil, fmt.Errorf("key file %s is not in PEM format", keyPath)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
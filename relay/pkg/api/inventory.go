@@ -0,0 +1,273 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/flock-org/flock/relay/config"
+)
+
+// Kinds of the certificates found in the certificates directory
+const (
+	KindRelayCA    = "relay-ca"
+	KindRelay      = "relay"
+	KindUserCA     = "user-ca"
+	KindPartyRelay = "party-relay"
+	KindPartyE2E   = "party-e2e"
+)
+
+// CertInfo describes a certificate of the certificates directory and whether it is still trusted
+type CertInfo struct {
+	Kind string
+	User string
+	Name string
+	Path string
+
+	Subject   string
+	Issuer    string
+	Serial    string
+	DNSNames  []string
+	NotBefore time.Time
+	NotAfter  time.Time
+	IsCA      bool
+
+	// TrustedBy is the CA file the certificate chains to, empty if ChainError is set
+	TrustedBy  string
+	ChainError string
+	Revoked    bool
+}
+
+// Status summarizes whether the certificate can still be used
+func (c *CertInfo) Status() string {
+	switch {
+	case c.Revoked:
+		return "revoked"
+	case time.Now().After(c.NotAfter):
+		return "expired"
+	case c.ChainError != "":
+		return "untrusted"
+	}
+	return "valid"
+}
+
+// trustRoot is a CA of the certificates directory with its revocation list
+type trustRoot struct {
+	path    string
+	cert    *x509.Certificate
+	crlPath string
+}
+
+// ListCertificates walks the certificates directory and describes the relay, user and party certificates,
+// ordered by user and party.
+func ListCertificates() ([]CertInfo, error) {
+	entries, err := os.ReadDir(config.BaseDirectory())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificates directory: %v", err)
+	}
+	roots, err := loadTrustRoots()
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []CertInfo
+	add := func(kind, user, name, path string) error {
+		info, err := inspectCertificate(path, roots)
+		if err != nil {
+			return err
+		}
+		info.Kind, info.User, info.Name = kind, user, name
+		certs = append(certs, *info)
+		return nil
+	}
+	if exists(config.FrCAFile()) {
+		if err := add(KindRelayCA, "", config.FlockrelayServerName, config.FrCAFile()); err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(config.BaseDirectory(), entry.Name())
+		userCA := filepath.Join(dir, config.UserCAFile)
+		partyCert := filepath.Join(dir, config.CertificateFileName)
+		switch {
+		case exists(userCA):
+			if err := add(KindUserCA, entry.Name(), entry.Name(), userCA); err != nil {
+				return nil, err
+			}
+			parties, err := os.ReadDir(dir)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read directory of user %s: %v", entry.Name(), err)
+			}
+			for _, party := range parties {
+				if !party.IsDir() {
+					continue
+				}
+				path := filepath.Join(dir, party.Name(), config.CertificateFileName)
+				if exists(path) {
+					if err := add(KindPartyE2E, entry.Name(), party.Name(), path); err != nil {
+						return nil, err
+					}
+				}
+				path = config.PartyRelayCertFile(entry.Name(), party.Name())
+				if exists(path) {
+					if err := add(KindPartyRelay, entry.Name(), party.Name(), path); err != nil {
+						return nil, err
+					}
+				}
+			}
+		case entry.Name() == config.FlockrelayServerName && exists(partyCert):
+			if err := add(KindRelay, "", entry.Name(), partyCert); err != nil {
+				return nil, err
+			}
+		case exists(partyCert):
+			// Left in the legacy layout, fr-adm migrate moves it to the directory of its user
+			if err := add(KindPartyRelay, "", entry.Name(), partyCert); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The relay certificate of a party carries its user domain
+	for i := range certs {
+		if certs[i].Kind == KindPartyRelay {
+			if cert, err := loadCertificate(certs[i].Path); err == nil && len(cert.Subject.OrganizationalUnit) > 0 {
+				certs[i].User = cert.Subject.OrganizationalUnit[0]
+			}
+		}
+	}
+	sort.SliceStable(certs, func(i, j int) bool {
+		if certs[i].User != certs[j].User {
+			return certs[i].User < certs[j].User
+		}
+		return certs[i].Name < certs[j].Name
+	})
+	return certs, nil
+}
+
+// InspectCertificate describes the certificate at path, checking its chain against the relay and user CAs
+func InspectCertificate(path string) (*CertInfo, error) {
+	roots, err := loadTrustRoots()
+	if err != nil {
+		return nil, err
+	}
+	return inspectCertificate(path, roots)
+}
+
+func inspectCertificate(path string, roots []trustRoot) (*CertInfo, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// The certificate is followed by the certificate of its CA
+	var chain []*x509.Certificate
+	for block, rest := pem.Decode(raw); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse certificate in %s: %v", path, err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("certificate file %s is not in PEM format", path)
+	}
+	cert := chain[0]
+	info := &CertInfo{
+		Path:      path,
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		Serial:    cert.SerialNumber.String(),
+		DNSNames:  cert.DNSNames,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		IsCA:      cert.IsCA,
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	info.ChainError = "not signed by the relay CA or a user CA"
+	for _, root := range roots {
+		pool := x509.NewCertPool()
+		pool.AddCert(root.cert)
+		_, err := cert.Verify(x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			if cert.CheckSignatureFrom(root.cert) == nil {
+				info.TrustedBy, info.ChainError = root.path, err.Error()
+			}
+			continue
+		}
+		info.TrustedBy, info.ChainError = root.path, ""
+		if !cert.IsCA {
+			crl, err := loadCRL(root.crlPath)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read CRL %s: %v", root.crlPath, err)
+			}
+			info.Revoked = crl != nil && revoked(crl, cert)
+		}
+		break
+	}
+	return info, nil
+}
+
+// loadTrustRoots reads the relay CA and the CA of every user
+func loadTrustRoots() ([]trustRoot, error) {
+	var roots []trustRoot
+	if exists(config.FrCAFile()) {
+		cert, err := loadCertificate(config.FrCAFile())
+		if err != nil {
+			return nil, fmt.Errorf("unable to read relay CA: %v", err)
+		}
+		roots = append(roots, trustRoot{path: config.FrCAFile(), cert: cert, crlPath: config.FrCRLFile()})
+	}
+	users, err := filepath.Glob(filepath.Join(config.BaseDirectory(), "*", config.UserCAFile))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range users {
+		cert, err := loadCertificate(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA %s: %v", path, err)
+		}
+		roots = append(roots, trustRoot{path: path, cert: cert, crlPath: filepath.Join(filepath.Dir(path), config.UserCRLFile)})
+	}
+	return roots, nil
+}
+
+func revoked(crl *x509.RevocationList, cert *x509.Certificate) bool {
+	for _, entry := range crl.RevokedCertificates {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The relay control protocol runs over the relay TLS session before the handover.
+// Every message is framed as:
+//
+//	| version (1 byte) | type (1 byte) | length (4 bytes, big endian) | JSON payload (length bytes) |
+//
+// A party sends Hello and AuthReq. The relay answers Waiting while the party is parked,
+// then Ready followed by Handover once the peer arrived, or Error at any point.
+// After Handover the relay ends the TLS session and the raw TCP connection carries the E2E session.
+//
+// Federated relays speak the same protocol to each other. A relay sends Hello and Subscribe to each
+// of its peers, which stream their parked rendezvous as Parked messages. To pair one of its parties
+// with a party parked on a peer, a relay sends Hello and Claim on a new connection; the peer answers
+// Ready and the connection, still under the relay TLS session, becomes the tunnel of the E2E session.
+//
+// A party whose AuthReq asks for its mailbox is not paired. The relay answers Mailbox, then delivers
+// the messages its peer left in the mailbox as Mail messages, which the party acknowledges with MailAck,
+// and buffers the Mail messages the party sends until its peer attaches in turn. The party ends the
+// session with close_notify, which the relay returns once every message it sent is buffered.
+//
+// A party whose AuthReq asks for Mux keeps its connection. The relay answers Mux and the relay TLS session
+// then carries the frames of package mux: each stream the party opens carries an AuthReq message, and the
+// relay replies on the stream with Waiting, then Ready or Error. No Handover follows Ready, the stream carries
+// the E2E session and is paired with a stream or a connection of the peer like any other party.
+
+// ProtocolVersion is the version of the relay control protocol
+const ProtocolVersion byte = 1
+
+// MaxMessageSize bounds the payload of a control message
+const MaxMessageSize = 64 * 1024
+
+const headerSize = 6
+
+// MessageType identifies a control message
+type MessageType byte
+
+const (
+	// MsgHello opens the control session of a party
+	MsgHello MessageType = 1
+	// MsgAuthReq carries the AuthReq of a party
+	MsgAuthReq MessageType = 2
+	// MsgWaiting tells a party it is parked until its peer arrives
+	MsgWaiting MessageType = 3
+	// MsgReady carries the TLS role of a paired party
+	MsgReady MessageType = 4
+	// MsgError carries an Error and ends the control session
+	MsgError MessageType = 5
+	// MsgHandover is the last message before the relay ends the TLS session
+	MsgHandover MessageType = 6
+	// MsgSubscribe asks a peer relay to stream its parked rendezvous
+	MsgSubscribe MessageType = 7
+	// MsgParked carries the Parked rendezvous of a peer relay
+	MsgParked MessageType = 8
+	// MsgClaim carries the Claim of a party parked on a peer relay
+	MsgClaim MessageType = 9
+	// MsgMailbox tells a party its mailbox session started
+	MsgMailbox MessageType = 10
+	// MsgMail carries a mailbox message, its payload is not JSON but the sequence number and the message, see WriteMail
+	MsgMail MessageType = 11
+	// MsgMailAck carries the MailAck of the mailbox messages a party received
+	MsgMailAck MessageType = 12
+	// MsgMux tells a party its multiplexed session started
+	MsgMux MessageType = 13
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgHello:
+		return "Hello"
+	case MsgAuthReq:
+		return "AuthReq"
+	case MsgWaiting:
+		return "Waiting"
+	case MsgReady:
+		return "Ready"
+	case MsgError:
+		return "Error"
+	case MsgHandover:
+		return "Handover"
+	case MsgSubscribe:
+		return "Subscribe"
+	case MsgParked:
+		return "Parked"
+	case MsgClaim:
+		return "Claim"
+	case MsgMailbox:
+		return "Mailbox"
+	case MsgMail:
+		return "Mail"
+	case MsgMailAck:
+		return "MailAck"
+	case MsgMux:
+		return "Mux"
+	}
+	return fmt.Sprintf("MessageType(%d)", byte(t))
+}
+
+// ErrLegacyMessage is returned when the peer speaks the unframed JSON protocol of older relay clients
+var ErrLegacyMessage = errors.New("unframed legacy control message")
+
+// WriteMessage writes msg as a framed control message of type t, a nil msg sends an empty payload
+func WriteMessage(w io.Writer, t MessageType, msg interface{}) error {
+	var payload []byte
+	if msg != nil {
+		var err error
+		payload, err = json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+	}
+	return writeFrame(w, t, payload)
+}
+
+// mailSeqSize is the size of the sequence number heading the payload of a Mail message
+const mailSeqSize = 8
+
+// MaxMailSize bounds the messages carried by Mail messages
+const MaxMailSize = MaxMessageSize - mailSeqSize
+
+// WriteMail writes a Mail message carrying data, numbered seq by the relay; parties send it with seq 0
+func WriteMail(w io.Writer, seq uint64, data []byte) error {
+	payload := make([]byte, mailSeqSize+len(data))
+	binary.BigEndian.PutUint64(payload, seq)
+	copy(payload[mailSeqSize:], data)
+	return writeFrame(w, MsgMail, payload)
+}
+
+// DecodeMail returns the sequence number and the message of the payload of a Mail message
+func DecodeMail(payload []byte) (uint64, []byte, error) {
+	if len(payload) < mailSeqSize {
+		return 0, nil, &Error{Code: ErrBadRequest, Message: fmt.Sprintf("mail message of %d bytes is too short", len(payload))}
+	}
+	return binary.BigEndian.Uint64(payload), payload[mailSeqSize:], nil
+}
+
+// writeFrame writes payload as a framed control message of type t
+func writeFrame(w io.Writer, t MessageType, payload []byte) error {
+	if len(payload) > MaxMessageSize {
+		return fmt.Errorf("%v message of %d bytes exceeds %d bytes", t, len(payload), MaxMessageSize)
+	}
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = ProtocolVersion
+	frame[1] = byte(t)
+	binary.BigEndian.PutUint32(frame[2:headerSize], uint32(len(payload)))
+	copy(frame[headerSize:], payload)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadMessage reads a framed control message and returns its type and payload
+func ReadMessage(r io.Reader) (MessageType, []byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	if header[0] == '{' {
+		return 0, nil, ErrLegacyMessage
+	}
+	if header[0] != ProtocolVersion {
+		return 0, nil, &Error{
+			Code:    ErrUnsupportedVersion,
+			Message: fmt.Sprintf("protocol version %d is not supported, expected %d", header[0], ProtocolVersion),
+		}
+	}
+	length := binary.BigEndian.Uint32(header[2:])
+	if length > MaxMessageSize {
+		return 0, nil, &Error{Code: ErrBadRequest, Message: fmt.Sprintf("message of %d bytes exceeds %d bytes", length, MaxMessageSize)}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return MessageType(header[1]), payload, nil
+}
+
+// ReadMessageOf reads a control message that must be of type t into msg.
+// An Error message received instead is returned as the error.
+func ReadMessageOf(r io.Reader, t MessageType, msg interface{}) error {
+	got, payload, err := ReadMessage(r)
+	if err != nil {
+		return err
+	}
+	return DecodeMessage(got, payload, t, msg)
+}
+
+// DecodeMessage decodes the payload of a message of type got that must be of type want into msg.
+// An Error message is returned as the error.
+func DecodeMessage(got MessageType, payload []byte, want MessageType, msg interface{}) error {
+	if got == MsgError && want != MsgError {
+		relayErr := &Error{}
+		if err := json.Unmarshal(payload, relayErr); err != nil {
+			return fmt.Errorf("unable to parse error message: %v", err)
+		}
+		return relayErr
+	}
+	if got != want {
+		return &Error{Code: ErrBadRequest, Message: fmt.Sprintf("expected %v message, got %v", want, got)}
+	}
+	if msg == nil || len(payload) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(payload, msg); err != nil {
+		return &Error{Code: ErrBadRequest, Message: fmt.Sprintf("unable to parse %v message: %v", want, err)}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/flock-org/flock/relay/config"
+)
+
+// adminTimeout bounds a request to the relay admin API
+const adminTimeout = 30 * time.Second
+
+// adminClient returns an HTTPS client authenticated with the relay certificate
+func adminClient() (*http.Client, error) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(config.FlockrelayCADirectory(), config.CertificateFileName),
+		filepath.Join(config.FlockrelayCADirectory(), config.PrivateKeyFileName))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load relay certificate: %v", err)
+	}
+	caData, err := os.ReadFile(config.FrCAFile())
+	if err != nil {
+		return nil, fmt.Errorf("unable to read relay CA: %v", err)
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("unable to parse relay CA %s", config.FrCAFile())
+	}
+	return &http.Client{
+		Timeout: adminTimeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      rootCAs,
+			ServerName:   config.FlockrelayServerName,
+			MinVersion:   tls.VersionTLS12,
+		}},
+	}, nil
+}
+
+// adminRequest sends a request to path on the admin API of relay and decodes its JSON response into resp, if not nil
+func adminRequest(method, relay, path string, query url.Values, resp interface{}) error {
+	client, err := adminClient()
+	if err != nil {
+		return err
+	}
+	target := url.URL{Scheme: "https", Host: relay, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	httpResp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach the relay admin API: %v", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK && httpResp.StatusCode != http.StatusNoContent {
+		msg, _ := io.ReadAll(httpResp.Body)
+		return fmt.Errorf("relay admin API returned %s: %s", httpResp.Status, msg)
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// sessionQuery encodes the session filters, leaving out the empty ones
+func sessionQuery(user, src, dst, tag string) url.Values {
+	query := url.Values{}
+	for key, value := range map[string]string{"user": user, "src": src, "dst": dst, "tag": tag} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	return query
+}
+
+// ListSessions returns the parked and paired sessions of the relay at address relay, optionally of a single user
+func ListSessions(relay, user string) ([]Session, error) {
+	var sessions []Session
+	err := adminRequest(http.MethodGet, relay, "/sessions", sessionQuery(user, "", "", ""), &sessions)
+	return sessions, err
+}
+
+// TerminateSessions ends the sessions of user on the relay at address relay, narrowed down by the
+// non-empty src, dst and tag filters, and returns how many were terminated
+func TerminateSessions(relay, user, src, dst, tag string) (int, error) {
+	var resp TerminateResp
+	err := adminRequest(http.MethodDelete, relay, "/sessions", sessionQuery(user, src, dst, tag), &resp)
+	return resp.Terminated, err
+}
+
+// ReloadCredentials makes the relay at address relay reload its certificate and trusted CAs
+func ReloadCredentials(relay string) error {
+	return adminRequest(http.MethodPost, relay, "/reload", nil, nil)
+}
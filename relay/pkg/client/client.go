@@ -14,21 +14,32 @@
 package client
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
-	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/url"
+	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/flock-org/flock/relay/config"
 	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/revocation"
+	"github.com/flock-org/flock/relay/pkg/websocket"
 )
 
-var (
-	maxDataBufferSize = 64 * 1024
-	readDeadline      = 500 * time.Millisecond
+const (
+	// agent identifies this client in the Hello message
+	agent = "flock-go"
+	// handoverTimeout bounds the wait for the relay to end its TLS session after the handover
+	handoverTimeout = 10 * time.Second
+	// upgradeTimeout bounds the WebSocket upgrade of a relay reached over ws:// or wss://
+	upgradeTimeout = 10 * time.Second
 )
 
 func tlsClient(conn net.Conn, parsedCertData *parsedCertData, sni string) (*tls.Conn, error) {
@@ -39,8 +50,7 @@ func tlsClient(conn net.Conn, parsedCertData *parsedCertData, sni string) (*tls.
 	tlsConn := tls.Client(conn, parsedCertData.ClientConfig(sni))
 	err = tlsConn.HandshakeContext(ctx)
 	if err != nil {
-		log.Fatalf("failed to perform handshake : %+v", err)
-		return nil, err
+		return nil, fmt.Errorf("failed to perform handshake: %v", err)
 	}
 	// log.Printf("Handshake complete")
 	return tlsConn, nil
@@ -53,8 +63,7 @@ func tlsServer(conn net.Conn, parsedCertData *parsedCertData) (*tls.Conn, error)
 	tlsConn := tls.Server(conn, parsedCertData.ServerConfig())
 	err = tlsConn.HandshakeContext(ctx)
 	if err != nil {
-		log.Fatalf("failed to perform handshake : %+v", err)
-		return nil, err
+		return nil, fmt.Errorf("failed to perform handshake: %v", err)
 	}
 	// log.Printf("Handshake complete")
 	return tlsConn, nil
@@ -65,65 +74,122 @@ func GetSessionE2EGo(tcpConn net.Conn, ready *api.Ready, user, party, dest strin
 	partyDirectory := config.UserPartyDirectory(user, party)
 	userDirectory := config.UserDirectory(user)
 
-	parsedCertData, _ := parseTLSFiles(filepath.Join(userDirectory, config.UserCAFile),
+	parsedCertData, err := parseTLSFiles(filepath.Join(userDirectory, config.UserCAFile),
 		filepath.Join(partyDirectory, config.CertificateFileName),
 
 		filepath.Join(partyDirectory, config.PrivateKeyFileName))
+	if err != nil {
+		return nil, err
+	}
+	// Peers revoked by the user CA are rejected, the CRL is reloaded whenever fr-adm publishes a new one
+	caData, err := os.ReadFile(filepath.Join(userDirectory, config.UserCAFile))
+	if err != nil {
+		return nil, err
+	}
+	parsedCertData.crl, err = revocation.NewList(filepath.Join(userDirectory, config.UserCRLFile), caData)
+	if err != nil {
+		return nil, err
+	}
 	if ready.Mode == api.TLSModeClient {
 		return tlsClient(tcpConn, parsedCertData, dest)
 	}
 	return tlsServer(tcpConn, parsedCertData)
 }
 
-func requestAuthGo(conn *tls.Conn, req api.AuthReq) (*api.Ready, error) {
-	readyResp := &api.Ready{}
-	bufData := make([]byte, maxDataBufferSize)
-	authData, err := json.Marshal(req)
-	if err != nil {
+// sendAuthReq sends Hello and AuthReq in a single write
+func sendAuthReq(conn *tls.Conn, req api.AuthReq) error {
+	var msgs bytes.Buffer
+	if err := api.WriteMessage(&msgs, api.MsgHello, api.Hello{Agent: agent}); err != nil {
+		return err
+	}
+	if err := api.WriteMessage(&msgs, api.MsgAuthReq, req); err != nil {
 		log.Printf("Failed to marshal auth request: %v.", err)
-		return nil, err
+		return err
 	}
+	_, err := conn.Write(msgs.Bytes())
+	return err
+}
+
+func requestAuthGo(conn *tls.Conn, req api.AuthReq) (*api.Ready, error) {
 	// log.Printf("Requesting auth: %v. Waiting..", req)
-	conn.Write(authData)
-	numBytes, err := conn.Read(bufData)
-	if err != nil {
-		log.Printf("Read error %v\n", err)
+	if err := sendAuthReq(conn, req); err != nil {
 		return nil, err
 	}
-	err = json.Unmarshal(bufData[:numBytes], readyResp)
-	if err != nil {
-		log.Printf("Failed to unmarshal auth request: %s", err)
-		return nil, err
+
+	var readyResp *api.Ready
+	for {
+		t, payload, err := api.ReadMessage(conn)
+		if err != nil {
+			log.Printf("Read error %v\n", err)
+			return nil, err
+		}
+		switch t {
+		case api.MsgWaiting:
+			// Parked until the peer arrives
+		case api.MsgReady:
+			readyResp = &api.Ready{}
+			if err := api.DecodeMessage(t, payload, api.MsgReady, readyResp); err != nil {
+				return nil, err
+			}
+		case api.MsgHandover:
+			if readyResp == nil {
+				return nil, fmt.Errorf("relay handed over the connection before it was ready")
+			}
+			return readyResp, awaitCloseNotify(conn)
+		default:
+			return nil, api.DecodeMessage(t, payload, api.MsgReady, nil)
+		}
 	}
-	// Read the CloseNotify on the TLS connection
-	// Set a deadline so that we are not blocked in this step, and we can retry.
-	err = conn.SetReadDeadline(time.Now().Add(readDeadline))
-	if err != nil {
-		return nil, err
+}
+
+// awaitCloseNotify consumes the close_notify that ends the relay TLS session after the handover and
+// acknowledges it with our own, leaving the raw TCP connection for the E2E session
+func awaitCloseNotify(conn *tls.Conn) error {
+	bufData := make([]byte, 1)
+	if err := conn.SetReadDeadline(time.Now().Add(handoverTimeout)); err != nil {
+		return err
 	}
-	_, err = conn.Read(bufData)
-	if err1, ok := err.(net.Error); ok && err1.Timeout() {
-		return nil, err
+	_, err := conn.Read(bufData)
+	if err != io.EOF {
+		return fmt.Errorf("expected the relay to end the TLS session after handover, got: %v", err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		return err
 	}
+	// Reset Deadlines for future reads and writes, Let application decide to set deadline
+	return conn.SetDeadline(time.Time{})
+}
 
-	// Reset Deadline for future reads, Let application decide to set deadline
-	conn.SetReadDeadline(time.Time{})
-	// log.Printf("Expected EOF on TLS conn and got: %v", err)
-	return readyResp, nil
+// dialRelay connects to a relay address, host:port, unix:<path> for a relay listening on a Unix domain socket,
+// or a ws:// or wss:// URL for a relay behind an HTTP ingress. The relay TLS session runs inside the WebSocket.
+func dialRelay(relay string, parsedCertData *parsedCertData) (net.Conn, error) {
+	if path, ok := strings.CutPrefix(relay, "unix:"); ok {
+		return net.Dial("unix", path)
+	}
+	if websocket.IsURL(relay) {
+		ctx, cancel := context.WithTimeout(context.Background(), upgradeTimeout)
+		defer cancel()
+		u, err := url.Parse(relay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid relay URL: %v", err)
+		}
+		return websocket.Dial(ctx, relay, parsedCertData.WebConfig(u.Hostname()))
+	}
+	return net.Dial("tcp", relay)
 }
 
-func StartRelayAuthGo(name, dest, tag, relay string) (net.Conn, *tls.Conn, *api.Ready, error) {
-	tcpConn, err := net.Dial("tcp", relay)
+func StartRelayAuthGo(user, name, dest, tag, relay string) (net.Conn, *tls.Conn, *api.Ready, error) {
+	parsedCertData, err := parseTLSFiles(config.FrCAFile(),
+		config.PartyRelayCertFile(user, name),
+		config.PartyRelayKeyFile(user, name))
 	if err != nil {
-		log.Printf("Failed to connect to socket %+v", err)
+		log.Printf("Parse TLS files %+v", err)
 		return nil, nil, nil, err
 	}
 
-	parsedCertData, err := parseTLSFiles(config.FrCAFile,
-		filepath.Join(config.PartyDirectory(name), config.CertificateFileName),
-		filepath.Join(config.PartyDirectory(name), config.PrivateKeyFileName))
+	tcpConn, err := dialRelay(relay, parsedCertData)
 	if err != nil {
-		log.Printf("Parse TLS files %+v", err)
+		log.Printf("Failed to connect to socket %+v", err)
 		return nil, nil, nil, err
 	}
 	// TODO @praveingk: Need to check regarding using party's SNI.
@@ -131,11 +197,17 @@ func StartRelayAuthGo(name, dest, tag, relay string) (net.Conn, *tls.Conn, *api.
 	var tlsConn *tls.Conn
 
 	tlsConn, err = tlsClient(tcpConn, parsedCertData, "flockrelay")
+	if err != nil {
+		log.Printf("Failed to connect to the relay: %v.", err)
+		tcpConn.Close()
+		return nil, nil, nil, err
+	}
 
 	authReq := api.AuthReq{DestParty: dest, Tag: tag}
 	readyResp, err := requestAuthGo(tlsConn, authReq)
 	if err != nil {
 		log.Printf("Failed authorization: %v.", err)
+		tcpConn.Close()
 		return nil, nil, nil, err
 	}
 
@@ -143,34 +215,51 @@ func StartRelayAuthGo(name, dest, tag, relay string) (net.Conn, *tls.Conn, *api.
 }
 
 func StartRelayAuthWithCerts(dest, tag, relay, cacert, cert, key string) (net.Conn, *tls.Conn, *api.Ready, error) {
-	tcpConn, err := net.Dial("tcp", relay)
+	parsedCertData, err := parseTLSStrings(cacert, cert, key)
 	if err != nil {
-		log.Printf("Failed to connect to socket %+v", err)
+		log.Printf("Parse TLS files %+v", err)
 		return nil, nil, nil, err
 	}
 
-	parsedCertData, err := parseTLSStrings(cacert, cert, key)
+	tcpConn, err := dialRelay(relay, parsedCertData)
 	if err != nil {
-		log.Printf("Parse TLS files %+v", err)
+		log.Printf("Failed to connect to socket %+v", err)
 		return nil, nil, nil, err
 	}
 
 	var tlsConn *tls.Conn
 
 	tlsConn, err = tlsClient(tcpConn, parsedCertData, "flockrelay")
+	if err != nil {
+		log.Printf("Failed to connect to the relay: %v.", err)
+		tcpConn.Close()
+		return nil, nil, nil, err
+	}
 
 	authReq := api.AuthReq{DestParty: dest, Tag: tag}
 	readyResp, err := requestAuthGo(tlsConn, authReq)
 	if err != nil {
 		log.Printf("Failed authorization: %v.", err)
+		tcpConn.Close()
 		return nil, nil, nil, err
 	}
 
 	return tcpConn, tlsConn, readyResp, nil
 }
 
-func GetSessionE2EGoWithCerts(tcpConn net.Conn, ready *api.Ready, dest, cacert, cert, key string) (*tls.Conn, error) {
-	parsedCertData, _ := parseTLSStrings(cacert, cert, key)
+// GetSessionE2EGoWithCerts runs the E2E TLS handshake with PEM encoded certificates. An optional PEM encoded
+// CRL of the user CA rejects peers whose certificate was revoked.
+func GetSessionE2EGoWithCerts(tcpConn net.Conn, ready *api.Ready, dest, cacert, cert, key string, crl ...string) (*tls.Conn, error) {
+	parsedCertData, err := parseTLSStrings(cacert, cert, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(crl) > 0 && crl[0] != "" {
+		parsedCertData.crl, err = revocation.ParseList([]byte(crl[0]), []byte(cacert))
+		if err != nil {
+			return nil, err
+		}
+	}
 	if ready.Mode == api.TLSModeClient {
 		return tlsClient(tcpConn, parsedCertData, dest)
 	}
@@ -0,0 +1,143 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/flock-org/flock/relay/config"
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/mux"
+)
+
+// e2eSession upgrades a connection handed over by the relay to the E2E TLS session with the peer of ready
+type e2eSession func(tcpConn net.Conn, ready *api.Ready) (*tls.Conn, error)
+
+// JoinGroupGo joins party name of user to the group rendezvous id as member index of size members, and returns
+// the E2E TLS sessions with every other member, keyed by their index. The relay pairs the members once all of
+// them joined, the member of the lower index of each pair being the TLS client. A member opens a single
+// multiplexed session to the relay with a stream per other member, and the session ends with the last of them.
+func JoinGroupGo(user, name, id string, index, size int, relay string) (map[int]*tls.Conn, error) {
+	parsedCertData, err := parseTLSFiles(config.FrCAFile(),
+		config.PartyRelayCertFile(user, name),
+		config.PartyRelayKeyFile(user, name))
+	if err != nil {
+		return nil, err
+	}
+	return joinGroup(id, index, size, relay, parsedCertData, func(tcpConn net.Conn, ready *api.Ready) (*tls.Conn, error) {
+		return GetSessionE2EGo(tcpConn, ready, user, name, ready.Peer)
+	})
+}
+
+// JoinGroupWithCerts joins a group rendezvous with PEM encoded certificates: the relay CA, certificate and key
+// authenticate the party to the relay, the user CA, party certificate and key to the other members. An optional
+// PEM encoded CRL of the user CA rejects members whose certificate was revoked.
+func JoinGroupWithCerts(id string, index, size int, relay, relayCA, relayCert, relayKey, userCA, partyCert, partyKey string, crl ...string) (map[int]*tls.Conn, error) {
+	parsedCertData, err := parseTLSStrings(relayCA, relayCert, relayKey)
+	if err != nil {
+		return nil, err
+	}
+	return joinGroup(id, index, size, relay, parsedCertData, func(tcpConn net.Conn, ready *api.Ready) (*tls.Conn, error) {
+		return GetSessionE2EGoWithCerts(tcpConn, ready, ready.Peer, userCA, partyCert, partyKey, crl...)
+	})
+}
+
+// groupSession is the E2E session of a member with the member peer, or the error that prevented it
+type groupSession struct {
+	peer int
+	conn *tls.Conn
+	err  error
+}
+
+func joinGroup(id string, index, size int, relay string, parsedCertData *parsedCertData, e2e e2eSession) (map[int]*tls.Conn, error) {
+	if index < 0 || index >= size {
+		return nil, fmt.Errorf("member %d is not in a group of %d members", index, size)
+	}
+	m, err := openMux(relay, parsedCertData)
+	if err != nil {
+		return nil, err
+	}
+	open := &atomic.Int32{}
+	open.Store(int32(size - 1))
+	sessions := make(chan groupSession, size-1)
+	for peer := 0; peer < size; peer++ {
+		if peer == index {
+			continue
+		}
+		go func(peer int) {
+			conn, err := joinPeer(m, open, api.GroupJoin{ID: id, Index: index, Size: size, Peer: peer}, e2e)
+			sessions <- groupSession{peer: peer, conn: conn, err: err}
+		}(peer)
+	}
+	conns := make(map[int]*tls.Conn, size-1)
+	for i := 0; i < size-1; i++ {
+		session := <-sessions
+		if session.err != nil {
+			if err == nil {
+				err = fmt.Errorf("unable to connect to member %d of group %s: %v", session.peer, id, session.err)
+			}
+			continue
+		}
+		conns[session.peer] = session.conn
+	}
+	if err != nil {
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return nil, err
+	}
+	return conns, nil
+}
+
+// groupStream is the stream of a member to another member, the last of the streams of the member to close
+// ends its multiplexed session
+type groupStream struct {
+	*mux.Stream
+	m    *Mux
+	open *atomic.Int32
+	once sync.Once
+}
+
+func (g *groupStream) Close() error {
+	err := g.Stream.Close()
+	g.once.Do(func() { leaveSession(g.m, g.open) })
+	return err
+}
+
+// leaveSession ends the session of a member once none of its open streams is left
+func leaveSession(m *Mux, open *atomic.Int32) {
+	if open.Add(-1) == 0 {
+		m.Close()
+	}
+}
+
+// joinPeer connects a member to one other member of its group with a stream of the session of the member
+func joinPeer(m *Mux, open *atomic.Int32, join api.GroupJoin, e2e e2eSession) (*tls.Conn, error) {
+	stream, ready, err := m.open(api.AuthReq{Group: &join})
+	if err != nil {
+		leaveSession(m, open)
+		return nil, err
+	}
+	conn := &groupStream{Stream: stream, m: m, open: open}
+	tlsConn, err := e2e(conn, ready)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/flock-org/flock/relay/config"
+	"github.com/flock-org/flock/relay/pkg/api"
+)
+
+// Mailbox is the mailbox session of a party with its peer. Messages sent are buffered by the relay until the
+// peer attaches to the mailbox, and messages the peer left are received, sealed end to end by a Sealer.
+type Mailbox struct {
+	tcpConn    net.Conn
+	tlsConn    *tls.Conn
+	tag        string
+	sealer     *Sealer
+	writeMutex sync.Mutex
+	// Pending is the number of messages waiting for the party when the session started
+	Pending int
+	// MaxBytes and TTL are the limits of the mailbox on the relay
+	MaxBytes int
+	TTL      time.Duration
+}
+
+// OpenMailbox starts the mailbox session of party name of user with dest under tag, sealing messages with sealer
+func OpenMailbox(user, name, dest, tag, relay string, sealer *Sealer) (*Mailbox, error) {
+	parsedCertData, err := parseTLSFiles(config.FrCAFile(),
+		config.PartyRelayCertFile(user, name),
+		config.PartyRelayKeyFile(user, name))
+	if err != nil {
+		return nil, err
+	}
+	return openMailbox(dest, tag, relay, parsedCertData, sealer)
+}
+
+// OpenMailboxWithCerts starts a mailbox session with PEM encoded relay certificates, sealing messages with sealer
+func OpenMailboxWithCerts(dest, tag, relay, cacert, cert, key string, sealer *Sealer) (*Mailbox, error) {
+	parsedCertData, err := parseTLSStrings(cacert, cert, key)
+	if err != nil {
+		return nil, err
+	}
+	return openMailbox(dest, tag, relay, parsedCertData, sealer)
+}
+
+func openMailbox(dest, tag, relay string, parsedCertData *parsedCertData, sealer *Sealer) (*Mailbox, error) {
+	tcpConn, err := dialRelay(relay, parsedCertData)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, err := tlsClient(tcpConn, parsedCertData, "flockrelay")
+	if err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	if err := sendAuthReq(tlsConn, api.AuthReq{DestParty: dest, Tag: tag, Mailbox: true}); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	resp := api.Mailbox{}
+	if err := api.ReadMessageOf(tlsConn, api.MsgMailbox, &resp); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	return &Mailbox{
+		tcpConn:  tcpConn,
+		tlsConn:  tlsConn,
+		tag:      tag,
+		sealer:   sealer,
+		Pending:  resp.Pending,
+		MaxBytes: resp.MaxBytes,
+		TTL:      resp.TTL,
+	}, nil
+}
+
+// Send seals msg and leaves it in the mailbox of the peer. Every message sent is buffered by the relay once Close
+// returns nil, a full mailbox makes Close return an ErrMailboxFull error instead.
+func (m *Mailbox) Send(msg []byte) error {
+	// Messages are sealed in the order they are sent, so that their sequence numbers grow in the mailbox
+	m.writeMutex.Lock()
+	defer m.writeMutex.Unlock()
+	sealed, err := m.sealer.Seal(m.tag, msg)
+	if err != nil {
+		return err
+	}
+	if len(sealed) > api.MaxMailSize {
+		return fmt.Errorf("sealed message of %d bytes exceeds %d bytes", len(sealed), api.MaxMailSize)
+	}
+	return api.WriteMail(m.tlsConn, 0, sealed)
+}
+
+// DroppedError is returned by Receive for a message that could not be opened, e.g. because it was not sealed by
+// the peer. The message is acknowledged so that it is not delivered again, and the next Receive returns the following one.
+type DroppedError struct {
+	Seq uint64
+	Err error
+}
+
+func (e *DroppedError) Error() string {
+	return fmt.Sprintf("dropped mailbox message %d: %v", e.Seq, e.Err)
+}
+
+func (e *DroppedError) Unwrap() error {
+	return e.Err
+}
+
+// Receive returns the next message the peer left in the mailbox, waiting for one to arrive.
+// The message is acknowledged, so the relay drops it. A message the sealer already opened, delivered
+// again because its acknowledgment was lost, is acknowledged and skipped. A message whose sequence number
+// cannot be saved in the SeqStore of the sealer is left unacknowledged, and Receive returns the error.
+func (m *Mailbox) Receive() ([]byte, error) {
+	for {
+		t, payload, err := api.ReadMessage(m.tlsConn)
+		if err != nil {
+			return nil, err
+		}
+		if t != api.MsgMail {
+			return nil, api.DecodeMessage(t, payload, api.MsgMail, nil)
+		}
+		seq, sealed, err := api.DecodeMail(payload)
+		if err != nil {
+			return nil, err
+		}
+		msg, openErr := m.sealer.Open(m.tag, sealed)
+		if errors.Is(openErr, errSeqStore) {
+			// The message is left to the relay, to be opened once the sequence number can be saved
+			return nil, openErr
+		}
+		// A message that cannot be opened is acknowledged too, so it is not delivered again. A message returned
+		// whose acknowledgment fails is delivered again on the next session, where the sealer skips it.
+		ackErr := m.ack(seq)
+		switch {
+		case openErr == nil:
+			return msg, nil
+		case ackErr != nil:
+			return nil, ackErr
+		case errors.Is(openErr, errReplayed):
+			continue
+		default:
+			return nil, &DroppedError{Seq: seq, Err: openErr}
+		}
+	}
+}
+
+// ack acknowledges the messages up to seq, so the relay drops them
+func (m *Mailbox) ack(seq uint64) error {
+	m.writeMutex.Lock()
+	defer m.writeMutex.Unlock()
+	return api.WriteMessage(m.tlsConn, api.MsgMailAck, api.MailAck{Seq: seq})
+}
+
+// SetDeadline sets the deadline of Send and Receive
+func (m *Mailbox) SetDeadline(t time.Time) error {
+	return m.tlsConn.SetDeadline(t)
+}
+
+// Close ends the mailbox session and waits for the relay to confirm that every message sent is buffered.
+// Messages received meanwhile are not acknowledged and are delivered again on the next session.
+// Close must not be called while Receive is in progress.
+func (m *Mailbox) Close() error {
+	defer m.tcpConn.Close()
+	m.writeMutex.Lock()
+	closeErr := m.tlsConn.CloseWrite()
+	m.writeMutex.Unlock()
+	// The relay may have ended the session with an error, which explains a failed CloseWrite too
+	if err := m.tlsConn.SetReadDeadline(time.Now().Add(handoverTimeout)); err != nil {
+		return err
+	}
+	for {
+		t, payload, err := api.ReadMessage(m.tlsConn)
+		if t == api.MsgError {
+			return api.DecodeMessage(t, payload, api.MsgMail, nil)
+		}
+		if err == io.EOF {
+			return closeErr
+		}
+		if err != nil {
+			if closeErr != nil {
+				return closeErr
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/flock-org/flock/relay/config"
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/mux"
+)
+
+// Mux is a long-lived connection of a party to the relay carrying many streams, each paired with a peer like a
+// connection of its own but without a TCP connection and a relay TLS handshake per stream
+type Mux struct {
+	session *mux.Session
+	// MaxStreams bounds the streams open at once, Window is the flow control window of each stream
+	MaxStreams int
+	Window     int
+}
+
+// OpenMux starts the multiplexed session of party name of user
+func OpenMux(user, name, relay string) (*Mux, error) {
+	parsedCertData, err := parseTLSFiles(config.FrCAFile(),
+		config.PartyRelayCertFile(user, name),
+		config.PartyRelayKeyFile(user, name))
+	if err != nil {
+		return nil, err
+	}
+	return openMux(relay, parsedCertData)
+}
+
+// OpenMuxWithCerts starts a multiplexed session with PEM encoded relay certificates
+func OpenMuxWithCerts(relay, cacert, cert, key string) (*Mux, error) {
+	parsedCertData, err := parseTLSStrings(cacert, cert, key)
+	if err != nil {
+		return nil, err
+	}
+	return openMux(relay, parsedCertData)
+}
+
+func openMux(relay string, parsedCertData *parsedCertData) (*Mux, error) {
+	tcpConn, err := dialRelay(relay, parsedCertData)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, err := tlsClient(tcpConn, parsedCertData, "flockrelay")
+	if err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	if err := sendAuthReq(tlsConn, api.AuthReq{Mux: true}); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	resp := api.Mux{}
+	if err := api.ReadMessageOf(tlsConn, api.MsgMux, &resp); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+	return &Mux{session: mux.Client(tlsConn), MaxStreams: resp.MaxStreams, Window: resp.Window}, nil
+}
+
+// OpenStream opens a stream to dest under tag and waits for the relay to pair it, like StartRelayAuthGo.
+// The stream and the TLS role of the party are then passed to GetSessionE2EGo for the E2E session.
+func (m *Mux) OpenStream(dest, tag string) (*mux.Stream, *api.Ready, error) {
+	return m.open(api.AuthReq{DestParty: dest, Tag: tag})
+}
+
+// open opens a stream carrying authReq and waits for the relay to pair it
+func (m *Mux) open(authReq api.AuthReq) (*mux.Stream, *api.Ready, error) {
+	var req bytes.Buffer
+	if err := api.WriteMessage(&req, api.MsgAuthReq, authReq); err != nil {
+		return nil, nil, err
+	}
+	stream, err := m.session.Open(req.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	ready, err := awaitStreamReady(stream)
+	if err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
+	return stream, ready, nil
+}
+
+// awaitStreamReady reads the replies of the relay to a stream until it is paired
+func awaitStreamReady(stream *mux.Stream) (*api.Ready, error) {
+	for {
+		reply, err := stream.ReadControl()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the reply to stream %d: %v", stream.ID(), err)
+		}
+		t, payload, err := api.ReadMessage(bytes.NewReader(reply))
+		if err != nil {
+			return nil, err
+		}
+		if t == api.MsgWaiting {
+			// Parked until the peer arrives
+			continue
+		}
+		ready := &api.Ready{}
+		if err := api.DecodeMessage(t, payload, api.MsgReady, ready); err != nil {
+			return nil, err
+		}
+		return ready, nil
+	}
+}
+
+// Close ends the session, and with it every stream still open
+func (m *Mux) Close() error {
+	return m.session.Close()
+}
@@ -0,0 +1,350 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/flock-org/flock/relay/config"
+	"github.com/flock-org/flock/relay/pkg/revocation"
+)
+
+// sealVersion heads the sealed messages
+const sealVersion byte = 2
+
+const (
+	sealKeySize   = 32
+	sealNonceSize = 12
+	sealSeqSize   = 8
+)
+
+// errReplayed is returned by Open for a message whose sequence number is not above the last one opened under its tag
+var errReplayed = errors.New("message was already opened")
+
+// errSeqStore is returned by Open when the sequence number of a message could not be saved, the message was not opened
+var errSeqStore = errors.New("unable to record the opened message")
+
+// SeqStore keeps the sequence number of the last message a Sealer opened under each tag, so that replays are
+// rejected across processes, e.g. by the parties of a serverless function that each invocation starts anew.
+// A tag never opened loads as 0.
+type SeqStore interface {
+	Load(tag string) (uint64, error)
+	Save(tag string, seq uint64) error
+}
+
+// fileSeqStore is a SeqStore in a JSON file mapping the tags to their sequence numbers
+type fileSeqStore struct {
+	path string
+}
+
+// NewFileSeqStore returns a SeqStore kept in the file at path
+func NewFileSeqStore(path string) SeqStore {
+	return &fileSeqStore{path: path}
+}
+
+func (f *fileSeqStore) read() (map[string]uint64, error) {
+	seqs := make(map[string]uint64)
+	data, err := os.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return seqs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &seqs); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", f.path, err)
+	}
+	return seqs, nil
+}
+
+func (f *fileSeqStore) Load(tag string) (uint64, error) {
+	seqs, err := f.read()
+	return seqs[tag], err
+}
+
+func (f *fileSeqStore) Save(tag string, seq uint64) error {
+	seqs, err := f.read()
+	if err != nil {
+		return err
+	}
+	seqs[tag] = seq
+	data, err := json.Marshal(seqs)
+	if err != nil {
+		return err
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	// Rename is atomic, so a crash never leaves the sequence numbers half written
+	return os.Rename(tmp, f.path)
+}
+
+// Sealer encrypts the mailbox messages of a party to its peer and signs them with the party key, so that only
+// the peer can read them and the relay can neither read nor forge them. It opens the messages of the peer in turn.
+//
+// A sealed message is laid out as:
+//
+//	| version (1 byte) | sequence (8 bytes) | AES key encrypted with RSA-OAEP for the recipient | nonce (12 bytes) | AES-GCM ciphertext | RSA-PSS signature of the sender |
+//
+// The user, the sender, the recipient, the tag of the mailbox and the sequence number are bound to the ciphertext
+// and the signature, so the relay can neither move a message to another mailbox nor reorder it. The sequence
+// numbers of a sender grow across sessions and restarts, they are the time the message was sealed, and Open
+// rejects a message whose sequence number is not above the last one it opened under the same tag.
+// The last sequence numbers opened are only kept by the Sealer, and so only reject replays within its process,
+// unless they are saved in a SeqStore: NewSealer keeps them next to the party certificates, while the callers
+// of NewSealerWithCerts that start new processes, such as serverless functions, supply one with SetSeqStore.
+type Sealer struct {
+	user    string
+	name    string
+	peer    string
+	key     *rsa.PrivateKey
+	peerKey *rsa.PublicKey
+	mutex   sync.Mutex
+	sealed  uint64            // sequence number of the last message sealed
+	opened  map[string]uint64 // Tag -> sequence number of the last message opened
+	seqs    SeqStore
+}
+
+// NewSealer returns the sealer of party with its peer dest, both parties of user, from the certificates directory
+func NewSealer(user, party, dest string) (*Sealer, error) {
+	partyDirectory := config.UserPartyDirectory(user, party)
+	userDirectory := config.UserDirectory(user)
+	parsedCertData, err := parseTLSFiles(filepath.Join(userDirectory, config.UserCAFile),
+		filepath.Join(partyDirectory, config.CertificateFileName),
+		filepath.Join(partyDirectory, config.PrivateKeyFileName))
+	if err != nil {
+		return nil, err
+	}
+	caData, err := os.ReadFile(filepath.Join(userDirectory, config.UserCAFile))
+	if err != nil {
+		return nil, err
+	}
+	parsedCertData.crl, err = revocation.NewList(filepath.Join(userDirectory, config.UserCRLFile), caData)
+	if err != nil {
+		return nil, err
+	}
+	peerCert, err := os.ReadFile(filepath.Join(config.UserPartyDirectory(user, dest), config.CertificateFileName))
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the certificate of %s: %v", dest, err)
+	}
+	sealer, err := newSealer(parsedCertData, peerCert)
+	if err != nil {
+		return nil, err
+	}
+	sealer.SetSeqStore(NewFileSeqStore(config.PartyOpenedSeqFile(user, party, dest)))
+	return sealer, nil
+}
+
+// NewSealerWithCerts returns the sealer of a party with the PEM encoded user CA, party certificate and key,
+// and the certificate of its peer. An optional PEM encoded CRL of the user CA rejects a revoked peer.
+func NewSealerWithCerts(cacert, cert, key, peerCert string, crl ...string) (*Sealer, error) {
+	parsedCertData, err := parseTLSStrings(cacert, cert, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(crl) > 0 && crl[0] != "" {
+		parsedCertData.crl, err = revocation.ParseList([]byte(crl[0]), []byte(cacert))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return newSealer(parsedCertData, []byte(peerCert))
+}
+
+// newSealer checks that the peer certificate is issued by the user CA and not revoked
+func newSealer(parsedCertData *parsedCertData, peerPEM []byte) (*Sealer, error) {
+	key, ok := parsedCertData.certificate.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unable to seal messages with a %T key", parsedCertData.certificate.PrivateKey)
+	}
+	block, _ := pem.Decode(peerPEM)
+	if block == nil {
+		return nil, fmt.Errorf("peer certificate is not in PEM format")
+	}
+	peerCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse peer certificate: %v", err)
+	}
+	_, err = peerCert.Verify(x509.VerifyOptions{Roots: parsedCertData.ca, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+	if err != nil {
+		return nil, fmt.Errorf("unable to verify peer certificate: %v", err)
+	}
+	if err := parsedCertData.crl.Check(peerCert); err != nil {
+		return nil, err
+	}
+	peerKey, ok := peerCert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unable to seal messages for a %T key", peerCert.PublicKey)
+	}
+	return &Sealer{
+		// Both parties are issued by the user CA, named after the user
+		user:    parsedCertData.x509cert.Issuer.CommonName,
+		name:    parsedCertData.x509cert.Subject.CommonName,
+		peer:    peerCert.Subject.CommonName,
+		key:     key,
+		peerKey: peerKey,
+		opened:  make(map[string]uint64),
+	}, nil
+}
+
+// SetSeqStore keeps the sequence numbers of the messages opened in store, which must not be shared by other
+// sealers of the party with the same peer
+func (s *Sealer) SetSeqStore(store SeqStore) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.seqs = store
+	s.opened = make(map[string]uint64)
+}
+
+// sealContext binds a sealed message to its user, sender, recipient, tag and sequence number, so it cannot be passed
+// off in the other direction, in another mailbox or in place of another message
+func sealContext(user, sender, recipient, tag string, seq uint64) []byte {
+	context := []byte(fmt.Sprintf("flock-mailbox/%d", sealVersion))
+	for _, field := range []string{user, sender, recipient, tag} {
+		context = binary.BigEndian.AppendUint32(context, uint32(len(field)))
+		context = append(context, field...)
+	}
+	return binary.BigEndian.AppendUint64(context, seq)
+}
+
+// nextSeq returns the sequence number of the next message sealed, above the previous one and at least the current time
+func (s *Sealer) nextSeq() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sealed++
+	if now := uint64(time.Now().UnixNano()); now > s.sealed {
+		s.sealed = now
+	}
+	return s.sealed
+}
+
+// checkSeq records seq as the last message opened under tag, unless it is not above the previous one
+func (s *Sealer) checkSeq(tag string, seq uint64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	last, ok := s.opened[tag]
+	if !ok && s.seqs != nil {
+		var err error
+		if last, err = s.seqs.Load(tag); err != nil {
+			return fmt.Errorf("%w: %v", errSeqStore, err)
+		}
+	}
+	if seq <= last {
+		s.opened[tag] = last
+		return errReplayed
+	}
+	if s.seqs != nil {
+		if err := s.seqs.Save(tag, seq); err != nil {
+			return fmt.Errorf("%w: %v", errSeqStore, err)
+		}
+	}
+	s.opened[tag] = seq
+	return nil
+}
+
+// digest hashes the context and the sealed message up to its signature
+func digest(context, sealed []byte) []byte {
+	h := sha256.New()
+	h.Write(context)
+	h.Write(sealed)
+	return h.Sum(nil)
+}
+
+// Seal encrypts msg for the peer in the mailbox of tag and signs it
+func (s *Sealer) Seal(tag string, msg []byte) ([]byte, error) {
+	aesKey := make([]byte, sealKeySize)
+	nonce := make([]byte, sealNonceSize)
+	if _, err := rand.Read(aesKey); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, s.peerKey, aesKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	seq := s.nextSeq()
+	context := sealContext(s.user, s.name, s.peer, tag, seq)
+	sealed := binary.BigEndian.AppendUint64([]byte{sealVersion}, seq)
+	sealed = append(sealed, wrappedKey...)
+	sealed = append(sealed, nonce...)
+	sealed = gcm.Seal(sealed, nonce, msg, context)
+	signature, err := rsa.SignPSS(rand.Reader, s.key, crypto.SHA256, digest(context, sealed), nil)
+	if err != nil {
+		return nil, err
+	}
+	return append(sealed, signature...), nil
+}
+
+// Open checks that a sealed message was signed by the peer for the mailbox of tag and was not opened before,
+// and returns it decrypted
+func (s *Sealer) Open(tag string, sealed []byte) ([]byte, error) {
+	header, wrappedSize, signatureSize := 1+sealSeqSize, s.key.Size(), s.peerKey.Size()
+	if len(sealed) < header+wrappedSize+sealNonceSize+signatureSize || sealed[0] != sealVersion {
+		return nil, fmt.Errorf("malformed sealed message")
+	}
+	seq := binary.BigEndian.Uint64(sealed[1:header])
+	context := sealContext(s.user, s.peer, s.name, tag, seq)
+	signed, signature := sealed[:len(sealed)-signatureSize], sealed[len(sealed)-signatureSize:]
+	if err := rsa.VerifyPSS(s.peerKey, crypto.SHA256, digest(context, signed), signature, nil); err != nil {
+		return nil, fmt.Errorf("message is not signed by %s: %v", s.peer, err)
+	}
+	wrappedKey := signed[header : header+wrappedSize]
+	nonce := signed[header+wrappedSize : header+wrappedSize+sealNonceSize]
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, s.key, wrappedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt message key: %v", err)
+	}
+	block, err := aes.NewCipher(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := gcm.Open(nil, nonce, signed[header+wrappedSize+sealNonceSize:], context)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkSeq(tag, seq); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a PEM encoded certificate and key
+type testCert struct {
+	cert, key string
+	x509cert  *x509.Certificate
+	privKey   *rsa.PrivateKey
+}
+
+// newTestCert issues a certificate of cn, self-signed when issuer is nil
+func newTestCert(t *testing.T, cn string, serial int64, issuer *testCert) *testCert {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	parent, signer := template, key
+	if issuer == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = issuer.x509cert, issuer.privKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x509cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{
+		cert:     string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		key:      string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})),
+		x509cert: x509cert,
+		privKey:  key,
+	}
+}
+
+// newTestSealerPair returns the sealers of parties 0 and 1 of user1 with each other
+func newTestSealerPair(t *testing.T) (func() *Sealer, *Sealer) {
+	ca := newTestCert(t, "user1", 1, nil)
+	p0, p1 := newTestCert(t, "0", 2, ca), newTestCert(t, "1", 3, ca)
+	s0, err := NewSealerWithCerts(ca.cert, p0.cert, p0.key, p1.cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() *Sealer {
+		s1, err := NewSealerWithCerts(ca.cert, p1.cert, p1.key, p0.cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s1
+	}, s0
+}
+
+// newTestSealers returns the sealers of parties 0 and 1 of user1 with each other, and of party 2 with party 1
+func newTestSealers(t *testing.T) (*Sealer, *Sealer, *Sealer) {
+	ca := newTestCert(t, "user1", 1, nil)
+	parties := []*testCert{newTestCert(t, "0", 2, ca), newTestCert(t, "1", 3, ca), newTestCert(t, "2", 4, ca)}
+	sealer := func(party, peer int) *Sealer {
+		s, err := NewSealerWithCerts(ca.cert, parties[party].cert, parties[party].key, parties[peer].cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	return sealer(0, 1), sealer(1, 0), sealer(2, 1)
+}
+
+func TestSealOpen(t *testing.T) {
+	s0, s1, s2 := newTestSealers(t)
+	sealed, err := s0.Seal("tag", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := s1.Open("tag", sealed)
+	if err != nil || string(msg) != "hello" {
+		t.Fatalf("expected hello, got %q: %v", msg, err)
+	}
+
+	fresh := func() []byte {
+		sealed, err := s0.Seal("tag", []byte("hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sealed
+	}
+	tampered := fresh()
+	tampered[len(tampered)/2] ^= 1
+	reordered := fresh()
+	reordered[1] ^= 1
+	tests := []struct {
+		name   string
+		opener *Sealer
+		tag    string
+		sealed []byte
+	}{
+		{"tampered ciphertext", s1, "tag", tampered},
+		{"altered sequence number", s1, "tag", reordered},
+		{"other mailbox", s1, "other", fresh()},
+		// The sender cannot open its own message, nor can it be passed off in the other direction
+		{"wrong direction", s0, "tag", fresh()},
+		{"other sender", s2, "tag", fresh()},
+		{"truncated", s1, "tag", fresh()[:100]},
+		{"unknown version", s1, "tag", append([]byte{sealVersion + 1}, fresh()[1:]...)},
+	}
+	for _, test := range tests {
+		if _, err := test.opener.Open(test.tag, test.sealed); err == nil {
+			t.Errorf("%s: expected the message to be rejected", test.name)
+		}
+	}
+}
+
+func TestOpenReplay(t *testing.T) {
+	s0, s1, _ := newTestSealers(t)
+	first, err := s0.Seal("tag", []byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s0.Seal("tag", []byte("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.Open("tag", first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.Open("tag", first); !errors.Is(err, errReplayed) {
+		t.Fatalf("expected a message opened twice to be replayed, got %v", err)
+	}
+	if _, err := s1.Open("tag", second); err != nil {
+		t.Fatal(err)
+	}
+	// A message older than the last one opened is replayed too, the relay cannot reorder them
+	if _, err := s1.Open("tag", first); !errors.Is(err, errReplayed) {
+		t.Fatalf("expected an older message to be replayed, got %v", err)
+	}
+	// The sequence numbers are tracked per mailbox
+	other, err := s0.Seal("other", []byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.Open("other", other); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewSealerRejectsForeignPeer(t *testing.T) {
+	ca := newTestCert(t, "user1", 1, nil)
+	party := newTestCert(t, "0", 2, ca)
+	foreign := newTestCert(t, "1", 3, newTestCert(t, "user2", 1, nil))
+	if _, err := NewSealerWithCerts(ca.cert, party.cert, party.key, foreign.cert); err == nil {
+		t.Fatal("expected a peer issued by another user CA to be rejected")
+	}
+}
+
+// failingSeqStore fails to save the sequence numbers
+type failingSeqStore struct{}
+
+func (failingSeqStore) Load(string) (uint64, error) { return 0, nil }
+
+func (failingSeqStore) Save(string, uint64) error { return errors.New("disk full") }
+
+func TestOpenReplayAcrossProcesses(t *testing.T) {
+	newRecipient, s0 := newTestSealerPair(t)
+	sealed, err := s0.Seal("tag", []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "opened.json")
+
+	first := newRecipient()
+	first.SetSeqStore(NewFileSeqStore(path))
+	if _, err := first.Open("tag", sealed); err != nil {
+		t.Fatal(err)
+	}
+	// A sealer of a new process with the same store rejects the message, one without a store does not
+	restarted := newRecipient()
+	restarted.SetSeqStore(NewFileSeqStore(path))
+	if _, err := restarted.Open("tag", sealed); !errors.Is(err, errReplayed) {
+		t.Fatalf("expected the message to be replayed across processes, got %v", err)
+	}
+	if _, err := newRecipient().Open("tag", sealed); err != nil {
+		t.Fatalf("expected a sealer without a store to only know its own process, got %v", err)
+	}
+
+	failing := newRecipient()
+	failing.SetSeqStore(failingSeqStore{})
+	if _, err := failing.Open("tag", sealed); !errors.Is(err, errSeqStore) {
+		t.Fatalf("expected a message whose sequence cannot be saved not to be opened, got %v", err)
+	}
+}
@@ -18,6 +18,9 @@ import (
 	"crypto/x509"
 	"fmt"
 	"os"
+
+	"github.com/flock-org/flock/relay/config"
+	"github.com/flock-org/flock/relay/pkg/revocation"
 )
 
 // ParsedCertData contains a parsed CA and TLS certificate.
@@ -25,6 +28,8 @@ type parsedCertData struct {
 	certificate tls.Certificate
 	ca          *x509.CertPool
 	x509cert    *x509.Certificate
+	// crl optionally rejects peers whose certificate the CA revoked
+	crl *revocation.List
 }
 
 // ParseTLSFiles parses the given TLS-related files.
@@ -97,23 +102,61 @@ func parseTLSStrings(ca, cert, key string) (*parsedCertData, error) {
 // ServerConfig return a TLS configuration for a server.
 func (c *parsedCertData) ServerConfig() *tls.Config {
 	return &tls.Config{
-		MinVersion:   tls.VersionTLS12,
-		Certificates: []tls.Certificate{c.certificate},
-		ClientCAs:    c.ca,
-		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:       tls.VersionTLS12,
+		Certificates:     []tls.Certificate{c.certificate},
+		ClientCAs:        c.ca,
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		VerifyConnection: c.verifyConnection,
 	}
 }
 
 // ClientConfig return a TLS configuration for a client.
 func (c *parsedCertData) ClientConfig(sni string) *tls.Config {
 	return &tls.Config{
-		MinVersion:   tls.VersionTLS12,
-		Certificates: []tls.Certificate{c.certificate},
-		RootCAs:      c.ca,
-		ServerName:   sni,
+		MinVersion:       tls.VersionTLS12,
+		Certificates:     []tls.Certificate{c.certificate},
+		RootCAs:          c.ca,
+		ServerName:       sni,
+		VerifyConnection: c.verifyConnection,
 	}
 }
 
+// WebConfig returns the TLS configuration of the HTTPS connection carrying a wss:// relay URL. The server is
+// either an ingress with a certificate of the system roots for host, or the relay itself with its relay certificate.
+func (c *parsedCertData) WebConfig(host string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// The chain is verified by VerifyConnection, against either set of roots
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return fmt.Errorf("HTTPS server sent no certificate")
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates})
+			if err == nil {
+				return nil
+			}
+			if _, relayErr := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       config.FlockrelayServerName,
+				Roots:         c.ca,
+				Intermediates: intermediates,
+			}); relayErr != nil {
+				return fmt.Errorf("unable to verify the HTTPS server %s: %v", host, err)
+			}
+			return nil
+		},
+	}
+}
+
+// verifyConnection rejects a peer whose certificate is revoked
+func (c *parsedCertData) verifyConnection(cs tls.ConnectionState) error {
+	return c.crl.VerifyConnection(cs)
+}
+
 // DNSNames returns the certificate DNS names.
 func (c *parsedCertData) DNSNames() []string {
 	return c.x509cert.DNSNames
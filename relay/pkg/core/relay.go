@@ -14,9 +14,14 @@
 package core
 
 import (
+	"context"
+	"fmt"
+	"net"
+
 	"github.com/clusterlink-net/clusterlink/pkg/util"
 	"github.com/sirupsen/logrus"
 
+	"github.com/flock-org/flock/relay/pkg/policy"
 	"github.com/flock-org/flock/relay/pkg/server"
 )
 
@@ -27,26 +32,68 @@ var localhost = "127.0.0.1"
 // Relay struct defines the properties of the relay
 type Relay struct {
 	url      string
+	ip       string // address the relay listeners bind, every address if empty
 	DPServer *server.Server
 }
 
-// StartRelay starts the main function of the relay
-func (r *Relay) StartRelay(parsedCertData *util.ParsedCertData, port string) error {
-	r.DPServer = server.NewRelay(parsedCertData)
+// StartRelay starts the main function of the relay on every listen address, with the optional metrics and admin servers
+// bound to the relay IP.
+// Once ctx is done the relay stops accepting parties and returns after draining its sessions.
+func (r *Relay) StartRelay(ctx context.Context, parsedCertData *util.ParsedCertData, addresses []string, metricsPort, adminPort string, opts server.Options) error {
+	r.DPServer = server.NewRelay(parsedCertData, opts)
 	// Start a routine to print active connections periodically
-	go r.DPServer.MonitorConnections()
+	go r.DPServer.MonitorConnections(ctx)
+	// Start a routine to evict parties whose peer never arrived
+	go r.DPServer.ReapRendezvous(ctx)
+	if metricsPort != "" {
+		go func() {
+			if err := r.DPServer.StartMetricsServer(net.JoinHostPort(r.ip, metricsPort)); err != nil {
+				clog.Errorf("Metrics server stopped: %v", err)
+			}
+		}()
+	}
+	if adminPort != "" {
+		go func() {
+			if err := r.DPServer.StartAdminServer(net.JoinHostPort(r.ip, adminPort)); err != nil {
+				clog.Errorf("Admin server stopped: %v", err)
+			}
+		}()
+	}
 	// Start the main relay server
-	err := r.DPServer.StartRelaySSLServer(port)
+	if err := r.DPServer.StartRelaySSLServer(ctx, addresses); err != nil {
+		return err
+	}
+	// The admin and metrics servers keep serving while the sessions drain
+	r.DPServer.Drain()
+	return nil
+}
 
-	return err
+// StartAPIServer starts the provisioning API server on the relay IP, handing out relayTarget (or the relay url) to parties
+func (r *Relay) StartAPIServer(parsedCertData *util.ParsedCertData, port, relayTarget string, policyEngine *policy.Engine, credentials *server.Credentials, webhookNetworks []*net.IPNet) {
+	if relayTarget == "" {
+		relayTarget = r.url
+	}
+	apiServer := server.NewAPIServer(parsedCertData, relayTarget, policyEngine, credentials, webhookNetworks)
+	if err := apiServer.StartFlockAPIServer(net.JoinHostPort(r.ip, port)); err != nil {
+		clog.Errorf("API server stopped: %v", err)
+	}
 }
 
-// Init initializes the relay
-func (r *Relay) Init(ip, port string, loglevel logrus.Level) {
+// Init initializes the relay, logging in the text or json format
+func (r *Relay) Init(ip, port string, loglevel logrus.Level, logFormat string) error {
 	r.url = ip + ":" + port
+	r.ip = ip
 	clog.Logger.SetLevel(loglevel)
-	clog.Logger.SetFormatter(&logrus.TextFormatter{
-		DisableColors: true,
-		FullTimestamp: true,
-	})
+	switch logFormat {
+	case "text":
+		clog.Logger.SetFormatter(&logrus.TextFormatter{
+			DisableColors: true,
+			FullTimestamp: true,
+		})
+	case "json":
+		clog.Logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", logFormat)
+	}
+	return nil
 }
@@ -0,0 +1,343 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mailbox buffers the messages a party sends to a peer that is not connected, until the peer
+// attaches and acknowledges them or they expire.
+package mailbox
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned once the relay is shutting down
+var ErrClosed = errors.New("the relay is shutting down")
+
+// ErrAttached is returned when the receiving party already has a mailbox session
+var ErrAttached = errors.New("the mailbox is already attached")
+
+// FullError is returned by Put when the message does not fit in the mailbox
+type FullError struct {
+	Mailbox string
+	Max     int
+}
+
+func (e *FullError) Error() string {
+	return fmt.Sprintf("mailbox %s is full, it holds up to %d bytes", e.Mailbox, e.Max)
+}
+
+// QuotaError is returned by Put when the mailboxes of the user or of the sending party reached one of their limits
+type QuotaError struct {
+	// Limit names the limit that was reached, e.g. user_mailboxes or party_mailbox_bytes
+	Limit   string
+	Max     int
+	Subject string
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s has reached its quota of %d (%s)", e.Subject, e.Max, e.Limit)
+}
+
+// Limits bounds the messages buffered by the store. MaxBytes bounds each mailbox, the other limits apply to all
+// the mailboxes of a user and of a sending party, and are unlimited when zero.
+type Limits struct {
+	MaxBytes int
+	// MaxUserBytes and MaxUserBoxes bound the bytes and the mailboxes holding messages of a user
+	MaxUserBytes int
+	MaxUserBoxes int
+	// MaxPartyBytes and MaxPartyBoxes bound the bytes and the mailboxes holding messages sent by a party
+	MaxPartyBytes int
+	MaxPartyBoxes int
+}
+
+// Message is a message buffered in a mailbox, numbered in the order it was put
+type Message struct {
+	Seq     uint64
+	Data    []byte
+	Expires time.Time
+}
+
+// box holds the messages sent by a party to a peer
+type box struct {
+	user     string
+	party    string // the sending party
+	messages []Message
+	bytes    int
+	nextSeq  uint64
+	attached bool
+	// notify is closed and replaced whenever a message is put or the store is closed
+	notify chan struct{}
+}
+
+// usage counts the mailboxes holding messages and their bytes, of a user or of a sending party
+type usage struct {
+	boxes int
+	bytes int
+}
+
+// Store holds the mailboxes of the relay, keyed by user, sending party, receiving party and tag
+type Store struct {
+	mutex   sync.Mutex
+	boxes   map[string]*box
+	users   map[string]usage // User -> usage of the user
+	parties map[string]usage // User/Party -> usage of the sending party
+	limits  Limits
+	ttl     time.Duration
+	closed  bool
+}
+
+// New returns a store whose mailboxes hold messages within limits, each kept for at most ttl
+func New(limits Limits, ttl time.Duration) *Store {
+	return &Store{
+		boxes:   make(map[string]*box),
+		users:   make(map[string]usage),
+		parties: make(map[string]usage),
+		limits:  limits,
+		ttl:     ttl,
+	}
+}
+
+func getKey(user, srcParty, dstParty, tag string) string {
+	return user + "/" + srcParty + ":" + dstParty + ":" + tag
+}
+
+// get returns the mailbox of the messages srcParty sends to dstParty, creating it if needed
+func (s *Store) get(user, srcParty, dstParty, tag string) (string, *box) {
+	key := getKey(user, srcParty, dstParty, tag)
+	b, ok := s.boxes[key]
+	if !ok {
+		b = &box{user: user, party: srcParty, nextSeq: 1, notify: make(chan struct{})}
+		s.boxes[key] = b
+	}
+	return key, b
+}
+
+// adjust adds boxes and bytes to the usage entry of key in m, dropping the entry once it is back to zero
+func adjust(m map[string]usage, key string, boxes, bytes int) {
+	u := m[key]
+	u.boxes += boxes
+	u.bytes += bytes
+	if u.boxes == 0 && u.bytes == 0 {
+		delete(m, key)
+		return
+	}
+	m[key] = u
+}
+
+// exceeds returns a *QuotaError when adding add to count, the current usage of subject, goes over max; a zero max is unlimited
+func exceeds(count, add, max int, limit, subject string) error {
+	if max > 0 && count+add > max {
+		return &QuotaError{Limit: limit, Max: max, Subject: subject}
+	}
+	return nil
+}
+
+// checkQuota checks that adding a message of size bytes to b keeps its user and its sending party within limits
+func (s *Store) checkQuota(b *box, bytes int) error {
+	boxes := 0
+	if len(b.messages) == 0 {
+		boxes = 1
+	}
+	partyKey := b.user + "/" + b.party
+	u, p := s.users[b.user], s.parties[partyKey]
+	for _, err := range []error{
+		exceeds(u.boxes, boxes, s.limits.MaxUserBoxes, "user_mailboxes", "user "+b.user),
+		exceeds(u.bytes, bytes, s.limits.MaxUserBytes, "user_mailbox_bytes", "user "+b.user),
+		exceeds(p.boxes, boxes, s.limits.MaxPartyBoxes, "party_mailboxes", "party "+partyKey),
+		exceeds(p.bytes, bytes, s.limits.MaxPartyBytes, "party_mailbox_bytes", "party "+partyKey),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// account adds messages of size bytes, or removes them when negative, from the usage of the user and
+// the sending party of b. A mailbox counts for them while it holds messages.
+func (s *Store) account(b *box, messages, bytes int) {
+	boxes := 0
+	switch {
+	case messages > 0 && len(b.messages) == messages:
+		boxes = 1
+	case messages < 0 && len(b.messages) == 0:
+		boxes = -1
+	}
+	adjust(s.users, b.user, boxes, bytes)
+	adjust(s.parties, b.user+"/"+b.party, boxes, bytes)
+}
+
+// Put buffers a message sent by srcParty to dstParty, failing with a *FullError when the mailbox is full,
+// or with a *QuotaError when the mailboxes of the user or of srcParty are
+func (s *Store) Put(user, srcParty, dstParty, tag string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	key, b := s.get(user, srcParty, dstParty, tag)
+	if b.bytes+len(data) > s.limits.MaxBytes {
+		return &FullError{Mailbox: key, Max: s.limits.MaxBytes}
+	}
+	if err := s.checkQuota(b, len(data)); err != nil {
+		return err
+	}
+	b.messages = append(b.messages, Message{Seq: b.nextSeq, Data: data, Expires: time.Now().Add(s.ttl)})
+	b.nextSeq++
+	b.bytes += len(data)
+	s.account(b, 1, len(data))
+	close(b.notify)
+	b.notify = make(chan struct{})
+	return nil
+}
+
+// Reader receives the messages of a mailbox for the party attached to it
+type Reader struct {
+	store *Store
+	key   string
+	// delivered is the sequence number of the last message returned by Next
+	delivered uint64
+}
+
+// Attach attaches dstParty to the mailbox of the messages srcParty sent it, a mailbox has a single reader at a time
+func (s *Store) Attach(user, srcParty, dstParty, tag string) (*Reader, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	key, b := s.get(user, srcParty, dstParty, tag)
+	if b.attached {
+		return nil, ErrAttached
+	}
+	b.attached = true
+	return &Reader{store: s, key: key}, nil
+}
+
+// Pending returns the number of messages waiting in the mailbox of the reader
+func (r *Reader) Pending() int {
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+	return len(r.store.boxes[r.key].messages)
+}
+
+// Next returns the messages put since the last call, waiting for one until done is closed.
+// The messages stay in the mailbox until they are acknowledged.
+func (r *Reader) Next(done <-chan struct{}) ([]Message, error) {
+	for {
+		r.store.mutex.Lock()
+		if r.store.closed {
+			r.store.mutex.Unlock()
+			return nil, ErrClosed
+		}
+		b := r.store.boxes[r.key]
+		var next []Message
+		for _, m := range b.messages {
+			if m.Seq > r.delivered {
+				next = append(next, m)
+			}
+		}
+		notify := b.notify
+		r.store.mutex.Unlock()
+		if len(next) > 0 {
+			r.delivered = next[len(next)-1].Seq
+			return next, nil
+		}
+		select {
+		case <-done:
+			return nil, nil
+		case <-notify:
+		}
+	}
+}
+
+// Ack removes the delivered messages up to seq from the mailbox
+func (r *Reader) Ack(seq uint64) {
+	if seq > r.delivered {
+		seq = r.delivered
+	}
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+	b := r.store.boxes[r.key]
+	messages, bytes := 0, 0
+	for len(b.messages) > 0 && b.messages[0].Seq <= seq {
+		messages++
+		bytes += len(b.messages[0].Data)
+		b.messages = b.messages[1:]
+	}
+	b.bytes -= bytes
+	r.store.account(b, -messages, -bytes)
+}
+
+// Detach ends the mailbox session of the reader, the messages it did not acknowledge are delivered again on the next one
+func (r *Reader) Detach() {
+	r.store.mutex.Lock()
+	defer r.store.mutex.Unlock()
+	b := r.store.boxes[r.key]
+	b.attached = false
+	if len(b.messages) == 0 {
+		delete(r.store.boxes, r.key)
+	}
+}
+
+// Expire drops the messages whose time to live is over, and returns how many were dropped
+func (s *Store) Expire(now time.Time) int {
+	expired := 0
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for key, b := range s.boxes {
+		kept := b.messages[:0]
+		messages, bytes := 0, 0
+		for _, m := range b.messages {
+			if now.After(m.Expires) {
+				messages++
+				bytes += len(m.Data)
+				continue
+			}
+			kept = append(kept, m)
+		}
+		b.messages = kept
+		b.bytes -= bytes
+		expired += messages
+		s.account(b, -messages, -bytes)
+		if len(b.messages) == 0 && !b.attached {
+			delete(s.boxes, key)
+		}
+	}
+	return expired
+}
+
+// Close stops accepting messages and ends the mailbox sessions, the buffered messages are dropped
+func (s *Store) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.closed = true
+	for _, b := range s.boxes {
+		close(b.notify)
+		b.notify = make(chan struct{})
+	}
+}
+
+// Usage returns the number of messages and bytes buffered in the mailboxes
+func (s *Store) Usage() (int, int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	messages, bytes := 0, 0
+	for _, b := range s.boxes {
+		messages += len(b.messages)
+		bytes += b.bytes
+	}
+	return messages, bytes
+}
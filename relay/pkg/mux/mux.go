@@ -0,0 +1,405 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package mux multiplexes logical streams over a single connection, each stream with its own flow control.
+//
+// Every frame is:
+//
+//	| type (1 byte) | stream id (4 bytes, big endian) | length (4 bytes, big endian) | payload (length bytes) |
+//
+// The client side opens a stream with an Open frame carrying its request, the server side may answer with
+// Control frames before either side sends Data. A side may send as many Data bytes as the window of the
+// stream allows, DefaultWindow initially, which the receiver extends with Window frames as it reads them.
+// Close ends the data a side sends, like a TCP half-close, and Reset aborts the stream.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWindow is the number of bytes a side may send on a stream before the receiver reads them
+	DefaultWindow = 256 * 1024
+	// DefaultMaxStreams bounds the open streams of a server session
+	DefaultMaxStreams = 256
+	// MaxFrameSize bounds the payload of a frame
+	MaxFrameSize = 64 * 1024
+	// maxDataFrame bounds the Data frames so that the streams of a session interleave
+	maxDataFrame = 16 * 1024
+	// acceptBacklog bounds the streams opened and not yet accepted
+	acceptBacklog = 64
+	// resetBacklog bounds the Reset frames waiting to be written, beyond which the other side is not reading
+	resetBacklog = 64
+	// writeTimeout bounds each frame write in case the other side is gone
+	writeTimeout = 30 * time.Second
+	// closeTimeout bounds the wait for the other side to close its end of the session
+	closeTimeout = 5 * time.Second
+	headerSize   = 9
+)
+
+const (
+	frameOpen    byte = 1
+	frameControl byte = 2
+	frameData    byte = 3
+	frameWindow  byte = 4
+	frameClose   byte = 5
+	frameReset   byte = 6
+)
+
+// ErrSessionClosed is returned by the streams of a session once its connection is closed
+var ErrSessionClosed = errors.New("mux session closed")
+
+// errWindowExceeded fails a stream whose other side sent more than its window
+var errWindowExceeded = errors.New("flow control window exceeded")
+
+// ResetError is returned by a stream the other side aborted
+type ResetError struct {
+	Reason string
+}
+
+func (e *ResetError) Error() string {
+	if e.Reason == "" {
+		return "stream reset by peer"
+	}
+	return "stream reset by peer: " + e.Reason
+}
+
+// Session multiplexes the streams of a connection
+type Session struct {
+	conn       net.Conn
+	client     bool
+	maxStreams int
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+	accept  chan acceptedStream
+	// resets queues the Reset frames of the reader for a single writer, resetting holds their stream ids
+	resets    chan resetFrame
+	resetting map[uint32]bool
+	// done is closed once the connection no longer carries frames from the other side
+	done chan struct{}
+}
+
+// resetFrame is a Reset frame waiting to be written
+type resetFrame struct {
+	id     uint32
+	reason string
+}
+
+// acceptedStream is a stream opened by the client side with its request
+type acceptedStream struct {
+	stream  *Stream
+	request []byte
+}
+
+// Client returns the session of the side of conn that opens streams
+func Client(conn net.Conn) *Session {
+	return newSession(conn, true, 0)
+}
+
+// Server returns the session of the side of conn that accepts up to maxStreams open streams
+func Server(conn net.Conn, maxStreams int) *Session {
+	if maxStreams <= 0 {
+		maxStreams = DefaultMaxStreams
+	}
+	return newSession(conn, false, maxStreams)
+}
+
+func newSession(conn net.Conn, client bool, maxStreams int) *Session {
+	s := &Session{
+		conn:       conn,
+		client:     client,
+		maxStreams: maxStreams,
+		streams:    make(map[uint32]*Stream),
+		nextID:     1,
+		accept:     make(chan acceptedStream, acceptBacklog),
+		resets:     make(chan resetFrame, resetBacklog),
+		resetting:  make(map[uint32]bool),
+		done:       make(chan struct{}),
+	}
+	go s.readFrames()
+	go s.writeResets()
+	return s
+}
+
+// Open opens a stream carrying request, the client side of the session reads the replies with ReadControl
+func (s *Session) Open(request []byte) (*Stream, error) {
+	if !s.client {
+		return nil, fmt.Errorf("only the client side of a session opens streams")
+	}
+	s.mutex.Lock()
+	if s.err != nil {
+		s.mutex.Unlock()
+		return nil, s.err
+	}
+	st := newStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.mutex.Unlock()
+	if err := s.writeFrame(frameOpen, st.id, request); err != nil {
+		s.remove(st.id)
+		return nil, err
+	}
+	return st, nil
+}
+
+// Accept returns the next stream opened by the client side and its request
+func (s *Session) Accept() (*Stream, []byte, error) {
+	accepted, ok := <-s.accept
+	if !ok {
+		return nil, nil, s.Err()
+	}
+	return accepted.stream, accepted.request, nil
+}
+
+// Done returns a channel closed once the session is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+// NumStreams returns the number of streams open on the session
+func (s *Session) NumStreams() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.streams)
+}
+
+// Err returns the error that closed the session, nil while it is open
+func (s *Session) Err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.err
+}
+
+// Close ends the session, failing its streams. The frames written so far are delivered before the connection
+// is shut down for writing, then Close waits for the other side to close its end, so that closing a connection
+// with frames left unread does not reset it and drop them.
+func (s *Session) Close() error {
+	if cw, ok := s.conn.(interface{ CloseWrite() error }); ok && s.Err() == nil {
+		s.writeMutex.Lock()
+		err := cw.CloseWrite()
+		s.writeMutex.Unlock()
+		if err == nil {
+			select {
+			case <-s.done:
+			case <-time.After(closeTimeout):
+			}
+		}
+	}
+	s.closeWithError(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWithError(err error) {
+	s.mutex.Lock()
+	if s.err != nil {
+		s.mutex.Unlock()
+		return
+	}
+	s.err = err
+	streams := s.streams
+	s.streams = make(map[uint32]*Stream)
+	s.mutex.Unlock()
+	s.conn.Close()
+	for _, st := range streams {
+		st.fail(err)
+	}
+}
+
+// remove forgets a stream, whose frames are then answered with Reset
+func (s *Session) remove(id uint32) {
+	s.mutex.Lock()
+	delete(s.streams, id)
+	s.mutex.Unlock()
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.streams[id]
+}
+
+// writeFrame writes a frame, a failed write closes the session
+func (s *Session) writeFrame(t byte, id uint32, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds %d bytes", len(payload), MaxFrameSize)
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = t
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:headerSize], uint32(len(payload)))
+	copy(frame[headerSize:], payload)
+
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	err := s.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err == nil {
+		_, err = s.conn.Write(frame)
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrSessionClosed, err)
+		s.closeWithError(err)
+	}
+	return err
+}
+
+func (s *Session) writeWindow(id uint32, increment int) {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(increment))
+	_ = s.writeFrame(frameWindow, id, payload)
+}
+
+// readFrames dispatches the frames of the connection to the streams until the connection fails
+func (s *Session) readFrames() {
+	defer close(s.done)
+	defer close(s.accept)
+	header := make([]byte, headerSize)
+	buf := make([]byte, MaxFrameSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			s.closeWithError(readError(err))
+			return
+		}
+		t, id, length := header[0], binary.BigEndian.Uint32(header[1:5]), binary.BigEndian.Uint32(header[5:headerSize])
+		if length > MaxFrameSize {
+			s.closeWithError(fmt.Errorf("%w: frame of %d bytes exceeds %d bytes", ErrSessionClosed, length, MaxFrameSize))
+			return
+		}
+		payload := buf[:length]
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.closeWithError(readError(err))
+			return
+		}
+		if err := s.dispatch(t, id, payload); err != nil {
+			s.closeWithError(fmt.Errorf("%w: %v", ErrSessionClosed, err))
+			return
+		}
+	}
+}
+
+func readError(err error) error {
+	if errors.Is(err, io.EOF) {
+		return ErrSessionClosed
+	}
+	return fmt.Errorf("%w: %v", ErrSessionClosed, err)
+}
+
+// dispatch handles a frame, returning an error when the other side breaks the protocol
+func (s *Session) dispatch(t byte, id uint32, payload []byte) error {
+	if t == frameOpen {
+		return s.opened(id, payload)
+	}
+	st := s.stream(id)
+	if st == nil {
+		if t == frameData || t == frameControl {
+			// The stream was closed on this side, tell the other side to stop sending
+			s.reset(id, "stream closed")
+		}
+		return nil
+	}
+	switch t {
+	case frameControl:
+		st.pushControl(append([]byte(nil), payload...))
+	case frameData:
+		if !st.pushData(payload) {
+			s.remove(id)
+			st.fail(errWindowExceeded)
+			s.reset(id, errWindowExceeded.Error())
+		}
+	case frameWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("window frame of %d bytes", len(payload))
+		}
+		st.addWindow(int(binary.BigEndian.Uint32(payload)))
+	case frameClose:
+		st.pushClose()
+	case frameReset:
+		s.remove(id)
+		st.fail(&ResetError{Reason: string(payload)})
+	default:
+		return fmt.Errorf("unknown frame type %d", t)
+	}
+	return nil
+}
+
+// reset aborts a stream of the other side. The frame is queued for writeResets so that the reader of the session
+// never waits for the other side to read; a stream already waiting for its reset is not queued again, and the
+// session is closed once resetBacklog frames are waiting.
+func (s *Session) reset(id uint32, reason string) {
+	s.mutex.Lock()
+	if s.resetting[id] {
+		s.mutex.Unlock()
+		return
+	}
+	s.resetting[id] = true
+	s.mutex.Unlock()
+	select {
+	case s.resets <- resetFrame{id: id, reason: reason}:
+	default:
+		s.closeWithError(fmt.Errorf("%w: %d stream resets waiting to be written", ErrSessionClosed, resetBacklog))
+	}
+}
+
+// writeResets writes the queued Reset frames until the session is closed
+func (s *Session) writeResets() {
+	for {
+		select {
+		case r := <-s.resets:
+			_ = s.writeFrame(frameReset, r.id, []byte(r.reason))
+			s.mutex.Lock()
+			delete(s.resetting, r.id)
+			s.mutex.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// opened accepts a stream opened by the client side
+func (s *Session) opened(id uint32, request []byte) error {
+	if s.client || id%2 == 0 {
+		return fmt.Errorf("unexpected open of stream %d", id)
+	}
+	s.mutex.Lock()
+	if _, exists := s.streams[id]; exists {
+		s.mutex.Unlock()
+		return fmt.Errorf("stream %d is already open", id)
+	}
+	if len(s.streams) >= s.maxStreams {
+		s.mutex.Unlock()
+		s.reset(id, fmt.Sprintf("the session has %d open streams", s.maxStreams))
+		return nil
+	}
+	st := newStream(s, id)
+	s.streams[id] = st
+	s.mutex.Unlock()
+	select {
+	case s.accept <- acceptedStream{stream: st, request: append([]byte(nil), request...)}:
+	default:
+		s.remove(id)
+		s.reset(id, "too many streams waiting to be accepted")
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// sessions returns the client and server sessions of a pipe
+func sessions(t *testing.T) (*Session, *Session) {
+	c, s := net.Pipe()
+	client, server := Client(c), Server(s, 0)
+	t.Cleanup(func() {
+		client.closeWithError(ErrSessionClosed)
+		server.closeWithError(ErrSessionClosed)
+	})
+	return client, server
+}
+
+// openStream opens a stream of client and accepts it on server
+func openStream(t *testing.T, client, server *Session) (*Stream, *Stream) {
+	cs, err := client.Open([]byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, request, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(request) != "request" {
+		t.Fatalf("expected the request of the stream, got %q", request)
+	}
+	return cs, ss
+}
+
+func TestWindow(t *testing.T) {
+	client, server := sessions(t)
+	cs, ss := openStream(t, client, server)
+	other, otherServer := openStream(t, client, server)
+
+	// The server does not read, so the client sends a window and waits for the rest
+	data := bytes.Repeat([]byte("x"), DefaultWindow+1000)
+	cs.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := cs.Write(data)
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != DefaultWindow {
+		t.Fatalf("expected %d bytes written before the deadline, got %d: %v", DefaultWindow, n, err)
+	}
+
+	// A stream with an exhausted window does not hold back the other streams of the session
+	go other.Write([]byte("other"))
+	buf := make([]byte, 5)
+	otherServer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(otherServer, buf); err != nil || string(buf) != "other" {
+		t.Fatalf("expected the other stream to carry data, got %q: %v", buf, err)
+	}
+
+	// Reading extends the window, and the rest of the data goes through
+	cs.SetWriteDeadline(time.Time{})
+	written := make(chan error, 1)
+	go func() {
+		_, err := cs.Write(data[n:])
+		if err == nil {
+			err = cs.CloseWrite()
+		}
+		written <- err
+	}()
+	ss.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, err := io.ReadAll(ss)
+	if err != nil || !bytes.Equal(received, data) {
+		t.Fatalf("expected %d bytes, got %d: %v", len(data), len(received), err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	// The window given back covers every byte read, beyond the bytes sent
+	for i := 0; ; i++ {
+		cs.mutex.Lock()
+		window := cs.sendWindow
+		cs.mutex.Unlock()
+		ss.mutex.Lock()
+		unacked := ss.unacked
+		ss.mutex.Unlock()
+		if window+unacked == DefaultWindow {
+			break
+		}
+		// The last Window frame may still be on its way
+		if i == 100 {
+			t.Fatalf("expected the window and the unacknowledged bytes to add up to %d, got %d and %d", DefaultWindow, window, unacked)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeRawFrame writes a frame on conn, bypassing the flow control of a session
+func writeRawFrame(conn net.Conn, t byte, id uint32, payload []byte) error {
+	frame := make([]byte, headerSize, headerSize+len(payload))
+	frame[0] = t
+	binary.BigEndian.PutUint32(frame[1:5], id)
+	binary.BigEndian.PutUint32(frame[5:headerSize], uint32(len(payload)))
+	_, err := conn.Write(append(frame, payload...))
+	return err
+}
+
+// readRawFrame reads a frame from conn
+func readRawFrame(conn net.Conn) (byte, uint32, []byte, error) {
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[5:headerSize]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return 0, 0, nil, err
+	}
+	return header[0], binary.BigEndian.Uint32(header[1:5]), payload, nil
+}
+
+func TestWindowExceeded(t *testing.T) {
+	c, raw := net.Pipe()
+	client := Client(c)
+	defer client.closeWithError(ErrSessionClosed)
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+
+	opened := make(chan *Stream, 1)
+	go func() {
+		cs, err := client.Open(nil)
+		if err != nil {
+			t.Error(err)
+		}
+		opened <- cs
+	}()
+	if ft, id, _, err := readRawFrame(raw); err != nil || ft != frameOpen || id != 1 {
+		t.Fatalf("expected the open frame of stream 1, got %d of %d: %v", ft, id, err)
+	}
+	cs := <-opened
+
+	// The other side sends a byte more than the window, without the client reading
+	chunk := make([]byte, maxDataFrame)
+	for sent := 0; sent < DefaultWindow; sent += len(chunk) {
+		if err := writeRawFrame(raw, frameData, 1, chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeRawFrame(raw, frameData, 1, []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	ft, id, reason, err := readRawFrame(raw)
+	if err != nil || ft != frameReset || id != 1 || string(reason) != errWindowExceeded.Error() {
+		t.Fatalf("expected the stream to be reset, got frame %d of %d %q: %v", ft, id, reason, err)
+	}
+
+	// The data within the window is read before the error
+	cs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, err := io.ReadAll(cs)
+	if !errors.Is(err, errWindowExceeded) || len(received) != DefaultWindow {
+		t.Fatalf("expected %d bytes then the window error, got %d: %v", DefaultWindow, len(received), err)
+	}
+	if client.Err() != nil {
+		t.Fatalf("a stream exceeding its window must not close the session: %v", client.Err())
+	}
+}
+
+func TestReset(t *testing.T) {
+	client, server := sessions(t)
+	cs, ss := openStream(t, client, server)
+
+	go ss.Write([]byte("unread"))
+	cs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(cs, buf); err != nil {
+		t.Fatal(err)
+	}
+	// Closing a stream with data left unread resets it
+	cs.Close()
+	ss.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var reset *ResetError
+	if _, err := ss.Read(buf); !errors.As(err, &reset) {
+		t.Fatalf("expected the stream to be reset, got %v", err)
+	}
+}
+
+func TestStrayFrames(t *testing.T) {
+	s, raw := net.Pipe()
+	server := Server(s, 0)
+	defer server.closeWithError(ErrSessionClosed)
+	defer raw.Close()
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// The frames of a stream waiting for its reset are not answered again, even while the other side does not read
+	for i := 0; i < 2*resetBacklog; i++ {
+		if err := writeRawFrame(raw, frameData, 3, []byte("x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ft, id, _, err := readRawFrame(raw); err != nil || ft != frameReset || id != 3 {
+		t.Fatalf("expected the stray stream to be reset, got frame %d of %d: %v", ft, id, err)
+	}
+	if server.Err() != nil {
+		t.Fatalf("the frames of a single stray stream must not close the session: %v", server.Err())
+	}
+
+	// A side flooding unknown streams without reading their resets has its session closed
+	for id := uint32(5); server.Err() == nil; id += 2 {
+		if err := writeRawFrame(raw, frameData, id, []byte("x")); err != nil {
+			break
+		}
+		if id > 4*resetBacklog {
+			t.Fatal("expected the session to be closed once its resets pile up")
+		}
+	}
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the session to be closed")
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mux
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// errWriteClosed is returned by the writes that follow CloseWrite
+var errWriteClosed = errors.New("write on a stream closed for writing")
+
+// Stream is a logical connection of a session. It implements net.Conn, and CloseWrite like a TCP connection.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mutex sync.Mutex
+	// notify is closed and replaced whenever the state of the stream changes, to wake up its waiting calls
+	notify   chan struct{}
+	controls [][]byte
+	recv     bytes.Buffer
+	// unacked counts the bytes read from recv that were not yet returned to the sender with a Window frame
+	unacked    int
+	sendWindow int
+	// recvClosed and sendClosed are set once the respective side ended its data with Close
+	recvClosed bool
+	sendClosed bool
+	closed     bool
+	// err is set when the stream was reset or its session failed
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{id: id, session: s, notify: make(chan struct{}), sendWindow: DefaultWindow}
+}
+
+// ID returns the identifier of the stream in its session
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// signal wakes up the calls waiting for the stream, under its mutex
+func (st *Stream) signal() {
+	close(st.notify)
+	st.notify = make(chan struct{})
+}
+
+// wait releases the mutex of the stream until its state changes or deadline passes
+func (st *Stream) wait(deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	notify := st.notify
+	st.mutex.Unlock()
+	defer st.mutex.Lock()
+	select {
+	case <-notify:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+// ReadControl returns the next Control frame of the stream, the replies of the server side to its request
+func (st *Stream) ReadControl() ([]byte, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for {
+		switch {
+		case len(st.controls) > 0:
+			payload := st.controls[0]
+			st.controls = st.controls[1:]
+			return payload, nil
+		case st.closed:
+			return nil, net.ErrClosed
+		case st.err != nil:
+			return nil, st.err
+		case st.recvClosed:
+			return nil, io.EOF
+		}
+		if err := st.wait(st.readDeadline); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// SendControl sends a Control frame to the side that opened the stream
+func (st *Stream) SendControl(payload []byte) error {
+	st.mutex.Lock()
+	err := st.err
+	if st.closed {
+		err = net.ErrClosed
+	}
+	st.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return st.session.writeFrame(frameControl, st.id, payload)
+}
+
+// Read reads the data of the stream, the data received before a reset is read before its error
+func (st *Stream) Read(p []byte) (int, error) {
+	st.mutex.Lock()
+	for {
+		switch {
+		case st.closed:
+			st.mutex.Unlock()
+			return 0, net.ErrClosed
+		case st.recv.Len() > 0:
+			n, _ := st.recv.Read(p)
+			st.unacked += n
+			increment := 0
+			if st.unacked >= DefaultWindow/4 && st.err == nil && !st.recvClosed {
+				increment = st.unacked
+				st.unacked = 0
+			}
+			st.mutex.Unlock()
+			if increment > 0 {
+				st.session.writeWindow(st.id, increment)
+			}
+			return n, nil
+		case st.recvClosed:
+			st.mutex.Unlock()
+			return 0, io.EOF
+		case st.err != nil:
+			st.mutex.Unlock()
+			return 0, st.err
+		}
+		if err := st.wait(st.readDeadline); err != nil {
+			st.mutex.Unlock()
+			return 0, err
+		}
+	}
+}
+
+// Write writes p to the stream, waiting for the other side to extend the window when it is exhausted
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	st.mutex.Lock()
+	for written < len(p) {
+		var err error
+		switch {
+		case st.closed:
+			err = net.ErrClosed
+		case st.err != nil:
+			err = st.err
+		case st.sendClosed:
+			err = errWriteClosed
+		case !st.writeDeadline.IsZero() && !time.Now().Before(st.writeDeadline):
+			err = os.ErrDeadlineExceeded
+		case st.sendWindow == 0:
+			err = st.wait(st.writeDeadline)
+			if err == nil {
+				continue
+			}
+		}
+		if err != nil {
+			st.mutex.Unlock()
+			return written, err
+		}
+		n := len(p) - written
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		if n > maxDataFrame {
+			n = maxDataFrame
+		}
+		st.sendWindow -= n
+		st.mutex.Unlock()
+		if err := st.session.writeFrame(frameData, st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+		st.mutex.Lock()
+	}
+	st.mutex.Unlock()
+	return written, nil
+}
+
+// CloseWrite ends the data sent on the stream, the other side reads EOF once it read the data sent before
+func (st *Stream) CloseWrite() error {
+	st.mutex.Lock()
+	err := st.err
+	if st.closed {
+		err = net.ErrClosed
+	}
+	done := st.sendClosed
+	st.sendClosed = true
+	st.signal()
+	st.mutex.Unlock()
+	if err != nil || done {
+		return err
+	}
+	return st.session.writeFrame(frameClose, st.id, nil)
+}
+
+// Close closes the stream. The data sent so far is delivered and ends with Close, unless data received on
+// the stream was left unread, which resets it.
+func (st *Stream) Close() error {
+	st.mutex.Lock()
+	if st.closed {
+		st.mutex.Unlock()
+		return nil
+	}
+	st.closed = true
+	var t byte
+	switch {
+	case st.err != nil:
+	case st.recv.Len() > 0:
+		t = frameReset
+	case !st.sendClosed:
+		t = frameClose
+	}
+	st.recv.Reset()
+	st.signal()
+	st.mutex.Unlock()
+	st.session.remove(st.id)
+	if t == 0 {
+		return nil
+	}
+	if err := st.session.writeFrame(t, st.id, nil); err != nil && !errors.Is(err, ErrSessionClosed) {
+		return err
+	}
+	return nil
+}
+
+// pushControl queues a Control frame for ReadControl
+func (st *Stream) pushControl(payload []byte) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.controls = append(st.controls, payload)
+	st.signal()
+}
+
+// pushData buffers the data of a Data frame, it reports false when the data exceeds the window of the stream
+func (st *Stream) pushData(data []byte) bool {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.recvClosed || st.err != nil {
+		return true
+	}
+	if st.recv.Len()+st.unacked+len(data) > DefaultWindow {
+		return false
+	}
+	st.recv.Write(data)
+	st.signal()
+	return true
+}
+
+// addWindow extends the bytes the stream may send
+func (st *Stream) addWindow(increment int) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.sendWindow += increment
+	st.signal()
+}
+
+// pushClose records that the other side ended its data
+func (st *Stream) pushClose() {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.recvClosed = true
+	st.signal()
+}
+
+// fail records the error that ends the stream, a reset or the failure of its session
+func (st *Stream) fail(err error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.signal()
+}
+
+// LocalAddr returns the local address of the connection of the session
+func (st *Stream) LocalAddr() net.Addr {
+	return st.session.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the connection of the session
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.session.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the stream
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.readDeadline, st.writeDeadline = t, t
+	st.signal()
+	return nil
+}
+
+// SetReadDeadline sets the deadline of the reads of the stream
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.readDeadline = t
+	st.signal()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of the writes of the stream, which wait for its window
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.writeDeadline = t
+	st.signal()
+	return nil
+}
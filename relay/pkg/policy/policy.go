@@ -0,0 +1,271 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+)
+
+// Engine holds the access-control policy of every user and decides whether two parties may be paired.
+// Users without a policy may pair any of their parties, unless the policy denies them by default.
+type Engine struct {
+	mutex sync.RWMutex
+	path  string
+	// optional treats a missing policy file as an empty policy, the file is created by the first change
+	optional    bool
+	modTime     time.Time
+	defaultDeny bool
+	users       map[string][]api.UserSpec
+	quota       api.Quota
+	quotas      map[string]api.Quota
+	webhooks    map[string]api.Webhook
+	logger      *logrus.Entry
+}
+
+// Authorize checks that srcParty may be paired with dstParty of user on tag, and returns the denial otherwise
+func (e *Engine) Authorize(user, srcParty, dstParty, tag string) *api.Error {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	specs, ok := e.users[user]
+	if !ok {
+		if !e.defaultDeny {
+			return nil
+		}
+		return &api.Error{Code: api.ErrAccessDenied, Message: fmt.Sprintf("no policy for user %s", user)}
+	}
+	for _, spec := range specs {
+		if contains(spec.Party, srcParty) && contains(spec.Party, dstParty) {
+			if allowsTag(spec.TagPrefixes, tag) {
+				return nil
+			}
+		}
+	}
+	return &api.Error{
+		Code:    api.ErrAccessDenied,
+		Message: fmt.Sprintf("parties %s and %s of user %s may not be paired on tag %q", srcParty, dstParty, user, tag),
+	}
+}
+
+// User returns the access groups of user, and whether the user has a policy
+func (e *Engine) User(user string) ([]api.UserSpec, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	specs, ok := e.users[user]
+	return specs, ok
+}
+
+// Quota returns the quota of user, the default quota if the user has none of its own
+func (e *Engine) Quota(user string) api.Quota {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	if quota, ok := e.quotas[user]; ok {
+		return quota
+	}
+	return e.quota
+}
+
+// Webhook returns the webhook of user, and whether the user registered one
+func (e *Engine) Webhook(user string) (api.Webhook, bool) {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	hook, ok := e.webhooks[user]
+	return hook, ok
+}
+
+// SetUser replaces the access groups of user, persisting the policy to the policy file if there is one
+func (e *Engine) SetUser(user string, specs []api.UserSpec) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	users := make(map[string][]api.UserSpec, len(e.users)+1)
+	for u, s := range e.users {
+		users[u] = s
+	}
+	users[user] = specs
+	if err := e.persist(users, e.webhooks); err != nil {
+		return err
+	}
+	e.users = users
+	return nil
+}
+
+// SetWebhook registers the webhook of user, a nil hook removes it. The policy file is updated if there is one.
+func (e *Engine) SetWebhook(user string, hook *api.Webhook) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	webhooks := make(map[string]api.Webhook, len(e.webhooks)+1)
+	for u, h := range e.webhooks {
+		webhooks[u] = h
+	}
+	if hook != nil {
+		webhooks[user] = *hook
+	} else {
+		delete(webhooks, user)
+	}
+	if err := e.persist(e.users, webhooks); err != nil {
+		return err
+	}
+	e.webhooks = webhooks
+	return nil
+}
+
+// persist writes the policy with users and webhooks to the policy file if there is one, the mutex must be held
+func (e *Engine) persist(users map[string][]api.UserSpec, webhooks map[string]api.Webhook) error {
+	if e.path == "" {
+		return nil
+	}
+	p := &api.Policy{DefaultDeny: e.defaultDeny, Users: users, DefaultQuota: e.quota, Quotas: e.quotas, Webhooks: webhooks}
+	if err := writePolicy(e.path, p); err != nil {
+		return err
+	}
+	if info, err := os.Stat(e.path); err == nil {
+		e.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Load (re)loads the policy file if it changed since it was last loaded
+func (e *Engine) Load() error {
+	if e.path == "" {
+		return nil
+	}
+	info, err := os.Stat(e.path)
+	if err != nil && e.optional && os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to stat policy file: %v", err)
+	}
+	e.mutex.RLock()
+	unchanged := info.ModTime().Equal(e.modTime)
+	e.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := os.ReadFile(e.path)
+	if err != nil {
+		return fmt.Errorf("unable to read policy file: %v", err)
+	}
+	var p api.Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("unable to parse policy file: %v", err)
+	}
+
+	e.mutex.Lock()
+	if p.Users == nil {
+		p.Users = make(map[string][]api.UserSpec)
+	}
+	e.users = p.Users
+	e.defaultDeny = p.DefaultDeny
+	e.quota = p.DefaultQuota
+	e.quotas = p.Quotas
+	e.webhooks = p.Webhooks
+	e.modTime = info.ModTime()
+	e.mutex.Unlock()
+	e.logger.Infof("Loaded access-control policy for %d users from %s", len(p.Users), e.path)
+	return nil
+}
+
+// Watch reloads the policy file whenever it changes, keeping the last good policy on errors
+func (e *Engine) Watch(interval time.Duration) {
+	if e.path == "" {
+		return
+	}
+	for {
+		time.Sleep(interval)
+		if err := e.Load(); err != nil {
+			e.logger.Errorf("Failed to reload policy: %v", err)
+		}
+	}
+}
+
+func writePolicy(path string, p *api.Policy) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".policy-*")
+	if err != nil {
+		return fmt.Errorf("unable to write policy file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write policy file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write policy file: %v", err)
+	}
+	// Rename is atomic, so the watcher never reads a partially written policy
+	return os.Rename(tmp.Name(), path)
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s || e == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func allowsTag(prefixes []string, tag string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(tag, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewEngine returns a policy engine loading the policy from path, an empty path starts without a policy
+func NewEngine(path string) (*Engine, error) {
+	e := &Engine{
+		path:   path,
+		users:  make(map[string][]api.UserSpec),
+		logger: logrus.WithField("component", "policy"),
+	}
+	if err := e.Load(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// OpenEngine returns a policy engine loading the policy from path like NewEngine, which starts without a policy
+// while the file does not exist and creates it when a policy or webhook is set
+func OpenEngine(path string) (*Engine, error) {
+	e := &Engine{
+		path:     path,
+		optional: true,
+		users:    make(map[string][]api.UserSpec),
+		logger:   logrus.WithField("component", "policy"),
+	}
+	if err := e.Load(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package revocation
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var rlog = logrus.WithField("component", "revocation")
+
+// reloadInterval is how often a List backed by a file checks whether the file changed
+const reloadInterval = 5 * time.Second
+
+// List holds the serial numbers revoked by a CA, read from a PEM encoded CRL signed by that CA.
+// A List backed by a file reloads the CRL at most every reloadInterval when the file changes, keeping
+// the last good CRL when the new one is invalid, expired or the file disappears. Until a CRL was
+// published the file is missing and nothing is revoked. Once the CRL in use expires every certificate is rejected.
+type List struct {
+	mutex      sync.RWMutex
+	path       string
+	modTime    time.Time
+	checked    time.Time // when the file was last checked for changes
+	loaded     bool
+	issuers    []*x509.Certificate
+	revoked    map[string]struct{}
+	nextUpdate time.Time
+}
+
+// parseCRL returns the revoked serial numbers of a PEM encoded CRL signed by one of issuers, and when it expires
+func parseCRL(data []byte, issuers []*x509.Certificate) (map[string]struct{}, time.Time, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "X509 CRL" {
+		return nil, time.Time{}, fmt.Errorf("CRL is not in PEM format")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("unable to parse CRL: %v", err)
+	}
+	signed := false
+	for _, issuer := range issuers {
+		if crl.CheckSignatureFrom(issuer) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return nil, time.Time{}, fmt.Errorf("CRL is not signed by the CA")
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		return nil, time.Time{}, fmt.Errorf("CRL expired on %s", crl.NextUpdate.Format(time.RFC3339))
+	}
+	revoked := make(map[string]struct{}, len(crl.RevokedCertificates))
+	for _, entry := range crl.RevokedCertificates {
+		revoked[entry.SerialNumber.String()] = struct{}{}
+	}
+	return revoked, crl.NextUpdate, nil
+}
+
+// parseIssuers returns the CA certificates of a PEM bundle
+func parseIssuers(caPEM []byte) ([]*x509.Certificate, error) {
+	var issuers []*x509.Certificate
+	for block, rest := pem.Decode(caPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse CA: %v", err)
+		}
+		issuers = append(issuers, cert)
+	}
+	if len(issuers) == 0 {
+		return nil, fmt.Errorf("unable to parse CA")
+	}
+	return issuers, nil
+}
+
+// load (re)reads the CRL file if it changed since it was last read
+func (l *List) load() error {
+	info, err := os.Stat(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		l.mutex.RLock()
+		loaded := l.loaded
+		l.mutex.RUnlock()
+		if loaded {
+			return fmt.Errorf("CRL %s is missing", l.path)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to stat CRL: %v", err)
+	}
+	l.mutex.RLock()
+	unchanged := info.ModTime().Equal(l.modTime)
+	l.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+	data, err := os.ReadFile(l.path)
+	if err == nil {
+		var revoked map[string]struct{}
+		var nextUpdate time.Time
+		revoked, nextUpdate, err = parseCRL(data, l.issuers)
+		if err == nil {
+			l.mutex.Lock()
+			l.revoked, l.nextUpdate, l.modTime, l.loaded = revoked, nextUpdate, info.ModTime(), true
+			l.mutex.Unlock()
+			rlog.Infof("Loaded %d revoked certificates from %s", len(revoked), l.path)
+			return nil
+		}
+	}
+	// Do not retry the same file on every check
+	l.mutex.Lock()
+	l.modTime = info.ModTime()
+	l.mutex.Unlock()
+	return fmt.Errorf("unable to load CRL %s: %v", l.path, err)
+}
+
+// reloadDue reports whether the CRL file should be checked for changes, at most once per reloadInterval
+func (l *List) reloadDue() bool {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Sub(l.checked) < reloadInterval {
+		return false
+	}
+	l.checked = now
+	return true
+}
+
+// Check returns an error if cert is revoked, or if the CRL in use expired
+func (l *List) Check(cert *x509.Certificate) error {
+	if l == nil {
+		return nil
+	}
+	if l.path != "" && l.reloadDue() {
+		if err := l.load(); err != nil {
+			rlog.Errorf("%v, keeping the previous CRL", err)
+		}
+	}
+	l.mutex.RLock()
+	_, revoked := l.revoked[cert.SerialNumber.String()]
+	nextUpdate := l.nextUpdate
+	l.mutex.RUnlock()
+	if !nextUpdate.IsZero() && time.Now().After(nextUpdate) {
+		return fmt.Errorf("the CRL expired on %s, publish a new one with fr-adm publish crl", nextUpdate.Format(time.RFC3339))
+	}
+	if revoked {
+		return fmt.Errorf("certificate %s (serial %s) is revoked", cert.Subject.CommonName, cert.SerialNumber)
+	}
+	return nil
+}
+
+// VerifyConnection rejects TLS peers presenting a revoked certificate, it is meant for tls.Config.VerifyConnection
+func (l *List) VerifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	return l.Check(cs.PeerCertificates[0])
+}
+
+// NewList returns the revocation list kept in the CRL file at path, signed by a CA of the caPEM bundle
+func NewList(path string, caPEM []byte) (*List, error) {
+	issuers, err := parseIssuers(caPEM)
+	if err != nil {
+		return nil, err
+	}
+	l := &List{path: path, issuers: issuers, checked: time.Now()}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// ParseList returns the revocation list of a PEM encoded CRL signed by a CA of the caPEM bundle
+func ParseList(crlPEM, caPEM []byte) (*List, error) {
+	issuers, err := parseIssuers(caPEM)
+	if err != nil {
+		return nil, err
+	}
+	revoked, nextUpdate, err := parseCRL(crlPEM, issuers)
+	if err != nil {
+		return nil, err
+	}
+	return &List{issuers: issuers, revoked: revoked, nextUpdate: nextUpdate, loaded: true}, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/clusterlink-net/clusterlink/pkg/utils/netutils"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/store"
+)
+
+// StartAdminServer serves the session admin API over HTTPS on address, host:port.
+// Only clients presenting the relay certificate are allowed.
+func (s *Server) StartAdminServer(address string) error {
+	s.logger.Infof("Relay admin server starting at %s.", address)
+	s.router.Use(adminOnly)
+	s.router.Get("/sessions", s.listSessions)
+	s.router.Delete("/sessions", s.terminateSessions)
+	s.router.Post("/reload", s.reloadCredentials)
+	if s.opts.Credentials == nil {
+		return fmt.Errorf("the admin server requires the relay credentials")
+	}
+	server := netutils.CreateResilientHTTPServer(address, s.router, s.opts.Credentials.ServerConfig(), nil, nil, nil)
+
+	return server.ListenAndServeTLS("", "")
+}
+
+// adminOnly rejects the clients that did not authenticate with the relay certificate
+func adminOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 || !isRelayCertificate(r.TLS.PeerCertificates[0]) {
+			http.Error(w, "the admin API requires the relay certificate", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sessionFilters returns the user, src, dst and tag query parameters of a session request
+func sessionFilters(r *http.Request) (string, string, string, string) {
+	q := r.URL.Query()
+	return q.Get("user"), q.Get("src"), q.Get("dst"), q.Get("tag")
+}
+
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	user, src, dst, tag := sessionFilters(r)
+	now := time.Now()
+	sessions := []api.Session{}
+	for _, ep := range s.states.ParkedEndpoints(user, src, dst, tag) {
+		sessions = append(sessions, api.Session{
+			User:     ep.User,
+			SrcParty: ep.SrcParty,
+			DstParty: ep.DstParty,
+			Tag:      ep.Tag,
+			State:    "parked",
+			SrcAddr:  endpointAddr(ep),
+			Since:    ep.Since,
+			Age:      now.Sub(ep.Since).Round(time.Second).String(),
+		})
+	}
+	for _, p := range s.states.PairedEndpoints(user, src, dst, tag) {
+		ep, peer := p[0], p[1]
+		sessions = append(sessions, api.Session{
+			User:     ep.User,
+			SrcParty: ep.SrcParty,
+			DstParty: ep.DstParty,
+			Tag:      ep.Tag,
+			State:    "paired",
+			SrcAddr:  endpointAddr(ep),
+			DstAddr:  endpointAddr(peer),
+			Since:    ep.PairedAt,
+			Age:      now.Sub(ep.PairedAt).Round(time.Second).String(),
+			SrcBytes: ep.Forwarded.Load(),
+			DstBytes: peer.Forwarded.Load(),
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		a, b := sessions[i], sessions[j]
+		if a.User != b.User {
+			return a.User < b.User
+		}
+		if a.SrcParty != b.SrcParty {
+			return a.SrcParty < b.SrcParty
+		}
+		if a.DstParty != b.DstParty {
+			return a.DstParty < b.DstParty
+		}
+		return a.Tag < b.Tag
+	})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sessions); err != nil {
+		s.logger.Errorf("Failed to encode sessions: %v", err)
+	}
+}
+
+// endpointAddr returns the address of a party, or of the peer relay it is connected to
+func endpointAddr(ep *store.Endpoint) string {
+	if ep.Relay != "" {
+		return ep.Relay + " (peer relay)"
+	}
+	return ep.Conn.RemoteAddr().String()
+}
+
+// terminateSessions ends the sessions of a user, narrowed down by the src, dst and tag filters.
+// Parked parties are told their session was terminated, paired parties are disconnected.
+func (s *Server) terminateSessions(w http.ResponseWriter, r *http.Request) {
+	user, src, dst, tag := sessionFilters(r)
+	if user == "" {
+		http.Error(w, "user is required", http.StatusBadRequest)
+		return
+	}
+	terminated := 0
+	for _, ep := range s.states.Unpark(user, src, dst, tag) {
+		s.logger.Infof("Terminating parked session %s/%s:%s(%s)", ep.User, ep.SrcParty, ep.DstParty, ep.Tag)
+		s.closeParked(ep, &api.Error{Code: api.ErrTerminated, Message: "session terminated by the relay operator"})
+		terminated++
+	}
+	for _, p := range s.states.PairedEndpoints(user, src, dst, tag) {
+		ep, peer := p[0], p[1]
+		s.logger.Infof("Terminating paired session %s/%s:%s(%s)", ep.User, ep.SrcParty, ep.DstParty, ep.Tag)
+		terminate(ep, peer)
+		terminated++
+	}
+	if terminated == 0 {
+		http.Error(w, "no matching session", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(api.TerminateResp{Terminated: terminated}); err != nil {
+		s.logger.Errorf("Failed to encode terminate response: %v", err)
+	}
+}
+
+// terminate disconnects a paired session, which ends its forwarding
+func terminate(ep, peer *store.Endpoint) {
+	ep.Terminated.Store(true)
+	ep.Conn.Close()
+	peer.Conn.Close()
+}
+
+// reloadCredentials reloads the relay certificate and trusted CAs, used by the next handshakes
+func (s *Server) reloadCredentials(w http.ResponseWriter, r *http.Request) {
+	if err := s.opts.Credentials.Reload(); err != nil {
+		s.logger.Errorf("Failed to reload credentials: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
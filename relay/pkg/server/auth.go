@@ -14,104 +14,276 @@
 package server
 
 import (
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"net"
-
-	"github.com/praveingk/openssl"
+	"time"
 
 	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/store"
 )
 
-func (s *Server) authorize(srcParty string, tcpConn net.Conn, tlsConn *openssl.Conn) error {
-	authReq := api.AuthReq{}
-	buf := make([]byte, 512)
+// serveParty serves the auth request of a party outside of the handshake workers, since parking, pairing and
+// the handover wait on the party and its peer
+func (s *Server) serveParty(user, srcParty string, authReq *api.AuthReq, tcpConn net.Conn, tlsConn *tls.Conn) {
+	if err := s.authorize(user, srcParty, authReq, tcpConn, tlsConn); err != nil {
+		s.metrics.authFailures.Inc()
+		s.logger.Errorf("Failed to authorize %s; %v", srcParty, err)
+		tlsConn.Close()
+	}
+}
 
-	n, err := tlsConn.Read(buf)
-	if err != nil {
-		s.logger.Errorf("Failed to read auth request: %s", err)
-		return err
+func (s *Server) authorize(user, srcParty string, authReq *api.AuthReq, tcpConn net.Conn, tlsConn *tls.Conn) error {
+	if authReq.Group != nil {
+		// The policy applies to each pair of the group once its members are known
+		now := time.Now()
+		ep := &store.Endpoint{Conn: tcpConn, TLSConn: tlsConn, Since: now, Deadline: now.Add(s.opts.RendezvousTimeout)}
+		return s.joinGroup(user, srcParty, authReq.Group, ep)
 	}
-	err = json.Unmarshal(buf[:n], &authReq)
-	if err != nil {
-		s.logger.Errorf("Failed to unmarshal auth request: %s", err)
-		return err
+	if authReq.Mux {
+		// The policy applies to each stream of the session
+		return s.serveMux(user, srcParty, tlsConn)
+	}
+	if s.opts.Policy != nil {
+		if denial := s.opts.Policy.Authorize(user, srcParty, authReq.DestParty, authReq.Tag); denial != nil {
+			s.replyError(tlsConn, denial)
+			return denial
+		}
 	}
 
-	dstConn, err := s.states.GetConnection(authReq.DestParty, srcParty, authReq.Tag)
+	if authReq.Mailbox {
+		return s.serveMailbox(user, srcParty, authReq, tlsConn)
+	}
+
+	now := time.Now()
+	ep := &store.Endpoint{Conn: tcpConn, TLSConn: tlsConn, Since: now, Deadline: now.Add(s.opts.RendezvousTimeout)}
+	return s.rendezvous(user, srcParty, authReq, ep)
+}
+
+// rendezvous parks a party until its peer arrives, or pairs it with its parked peer
+func (s *Server) rendezvous(user, srcParty string, authReq *api.AuthReq, ep *store.Endpoint) error {
+	peer, err := s.states.Rendezvous(user, srcParty, authReq.DestParty, authReq.Tag, ep, s.quota(user))
 	if err != nil {
+		relayErr := s.rendezvousError(err)
+		s.closeParked(ep, relayErr)
+		return relayErr
+	}
+	if peer == nil {
 		//s.logger.Infof("Destination party doesnt have an active connection, Waiting")
-		//s.logger.Infof("Storing the tcp connection for %s:%s (%s) comms", srcParty, authReq.DestParty, authReq.Tag)
-		s.states.StoreTLSConnection(srcParty, authReq.DestParty, authReq.Tag, tlsConn)
-		err = s.states.StoreConnection(srcParty, authReq.DestParty, authReq.Tag, tcpConn)
+		ep.CtrlMutex.Lock()
+		if !ep.Paired {
+			err = s.sendControl(ep, api.MsgWaiting, api.Waiting{Deadline: ep.Deadline})
+		}
+		ep.CtrlMutex.Unlock()
 		if err != nil {
-			return err
+			s.logger.Debugf("Failed to send waiting to %s/%s: %v", user, srcParty, err)
+		}
+		if s.federation != nil {
+			s.parked(ep)
 		}
-		// go func() {
-		// 	connKey := connection{party1: srcParty, party2: authReq.DestParty, tag: authReq.Tag}
-		// 	s.timelineMutex.Lock()
-		// 	s.relayTimeline[connKey] = &timeline{party1Incoming: incomingConn[tcpConn.RemoteAddr().String()],
-		// 		party1Handshake: partyHandshake, party1Auth: time.Now()}
-		// 	s.timelineMutex.Unlock()
-		// }()
+		s.invokePeer(ep)
 		return nil
 	}
-	//party2Auth := time.Now()
+	return s.pair(ep, peer)
+}
 
-	destTLSConn, err := s.states.GetTLSConnection(authReq.DestParty, srcParty, authReq.Tag)
-	if err != nil {
-		return err
+// rendezvousError returns the error sent to a party that could not be parked or paired
+func (s *Server) rendezvousError(err error) *api.Error {
+	relayErr := &api.Error{Code: api.ErrAlreadyWaiting, Message: err.Error()}
+	if errors.Is(err, store.ErrGroupMismatch) {
+		relayErr.Code = api.ErrBadRequest
+	}
+	var quotaErr *store.QuotaError
+	if errors.As(err, &quotaErr) {
+		relayErr.Code = api.ErrQuotaExceeded
+		s.metrics.quotaRejections.WithLabelValues(quotaErr.Limit).Inc()
+	}
+	if errors.Is(err, store.ErrClosed) {
+		relayErr.Code = api.ErrShuttingDown
 	}
+	return relayErr
+}
 
+// pair hands a party and the parked peer it was paired with over to their E2E session, and starts forwarding between them
+func (s *Server) pair(ep, peer *store.Endpoint) error {
 	//s.logger.Infof("Ending the TLS Connections(%s, %s, %s) and start TCP forwarding", authReq.DestParty, srcParty, authReq.Tag)
-	err = s.sendReady(tlsConn, api.Ready{Mode: api.TLSModeServer})
-	if err != nil {
-		tlsConn.Close()
-		destTLSConn.Close()
-		s.states.RemoveConnection(srcParty, authReq.DestParty, authReq.Tag)
-		s.states.RemoveConnection(authReq.DestParty, srcParty, authReq.Tag)
-		s.states.RemoveTLSConnection(srcParty, authReq.DestParty, authReq.Tag)
-		s.states.RemoveTLSConnection(authReq.DestParty, srcParty, authReq.Tag)
+	if err := s.handover(ep, api.Ready{Mode: api.TLSModeServer}); err != nil {
+		// Only the arriving party failed, its parked peer keeps waiting until its own deadline
+		s.states.Release(ep.User, ep.SrcParty, ep.DstParty, ep.Tag)
+		s.repark(peer)
 		return err
 	}
 	// To synchronize the TLS connections, we wait for the ACK and proceed to next server
-	err = s.sendReady(destTLSConn, api.Ready{Mode: api.TLSModeClient})
+	if err := s.handoverParked(peer, api.Ready{Mode: api.TLSModeClient}); err != nil {
+		closeEndpoint(peer)
+		s.states.Release(ep.User, ep.SrcParty, ep.DstParty, ep.Tag)
+		return err
+	}
+	s.metrics.timeToPair.Observe(ep.PairedAt.Sub(peer.Since).Seconds())
+	go s.startForwarding(ep, peer)
+	return nil
+}
+
+// handoverParked sends the TLS role to a party that was parked, after the Waiting message it may be sent concurrently
+func (s *Server) handoverParked(ep *store.Endpoint, ready api.Ready) error {
+	ep.CtrlMutex.Lock()
+	defer ep.CtrlMutex.Unlock()
+	ep.Paired = true
+	return s.handover(ep, ready)
+}
+
+// handover sends the TLS role to a paired party. The connection of the party is handed over to the E2E session,
+// while the stream of a multiplexed connection carries it right after Ready.
+func (s *Server) handover(ep *store.Endpoint, ready api.Ready) error {
+	if ep.Stream != nil {
+		return s.sendControl(ep, api.MsgReady, ready)
+	}
+	return s.sendReady(ep.TLSConn, ready)
+}
+
+// repark parks again a party whose claim on a peer relay or whose peer failed, or pairs it with its peer if it
+// arrived meanwhile. The party keeps the deadline it was first parked with.
+func (s *Server) repark(ep *store.Endpoint) {
+	peer, err := s.states.Rendezvous(ep.User, ep.SrcParty, ep.DstParty, ep.Tag, ep, s.quota(ep.User))
 	if err != nil {
-		tlsConn.Close()
-		destTLSConn.Close()
-		s.states.RemoveConnection(srcParty, authReq.DestParty, authReq.Tag)
-		s.states.RemoveConnection(authReq.DestParty, srcParty, authReq.Tag)
-		s.states.RemoveTLSConnection(srcParty, authReq.DestParty, authReq.Tag)
-		s.states.RemoveTLSConnection(authReq.DestParty, srcParty, authReq.Tag)
+		s.closeParked(ep, s.rendezvousError(err))
+		return
+	}
+	if peer == nil {
+		if s.federation != nil {
+			s.federation.publish(api.Parked{Rendezvous: []api.Rendezvous{endpointRendezvous(ep)}})
+		}
+		return
+	}
+	// The party was told it is waiting, so it is handed over like a parked party
+	err = s.handoverParked(ep, api.Ready{Mode: api.TLSModeServer})
+	if err == nil {
+		err = s.handoverParked(peer, api.Ready{Mode: api.TLSModeClient})
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to pair %s/%s:%s(%s): %v", ep.User, ep.SrcParty, ep.DstParty, ep.Tag, err)
+		closeEndpoint(ep)
+		closeEndpoint(peer)
+		s.states.Release(ep.User, ep.SrcParty, ep.DstParty, ep.Tag)
+		return
+	}
+	s.metrics.timeToPair.Observe(ep.PairedAt.Sub(peer.Since).Seconds())
+	go s.startForwarding(ep, peer)
+}
+
+// readAuthRequest reads the Hello and AuthReq control messages of a party.
+// Parties speaking another protocol version, including the unframed legacy protocol, are told so.
+func (s *Server) readAuthRequest(tlsConn *tls.Conn) (*api.AuthReq, error) {
+	hello := api.Hello{}
+	err := api.ReadMessageOf(tlsConn, api.MsgHello, &hello)
+	if err == nil {
+		authReq := &api.AuthReq{}
+		err = api.ReadMessageOf(tlsConn, api.MsgAuthReq, authReq)
+		if err == nil {
+			return authReq, nil
+		}
+	}
+
+	var relayErr *api.Error
+	switch {
+	case errors.Is(err, api.ErrLegacyMessage):
+		s.replyLegacyError(tlsConn, &api.Error{
+			Code:    api.ErrUnsupportedVersion,
+			Message: fmt.Sprintf("unframed control messages are no longer supported, upgrade the client to protocol version %d", api.ProtocolVersion),
+		})
+	case errors.As(err, &relayErr):
+		s.replyError(tlsConn, relayErr)
+	}
+	return nil, err
+}
+
+// sendMessage writes a control message, bounding the write in case the party is gone
+func (s *Server) sendMessage(conn *tls.Conn, t api.MessageType, msg interface{}) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(replyTimeout)); err != nil {
+		return err
+	}
+	if err := api.WriteMessage(conn, t, msg); err != nil {
 		return err
 	}
-	go s.startForwarding(srcParty, tcpConn, tlsConn, authReq.DestParty, dstConn, destTLSConn, authReq.Tag)
-	// go func() {
-	// 	connKey := connection{party1: authReq.DestParty, party2: srcParty, tag: authReq.Tag}
-	// 	s.timelineMutex.Lock()
-	// 	s.relayTimeline[connKey].SetupConn = time.Now()
-	// 	s.relayTimeline[connKey].party2Auth = party2Auth
-	// 	s.relayTimeline[connKey].party2Incoming = incomingConn[tcpConn.RemoteAddr().String()]
-	// 	s.relayTimeline[connKey].party2Handshake = partyHandshake
-	// 	s.timelineMutex.Unlock()
-	// }()
+	return conn.SetWriteDeadline(time.Time{})
+}
 
-	return nil
+// sendControl writes a control message to a party, on the relay TLS session of its connection or on its stream
+func (s *Server) sendControl(ep *store.Endpoint, t api.MessageType, msg interface{}) error {
+	if ep.Stream == nil {
+		return s.sendMessage(ep.TLSConn, t, msg)
+	}
+	var buf bytes.Buffer
+	if err := api.WriteMessage(&buf, t, msg); err != nil {
+		return err
+	}
+	return ep.Stream.SendControl(buf.Bytes())
 }
 
-func (s *Server) sendReady(conn *openssl.Conn, ready api.Ready) error {
-	buf := make([]byte, 512)
+// replyError sends an Error control message to a party, which ends its control session
+func (s *Server) replyError(conn *tls.Conn, relayErr *api.Error) {
+	if err := s.sendMessage(conn, api.MsgError, relayErr); err != nil {
+		s.logger.Debugf("Failed to send error to %s: %v", conn.RemoteAddr().String(), err)
+	}
+}
 
-	readyData, err := json.Marshal(ready)
+// replyLegacyError sends an error in the unframed JSON Ready reply understood by legacy clients
+func (s *Server) replyLegacyError(conn *tls.Conn, relayErr *api.Error) {
+	data, err := json.Marshal(api.Ready{Error: relayErr})
+	if err == nil {
+		err = conn.SetWriteDeadline(time.Now().Add(replyTimeout))
+	}
+	if err == nil {
+		_, err = conn.Write(data)
+	}
 	if err != nil {
-		s.logger.Errorf("Failed to marshal ready response: %v.", err)
+		s.logger.Debugf("Failed to send error to %s: %v", conn.RemoteAddr().String(), err)
+	}
+}
+
+// sendReady sends the TLS role to a paired party and hands its connection over to the E2E session.
+// After the Handover message the relay sends close_notify and waits for the party to acknowledge it
+// with its own, ending the TLS session in both directions while leaving the TCP connection open,
+// so that the next bytes on the connection belong to the E2E session.
+func (s *Server) sendReady(conn *tls.Conn, ready api.Ready) error {
+	err := s.sendMessage(conn, api.MsgReady, ready)
+	if err == nil {
+		err = s.sendMessage(conn, api.MsgHandover, api.Handover{})
+	}
+	if err == nil {
+		err = conn.CloseWrite()
+	}
+	if err == nil {
+		err = awaitCloseNotify(conn)
+	}
+	if err == nil {
+		// CloseWrite leaves an expired write deadline on the TCP connection
+		err = conn.SetDeadline(time.Time{})
 	}
-	_, err = conn.Write(readyData)
 	if err != nil {
 		s.logger.Errorf("Failed to write send ready: %s", err)
 		return err
 	}
-	conn.CloseSSL()
-	_, err = conn.Read(buf)
 	//s.logger.Infof("Ready and closed SSL")
 	return nil
 }
+
+// awaitCloseNotify reads the close_notify of a party that was handed over, record by record so
+// that E2E bytes the party sends right after it stay on the TCP connection
+func awaitCloseNotify(conn *tls.Conn) error {
+	if hc, ok := conn.NetConn().(*handoverConn); ok {
+		hc.exact.Store(true)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(replyTimeout)); err != nil {
+		return err
+	}
+	buf := make([]byte, 1)
+	if _, err := conn.Read(buf); err != io.EOF {
+		return fmt.Errorf("expected the party to end the TLS session after handover, got: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/mux"
+	"github.com/flock-org/flock/relay/pkg/store"
+)
+
+// streamEndpoint returns an endpoint of the relay side of a stream of session
+func streamEndpoint(t *testing.T, client, server *mux.Session) *store.Endpoint {
+	if _, err := client.Open(nil); err != nil {
+		t.Fatal(err)
+	}
+	stream, _, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	return &store.Endpoint{Conn: stream, Stream: stream, Since: now, Deadline: now.Add(time.Minute)}
+}
+
+// TestFailedHandoverReparksPeer pairs a party whose handover fails, and expects its parked peer to wait on
+func TestFailedHandoverReparksPeer(t *testing.T) {
+	c, r := net.Pipe()
+	client, server := mux.Client(c), mux.Server(r, 0)
+	defer client.Close()
+	defer server.Close()
+	s := NewRelay(nil, Options{})
+
+	peer := streamEndpoint(t, client, server)
+	deadline := peer.Deadline
+	if err := s.rendezvous("user1", "0", &api.AuthReq{DestParty: "1", Tag: "tag"}, peer); err != nil {
+		t.Fatal(err)
+	}
+	ep := streamEndpoint(t, client, server)
+	// The stream of the arriving party is gone before it is handed over
+	ep.Stream.Close()
+	if err := s.rendezvous("user1", "1", &api.AuthReq{DestParty: "0", Tag: "tag"}, ep); err == nil {
+		t.Fatal("expected the handover of the closed stream to fail")
+	}
+
+	parked := s.states.ParkedEndpoints("user1", "0", "1", "tag")
+	if len(parked) != 1 || parked[0] != peer || !parked[0].Deadline.Equal(deadline) {
+		t.Fatalf("expected the peer to be parked again with its deadline, got %v", parked)
+	}
+	if s.states.Paired() != 0 {
+		t.Fatalf("expected the failed pair to be released, got %d pairs", s.states.Paired())
+	}
+}
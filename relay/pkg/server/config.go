@@ -13,7 +13,91 @@
 
 package server
 
+import (
+	"net"
+	"time"
+
+	"github.com/flock-org/flock/relay/pkg/policy"
+	"github.com/flock-org/flock/relay/pkg/webhook"
+)
+
 const (
 	apiPort       = 8000
 	dataplanePort = 9000
+
+	// DefaultRendezvousTimeout is how long a party waits for its peer by default
+	DefaultRendezvousTimeout = 60 * time.Second
+	// DefaultHandshakeTimeout bounds the relay TLS handshake and auth request of a party
+	DefaultHandshakeTimeout = 10 * time.Second
+	// DefaultHandshakeWorkers is the number of handshakes run concurrently
+	DefaultHandshakeWorkers = 64
+	// DefaultMaxPendingHandshakes is the number of accepted connections queued for a handshake worker
+	DefaultMaxPendingHandshakes = 1024
+	// DefaultIdleTimeout is how long a forwarded session may carry no data before it is closed
+	DefaultIdleTimeout = 5 * time.Minute
+	// DefaultDrainTimeout is how long the forwarded sessions may run once the relay is shutting down
+	DefaultDrainTimeout = 60 * time.Second
+	// DefaultMailboxSize is the number of bytes a mailbox holds by default
+	DefaultMailboxSize = 1 << 20
+	// DefaultMailboxTTL is how long a mailbox message is kept by default
+	DefaultMailboxTTL = 10 * time.Minute
+	// DefaultMailboxUserSize and DefaultMailboxPartySize are the bytes buffered by default in all the mailboxes of a user and of a party
+	DefaultMailboxUserSize  = 16 << 20
+	DefaultMailboxPartySize = 4 << 20
+	// DefaultMaxUserMailboxes and DefaultMaxPartyMailboxes are the mailboxes holding messages of a user and of a party by default
+	DefaultMaxUserMailboxes  = 1024
+	DefaultMaxPartyMailboxes = 256
+	// drainPollInterval is how often the remaining sessions are counted while draining
+	drainPollInterval = 100 * time.Millisecond
+	// replyTimeout bounds the write of a control message to a party that may already be gone
+	replyTimeout = 5 * time.Second
+	// minReapInterval bounds how often the rendezvous reaper scans the store
+	minReapInterval = time.Second
+	// peerSyncInterval is how often a relay sends the snapshot of its parked rendezvous to its peer relays
+	peerSyncInterval = time.Second
+	// peerRetryInterval is how long a relay waits before reconnecting to an unreachable peer relay
+	peerRetryInterval = 2 * time.Second
+	// peerDialTimeout bounds the connection to a peer relay
+	peerDialTimeout = 5 * time.Second
 )
+
+// Options contains the tunables of the relay dataplane server
+type Options struct {
+	// RendezvousTimeout is how long a parked party waits for its peer before it is evicted
+	RendezvousTimeout time.Duration
+	// HandshakeTimeout bounds the relay TLS handshake and the read of the auth request
+	HandshakeTimeout time.Duration
+	// HandshakeWorkers is the number of handshakes run concurrently
+	HandshakeWorkers int
+	// MaxPendingHandshakes caps the accepted connections waiting for a handshake worker, beyond which they are rejected
+	MaxPendingHandshakes int
+	// IdleTimeout closes a forwarded session that carried no data in either direction for this long, zero disables it
+	IdleTimeout time.Duration
+	// MaxSessionLifetime closes a forwarded session this long after it started, zero disables it
+	MaxSessionLifetime time.Duration
+	// DrainTimeout is how long the forwarded sessions may finish on shutdown before they are closed
+	DrainTimeout time.Duration
+	// Credentials are the relay certificate and trusted CAs, reloaded when they change; nil loads them once from the certs directory
+	Credentials *Credentials
+	// Policy decides which parties may be paired, nil allows every pairing
+	Policy *policy.Engine
+	// MailboxSize is the number of bytes of messages each mailbox holds, zero disables the mailbox
+	MailboxSize int
+	// MailboxTTL is how long a mailbox message is kept for the peer to attach
+	MailboxTTL time.Duration
+	// MailboxUserSize and MailboxPartySize bound the bytes buffered in all the mailboxes of a user and of a
+	// sending party, zero is unlimited
+	MailboxUserSize  int
+	MailboxPartySize int
+	// MaxUserMailboxes and MaxPartyMailboxes bound the mailboxes holding messages of a user and of a sending
+	// party, zero is unlimited
+	MaxUserMailboxes  int
+	MaxPartyMailboxes int
+	// Webhooks delivers the invocations of the parties a parked party waits for to the webhooks of the policy,
+	// nil uses the default retries and reaches public addresses and WebhookNetworks only
+	Webhooks *webhook.Notifier
+	// WebhookNetworks are the networks webhooks may target besides public addresses, e.g. an internal function platform
+	WebhookNetworks []*net.IPNet
+	// Peers are the addresses of the peer relays, host:port or unix:<path>, whose parties may be paired with the parties of this relay
+	Peers []string
+}
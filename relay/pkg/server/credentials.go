@@ -0,0 +1,188 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/flock-org/flock/relay/config"
+	"github.com/flock-org/flock/relay/pkg/revocation"
+)
+
+// Credentials holds the relay certificate and key, and the CA bundles trusted for client certificates together
+// with the CRL of the relay CA. They are reloaded when their files change, so new handshakes use the rotated
+// files while the established sessions keep running.
+type Credentials struct {
+	mutex    sync.Mutex
+	certFile string
+	keyFile  string
+	caFiles  []string
+	modTimes map[string]time.Time
+	config   atomic.Pointer[tls.Config]
+	// clientConfig authenticates the relay to its peer relays
+	clientConfig atomic.Pointer[tls.Config]
+	logger       *logrus.Entry
+}
+
+// NewCredentials loads the relay certificate and key and trusts the relay CA bundle, which may hold several CAs,
+// and the CA bundles of trustedCAs, e.g. the old and new relay CAs while rotating the relay CA.
+func NewCredentials(trustedCAs []string) (*Credentials, error) {
+	c := &Credentials{
+		certFile: filepath.Join(config.FlockrelayCADirectory(), config.CertificateFileName),
+		keyFile:  filepath.Join(config.FlockrelayCADirectory(), config.PrivateKeyFileName),
+		caFiles:  append([]string{config.FrCAFile()}, trustedCAs...),
+		logger:   logrus.WithField("component", "server.credentials"),
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the certificate, key and CA bundles again, keeping the current ones if the files are invalid
+func (c *Credentials) Reload() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	modTimes := c.stat()
+	tlsConfig, clientConfig, err := c.load()
+	// A broken file is reported once, not on every check until it is fixed
+	c.modTimes = modTimes
+	if err != nil {
+		return err
+	}
+	c.config.Store(tlsConfig)
+	c.clientConfig.Store(clientConfig)
+	c.logger.Infof("Loaded relay certificate %s trusting %d CA bundles", c.certFile, len(c.caFiles))
+	return nil
+}
+
+// reloadIfChanged reloads the credentials if any of their files changed since they were last read
+func (c *Credentials) reloadIfChanged() error {
+	c.mutex.Lock()
+	modTimes := c.stat()
+	changed := len(modTimes) != len(c.modTimes)
+	for path, modTime := range modTimes {
+		if !modTime.Equal(c.modTimes[path]) {
+			changed = true
+		}
+	}
+	c.mutex.Unlock()
+	if !changed {
+		return nil
+	}
+	return c.Reload()
+}
+
+// stat returns the modification time of the credential files that exist
+func (c *Credentials) stat() map[string]time.Time {
+	modTimes := make(map[string]time.Time)
+	for _, path := range append([]string{c.certFile, c.keyFile}, c.caFiles...) {
+		if info, err := os.Stat(path); err == nil {
+			modTimes[path] = info.ModTime()
+		}
+	}
+	return modTimes
+}
+
+// load builds the server and client TLS configurations of the credential files. The server requires clients
+// to present a certificate signed by a trusted CA and not revoked by the relay CA, and the client expects
+// the same of peer relays.
+func (c *Credentials) load() (*tls.Config, *tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load relay certificate: %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	var bundle []byte
+	for _, path := range c.caFiles {
+		caData, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to read CA bundle: %v", err)
+		}
+		if !clientCAs.AppendCertsFromPEM(caData) {
+			return nil, nil, fmt.Errorf("unable to parse CA bundle %s", path)
+		}
+		bundle = append(append(bundle, caData...), '\n')
+	}
+	// The CRL may be signed by any trusted CA, e.g. by the new relay CA during a rotation
+	crl, err := revocation.NewList(config.FrCRLFile(), bundle)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load relay CRL: %v", err)
+	}
+	return &tls.Config{
+		Certificates:     []tls.Certificate{cert},
+		ClientCAs:        clientCAs,
+		ClientAuth:       tls.RequireAndVerifyClientCert,
+		MinVersion:       tls.VersionTLS12,
+		VerifyConnection: crl.VerifyConnection,
+	}, &tls.Config{
+		Certificates:     []tls.Certificate{cert},
+		RootCAs:          clientCAs,
+		ServerName:       config.FlockrelayServerName,
+		MinVersion:       tls.VersionTLS12,
+		VerifyConnection: crl.VerifyConnection,
+	}, nil
+}
+
+// ServerConfig returns a TLS configuration whose handshakes use the latest credentials
+func (c *Credentials) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return c.config.Load(), nil
+		},
+	}
+}
+
+// WebConfig returns the TLS configuration of a wss:// listener. It serves the latest relay certificate
+// without asking for a client certificate, the parties authenticate in the relay TLS session inside the WebSocket.
+func (c *Credentials) WebConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &c.config.Load().Certificates[0], nil
+		},
+	}
+}
+
+// ClientConfig returns the TLS configuration authenticating the relay to a peer relay with the latest credentials
+func (c *Credentials) ClientConfig() *tls.Config {
+	return c.clientConfig.Load()
+}
+
+// Watch reloads the credentials whenever their files change, until ctx is done
+func (c *Credentials) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.reloadIfChanged(); err != nil {
+				c.logger.Errorf("Failed to reload credentials, keeping the previous ones: %v", err)
+			}
+		}
+	}
+}
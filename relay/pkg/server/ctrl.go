@@ -14,12 +14,28 @@
 package server
 
 import (
+	"crypto/rand"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
 
+	"github.com/go-chi/chi"
+
+	"github.com/flock-org/flock/relay/config"
 	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/webhook"
 )
 
+// maxPartiesPerUser bounds the parties minted by a single user request
+const maxPartiesPerUser = 64
+
+// validName matches user and party names that are safe to use as a certificate directory
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
 // APIs for management
 func (s *APIServer) addUser(w http.ResponseWriter, r *http.Request) {
 	var userReq api.UserReq
@@ -29,6 +45,239 @@ func (s *APIServer) addUser(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	s.logger.Infof("Got a user requests")
-	w.WriteHeader(http.StatusOK)
+	if !validName.MatchString(userReq.UserName) || userReq.UserName == config.FlockrelayServerName {
+		http.Error(w, fmt.Sprintf("invalid user name %q", userReq.UserName), http.StatusBadRequest)
+		return
+	}
+	parties, err := strconv.Atoi(userReq.Parties)
+	if err != nil || parties < 1 || parties > maxPartiesPerUser {
+		http.Error(w, fmt.Sprintf("parties must be a number between 1 and %d", maxPartiesPerUser), http.StatusBadRequest)
+		return
+	}
+	s.logger.Infof("Got a user request for %s with %d parties", userReq.UserName, parties)
+
+	// Certificates are created on disk, so provisioning requests are serialized
+	s.provisionMutex.Lock()
+	defer s.provisionMutex.Unlock()
+	if _, err := os.Stat(config.UserDirectory(userReq.UserName)); err == nil {
+		http.Error(w, fmt.Sprintf("user %s already exists", userReq.UserName), http.StatusConflict)
+		return
+	}
+	if err := api.CreateUser(userReq.UserName, false); err != nil {
+		s.logger.Errorf("Failed to create user %s: %v", userReq.UserName, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	userResp := api.UserResp{RelayTarget: s.relayTarget}
+	for i := 0; i < parties; i++ {
+		partyID, err := createPendingParty(userReq.UserName)
+		if err != nil {
+			s.logger.Errorf("Failed to create a party for user %s: %v", userReq.UserName, err)
+			// The user is removed as a whole, so that the request can be retried
+			if err := os.RemoveAll(config.UserDirectory(userReq.UserName)); err != nil {
+				s.logger.Errorf("Failed to remove user %s: %v", userReq.UserName, err)
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		userResp.PartyInfos = append(userResp.PartyInfos, api.PartyInfo{
+			PartyID:   partyID,
+			BundleURL: fmt.Sprintf("/user/%s/party/%s", userReq.UserName, partyID),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(userResp); err != nil {
+		s.logger.Errorf("Failed to send user response: %v", err)
+	}
+}
+
+// createPendingParty creates a party of user named by a random id, whose bundle is marked on disk to be fetched
+func createPendingParty(user string) (string, error) {
+	partyID, err := newPartyID()
+	if err != nil {
+		return "", err
+	}
+	if err := api.CreateParty(partyID, user, false); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(config.PartyPendingBundleFile(user, partyID), nil, 0600); err != nil {
+		return "", fmt.Errorf("unable to mark the bundle of party %s: %v", partyID, err)
+	}
+	return partyID, nil
+}
+
+// getPartyBundle returns the certificates and keys of a party provisioned by addUser. Each bundle is handed
+// out once, the parties created by fr-adm or already fetched are not served. The bundles left to fetch are
+// marked next to the party certificates, so they survive restarts.
+func (s *APIServer) getPartyBundle(w http.ResponseWriter, r *http.Request) {
+	user := chi.URLParam(r, "user")
+	party := chi.URLParam(r, "party")
+	if !validName.MatchString(user) || !validName.MatchString(party) {
+		http.Error(w, "invalid user or party", http.StatusBadRequest)
+		return
+	}
+	// Removing the marker hands the bundle to a single request
+	if err := os.Remove(config.PartyPendingBundleFile(user, party)); err != nil {
+		http.Error(w, fmt.Sprintf("no bundle to fetch for party %s of user %s", party, user), http.StatusNotFound)
+		return
+	}
+	bundle, err := api.ReadPartyBundle(party, user)
+	if err != nil {
+		s.logger.Errorf("Failed to read bundle of party %s of user %s: %v", party, user, err)
+		http.Error(w, fmt.Sprintf("party %s of user %s not found", party, user), http.StatusNotFound)
+		return
+	}
+	s.logger.Infof("Handed out the bundle of party %s of user %s", party, user)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(bundle); err != nil {
+		s.logger.Errorf("Failed to send party bundle: %v", err)
+	}
+}
+
+// getRelayCRL publishes the revocation list of the relay CA
+func (s *APIServer) getRelayCRL(w http.ResponseWriter, r *http.Request) {
+	s.sendCRL(w, config.FrCRLFile())
+}
+
+// getUserCRL publishes the revocation list of the CA of a user
+func (s *APIServer) getUserCRL(w http.ResponseWriter, r *http.Request) {
+	user, ok := userParam(w, r)
+	if !ok {
+		return
+	}
+	s.sendCRL(w, filepath.Join(config.UserDirectory(user), config.UserCRLFile))
+}
+
+func (s *APIServer) sendCRL(w http.ResponseWriter, crlPath string) {
+	data, err := os.ReadFile(crlPath)
+	if err != nil {
+		http.Error(w, "CRL not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	if _, err := w.Write(data); err != nil {
+		s.logger.Errorf("Failed to send CRL: %v", err)
+	}
+}
+
+// userParam returns the user of the request path, replying with an error when it is not a valid name
+func userParam(w http.ResponseWriter, r *http.Request) (string, bool) {
+	user := chi.URLParam(r, "user")
+	if !validName.MatchString(user) {
+		http.Error(w, fmt.Sprintf("invalid user name %q", user), http.StatusBadRequest)
+		return "", false
+	}
+	return user, true
+}
+
+// getPolicy returns the access groups of a user
+func (s *APIServer) getPolicy(w http.ResponseWriter, r *http.Request) {
+	user, ok := userParam(w, r)
+	if !ok {
+		return
+	}
+	specs, ok := s.policy.User(user)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no policy for user %s", user), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(specs); err != nil {
+		s.logger.Errorf("Failed to send policy: %v", err)
+	}
+}
+
+// setPolicy replaces the access groups of a user, taking effect for the next pairing requests
+func (s *APIServer) setPolicy(w http.ResponseWriter, r *http.Request) {
+	user, ok := userParam(w, r)
+	if !ok {
+		return
+	}
+	var specs []api.UserSpec
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&specs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.policy.SetUser(user, specs); err != nil {
+		s.logger.Errorf("Failed to set policy of user %s: %v", user, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Infof("Updated policy of user %s with %d access groups", user, len(specs))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getWebhook returns the webhook of a user, without its secret
+func (s *APIServer) getWebhook(w http.ResponseWriter, r *http.Request) {
+	user, ok := userParam(w, r)
+	if !ok {
+		return
+	}
+	hook, ok := s.policy.Webhook(user)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no webhook for user %s", user), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(api.Webhook{URL: hook.URL}); err != nil {
+		s.logger.Errorf("Failed to send webhook: %v", err)
+	}
+}
+
+// setWebhook registers the webhook invoking the parties of a user that their peers wait for
+func (s *APIServer) setWebhook(w http.ResponseWriter, r *http.Request) {
+	user, ok := userParam(w, r)
+	if !ok {
+		return
+	}
+	var hook api.Webhook
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := webhook.Validate(hook, s.webhookNetworks); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.policy.SetWebhook(user, &hook); err != nil {
+		s.logger.Errorf("Failed to set webhook of user %s: %v", user, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Infof("Registered webhook %s for user %s", hook.URL, user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteWebhook removes the webhook of a user
+func (s *APIServer) deleteWebhook(w http.ResponseWriter, r *http.Request) {
+	user, ok := userParam(w, r)
+	if !ok {
+		return
+	}
+	if _, ok := s.policy.Webhook(user); !ok {
+		http.Error(w, fmt.Sprintf("no webhook for user %s", user), http.StatusNotFound)
+		return
+	}
+	if err := s.policy.SetWebhook(user, nil); err != nil {
+		s.logger.Errorf("Failed to remove webhook of user %s: %v", user, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger.Infof("Removed webhook of user %s", user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// newPartyID returns a random UUID (version 4) used to name a party
+func newPartyID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("unable to generate party id: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
 }
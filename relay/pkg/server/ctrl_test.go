@@ -0,0 +1,92 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi"
+
+	"github.com/flock-org/flock/relay/config"
+	"github.com/flock-org/flock/relay/pkg/api"
+)
+
+// getBundle requests the bundle of a party from s
+func getBundle(s *APIServer, user, party string) int {
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("user", user)
+	rctx.URLParams.Add("party", party)
+	r := httptest.NewRequest(http.MethodGet, "/user/"+user+"/party/"+party, nil)
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	w := httptest.NewRecorder()
+	s.getPartyBundle(w, r)
+	return w.Code
+}
+
+// TestPendingBundleSurvivesRestart fetches a bundle from a new API server, as after a restart, and only once
+func TestPendingBundleSurvivesRestart(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates certificates")
+	}
+	defer config.SetCertsDirectory(config.BaseDirectory())
+	config.SetCertsDirectory(filepath.Join(t.TempDir(), "certs"))
+	if err := api.CreateRelay(false); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	NewAPIServer(nil, "relay:9000", nil, nil, nil).addUser(w,
+		httptest.NewRequest(http.MethodPost, "/user", strings.NewReader(`{"UserName": "user1", "Parties": "1"}`)))
+	var resp api.UserResp
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || len(resp.PartyInfos) != 1 {
+		t.Fatalf("expected a party to be provisioned, got %d %q: %v", w.Code, w.Body.String(), err)
+	}
+	party := resp.PartyInfos[0].PartyID
+
+	restarted := NewAPIServer(nil, "relay:9000", nil, nil, nil)
+	if code := getBundle(restarted, "user1", party); code != http.StatusOK {
+		t.Fatalf("expected the bundle to be fetched after a restart, got %d", code)
+	}
+	if code := getBundle(restarted, "user1", party); code != http.StatusNotFound {
+		t.Fatalf("expected the bundle to be fetched once, got %d", code)
+	}
+}
+
+func TestUserHandlersRejectInvalidNames(t *testing.T) {
+	s := NewAPIServer(nil, "relay:9000", nil, nil, nil)
+	for name, handler := range map[string]http.HandlerFunc{
+		"getUserCRL":    s.getUserCRL,
+		"getPolicy":     s.getPolicy,
+		"setPolicy":     s.setPolicy,
+		"getWebhook":    s.getWebhook,
+		"setWebhook":    s.setWebhook,
+		"deleteWebhook": s.deleteWebhook,
+	} {
+		rctx := chi.NewRouteContext()
+		rctx.URLParams.Add("user", "../flockrelay")
+		r := httptest.NewRequest(http.MethodGet, "/user/x", strings.NewReader("{}"))
+		r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected an invalid user name to be rejected, got %d", name, w.Code)
+		}
+	}
+}
@@ -14,23 +14,24 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
-	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi"
-	"github.com/praveingk/openssl"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 
 	cutil "github.com/clusterlink-net/clusterlink/pkg/util"
-	"github.com/flock-org/flock/relay/config"
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/mailbox"
 	"github.com/flock-org/flock/relay/pkg/store"
-)
-
-var (
-	maxDataBufferSize = 64 * 1024
+	"github.com/flock-org/flock/relay/pkg/webhook"
 )
 
 // Server contains the declaration of the relay server
@@ -38,6 +39,13 @@ type Server struct {
 	router         *chi.Mux
 	parsedCertData *cutil.ParsedCertData
 	states         *store.State
+	opts           Options
+	hsStats        handshakeStats
+	limiters       *bandwidthLimiters
+	metrics        *metrics
+	federation     *federation // set when the relay has peer relays
+	mailboxes      *mailbox.Store
+	muxes          muxSessions
 	logger         *logrus.Entry
 	f1             *os.File
 	f2             *os.File
@@ -49,88 +57,231 @@ type connection struct {
 	tag    string
 }
 
-func (s *Server) startForwarding(srcParty string, conn1 net.Conn, sslConn1 *openssl.Conn, dstParty string, conn2 net.Conn, sslConn2 *openssl.Conn, tag string) {
-	forwarder := newForwarder(conn1, conn2)
-	b1, b2 := forwarder.run()
-	s.logger.Infof("Forwarding finished for %s:%s(%s), bytes transferred(%d, %d)", srcParty, dstParty, tag, b1, b2)
-	sslConn1.Close()
-	sslConn2.Close()
-	s.states.RemoveConnection(srcParty, dstParty, tag)
-	s.states.RemoveConnection(dstParty, srcParty, tag)
-	s.states.RemoveTLSConnection(srcParty, dstParty, tag)
-	s.states.RemoveTLSConnection(dstParty, srcParty, tag)
+func (s *Server) startForwarding(ep, peer *store.Endpoint) {
+	start := time.Now()
+	forwarder := newForwarder(ep.Conn, peer.Conn, &ep.Forwarded, &peer.Forwarded, s.opts.IdleTimeout, s.opts.MaxSessionLifetime)
+	quota := s.quota(ep.User)
+	forwarder.l1 = s.limiters.get(ep.User, ep.SrcParty, quota)
+	forwarder.l2 = s.limiters.get(peer.User, peer.SrcParty, quota)
+	userBytes := s.metrics.userBytesForwarded.WithLabelValues(ep.User)
+	forwarder.m1 = []prometheus.Counter{s.metrics.bytesForwarded.WithLabelValues("src_to_dst"), userBytes}
+	forwarder.m2 = []prometheus.Counter{s.metrics.bytesForwarded.WithLabelValues("dst_to_src"), userBytes}
+	b1, b2, reason := forwarder.run()
+	s.limiters.put(ep.User, ep.SrcParty, forwarder.l1)
+	s.limiters.put(peer.User, peer.SrcParty, forwarder.l2)
+	if ep.Terminated.Load() {
+		reason = EndTerminated
+	}
+	s.logger.Infof("Forwarding finished for %s/%s:%s(%s), bytes transferred(%d, %d), reason: %s", ep.User, ep.SrcParty, ep.DstParty, ep.Tag, b1, b2, reason)
+	s.metrics.sessionDuration.Observe(time.Since(start).Seconds())
+	s.metrics.sessionsFinished.WithLabelValues(string(reason)).Inc()
+	closeEndpoint(ep)
+	closeEndpoint(peer)
+	s.states.Release(ep.User, ep.SrcParty, ep.DstParty, ep.Tag)
+}
+
+// closeEndpoint closes the connection of a party, or its stream of a multiplexed connection
+func closeEndpoint(ep *store.Endpoint) {
+	if ep.TLSConn != nil {
+		ep.TLSConn.Close()
+	}
+	if ep.Conn != nil {
+		ep.Conn.Close()
+	}
 }
 
-func (s *Server) receiveWaitAndForward(address string, ctx *openssl.Ctx) error {
-	acceptor, err := net.Listen("tcp", address)
-	if err != nil {
-		s.logger.Errorln("Error:", err)
-		return err
+// unixPrefix marks the listen addresses that are the path of a Unix domain socket
+const unixPrefix = "unix:"
+
+// listen opens a TCP listener on a host:port address, or a Unix domain socket listener on unix:<path>
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, unixPrefix)
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil && errors.Is(err, syscall.EADDRINUSE) {
+		// Replace the socket left behind by a relay that did not exit cleanly, unless a relay still serves it
+		if conn, dialErr := net.Dial("unix", path); dialErr == nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+		l, err = net.Listen("unix", path)
 	}
+	return l, err
+}
 
+// acceptConnections queues the connections accepted by a listener for the handshake workers until the listener is closed
+func (s *Server) acceptConnections(l net.Listener, pending chan<- net.Conn) error {
 	for {
-		tcpConn, err := acceptor.Accept()
+		tcpConn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
 		if err != nil {
 			s.logger.Errorln("Accept error:", err)
 			continue
 		}
-		tlsConn, err := openssl.Server(tcpConn, ctx)
-		err = tlsConn.Handshake()
+		s.metrics.acceptedConns.Inc()
+		s.admit(pending, tcpConn)
+	}
+}
+
+// StartRelaySSLServer starts the Flock relay dataplane server which listens to connections from the user's parties (or functions)
+// on every address, host:port, unix:<path> or a ws:// or wss:// URL. Parties connected to different listeners share the rendezvous and may be paired.
+// The listeners are closed once ctx is done, after which the relay should be drained.
+func (s *Server) StartRelaySSLServer(ctx context.Context, addresses []string) error {
+	defer s.f1.Close()
+	defer s.f2.Close()
+	if s.opts.Credentials == nil {
+		creds, err := NewCredentials(nil)
 		if err != nil {
-			s.logger.Errorf("Handshake failed: %v.", err)
-			tlsConn.Close()
-			continue
+			s.logger.Fatal(err)
 		}
-		s.logger.Info("Accept incoming connection from ", tlsConn.RemoteAddr().String())
-		reqParty, err := getPartyName(tlsConn)
+		s.opts.Credentials = creds
+	}
+	tlsConfig := s.opts.Credentials.ServerConfig()
+
+	listeners := make([]net.Listener, 0, len(addresses))
+	for _, address := range addresses {
+		l, err := s.listenAddress(address)
 		if err != nil {
-			s.logger.Errorf("Failed to get party name: %v.", err)
-			tlsConn.Close()
-			continue
+			for _, l := range listeners {
+				l.Close()
+			}
+			s.logger.Errorln("Error:", err)
+			return fmt.Errorf("unable to listen on %s: %v", address, err)
 		}
-		s.logger.Infof("Got connection from %s requesting access to %s", reqParty, tlsConn.GetServername())
+		s.logger.Info("Starting relay... Listening to ", address, " for connections")
+		listeners = append(listeners, l)
+	}
 
-		err = s.authorize(reqParty, tcpConn, tlsConn)
-		if err != nil {
-			s.logger.Errorf("Failed to authorize %s; %v", reqParty, err)
-			tlsConn.Close()
-			continue
+	pending := s.startHandshakeWorkers(tlsConfig)
+	if s.federation != nil {
+		go s.startFederation(ctx)
+	}
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			errs <- s.acceptConnections(l, pending)
+		}(l)
+	}
+	go func() {
+		<-ctx.Done()
+		s.logger.Info("Shutting down, no longer accepting connections")
+		for _, l := range listeners {
+			l.Close()
 		}
+	}()
+	err := <-errs
+	if ctx.Err() != nil {
+		return nil
 	}
+	return err
 }
 
-// StartRelaySSLServer starts the Flock relay dataplane server which listens to connections from the user's parties (or functions)
-func (s *Server) StartRelaySSLServer(port string) error {
-	defer s.f1.Close()
-	defer s.f2.Close()
-	address := fmt.Sprintf(":%s", port)
-	s.logger.Info("Starting relay... Listening to ", address, " for connections")
-	ctx, err := openssl.NewCtxFromFiles(filepath.Join(config.FlockrelayCADirectory(), config.CertificateFileName),
-		filepath.Join(config.FlockrelayCADirectory(), config.PrivateKeyFileName))
-	if err != nil {
-		s.logger.Fatal(err)
+// Drain shuts the relay down once it stopped accepting connections. Parked parties are told the relay is
+// shutting down, and the forwarded sessions may finish for up to the drain timeout before they are closed,
+// followed by the multiplexed sessions that carried them.
+func (s *Server) Drain() {
+	defer s.closeMuxSessions()
+	for _, ep := range s.states.Close() {
+		s.logger.Infof("Closing parked session %s/%s:%s(%s) on shutdown", ep.User, ep.SrcParty, ep.DstParty, ep.Tag)
+		s.closeParked(ep, &api.Error{Code: api.ErrShuttingDown, Message: "the relay is shutting down"})
+	}
+	if s.mailboxes != nil {
+		// Mailbox sessions end and their buffered messages are lost
+		s.mailboxes.Close()
+	}
+	s.logger.Infof("Draining %d forwarded sessions for up to %v", s.states.Paired(), s.opts.DrainTimeout)
+	if s.waitForSessions(s.opts.DrainTimeout) {
+		s.logger.Info("All sessions finished")
+		return
 	}
-	ctx.LoadVerifyLocations(config.FrCAFileRoot, "")
-	ctx.SetVerifyMode(openssl.VerifyPeer)
+	for _, p := range s.states.PairedEndpoints("", "", "", "") {
+		ep, peer := p[0], p[1]
+		s.logger.Infof("Terminating session %s/%s:%s(%s) on shutdown", ep.User, ep.SrcParty, ep.DstParty, ep.Tag)
+		terminate(ep, peer)
+	}
+	// The forwarders end as soon as their connections are closed
+	if !s.waitForSessions(replyTimeout) {
+		s.logger.Warnf("%d sessions still forwarding after the drain timeout", s.states.Paired())
+	}
+}
 
-	return s.receiveWaitAndForward(address, ctx)
+// waitForSessions waits for up to timeout for the forwarded sessions to finish, reporting whether they did
+func (s *Server) waitForSessions(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for s.states.Paired() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(drainPollInterval)
+	}
+	return true
 }
 
-// MonitorConnections prints the active connection periodically
-func (s *Server) MonitorConnections() {
+// MonitorConnections prints the active connection periodically until ctx is done
+func (s *Server) MonitorConnections(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
 	for {
-		s.logger.Infof("Active Connections : %d", s.states.Conns())
-		time.Sleep(5 * time.Second)
+		s.logger.Infof("Active Connections : %d, Handshakes rejected : %d, timed out : %d, failed : %d", s.states.Conns(),
+			s.hsStats.rejected.Load(), s.hsStats.timedOut.Load(), s.hsStats.failed.Load())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 	}
 }
 
 // NewRelay returns a new dataplane HTTP server.
-func NewRelay(parsedCertData *cutil.ParsedCertData) *Server {
+func NewRelay(parsedCertData *cutil.ParsedCertData, opts Options) *Server {
+	if opts.RendezvousTimeout <= 0 {
+		opts.RendezvousTimeout = DefaultRendezvousTimeout
+	}
+	if opts.HandshakeTimeout <= 0 {
+		opts.HandshakeTimeout = DefaultHandshakeTimeout
+	}
+	if opts.HandshakeWorkers <= 0 {
+		opts.HandshakeWorkers = DefaultHandshakeWorkers
+	}
+	if opts.MaxPendingHandshakes <= 0 {
+		opts.MaxPendingHandshakes = DefaultMaxPendingHandshakes
+	}
+	if opts.DrainTimeout <= 0 {
+		opts.DrainTimeout = DefaultDrainTimeout
+	}
+	if opts.MailboxTTL <= 0 {
+		opts.MailboxTTL = DefaultMailboxTTL
+	}
+	if opts.Webhooks == nil {
+		opts.Webhooks = webhook.New(opts.WebhookNetworks)
+	}
 	s := &Server{
 		router:         chi.NewRouter(),
 		parsedCertData: parsedCertData,
 		states:         store.GetState(),
+		limiters:       newBandwidthLimiters(),
+		opts:           opts,
 		logger:         logrus.WithField("component", "server.relay"),
 	}
+	if opts.MailboxSize > 0 {
+		s.mailboxes = mailbox.New(mailbox.Limits{
+			MaxBytes:      opts.MailboxSize,
+			MaxUserBytes:  opts.MailboxUserSize,
+			MaxUserBoxes:  opts.MaxUserMailboxes,
+			MaxPartyBytes: opts.MailboxPartySize,
+			MaxPartyBoxes: opts.MaxPartyMailboxes,
+		}, opts.MailboxTTL)
+	}
+	if len(opts.Peers) > 0 {
+		s.federation = newFederation(opts.Peers)
+	}
+	s.metrics = newMetrics(s)
 	return s
 }
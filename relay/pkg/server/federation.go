@@ -0,0 +1,418 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/store"
+)
+
+// peerAgent identifies the relay in the Hello message sent to its peer relays
+const peerAgent = "flock-relay"
+
+// subscriberQueueSize bounds the Parked messages waiting to be sent to a peer relay, beyond which
+// announcements are dropped until the next snapshot
+const subscriberQueueSize = 64
+
+// federation shares the parked rendezvous of the relay with its peer relays, and tracks theirs.
+// When two parties that are waiting for each other are parked on different relays, the relay of the
+// party with the smaller name claims the other party from its relay, which pairs it with the tunnel
+// of the claim. Letting a single relay claim keeps the two relays from taking both parties at once.
+type federation struct {
+	peers []string
+	mutex sync.Mutex
+	// remote holds the rendezvous parked on each peer relay, by peer address and rendezvous key
+	remote      map[string]map[string]api.Rendezvous
+	subscribers map[*subscriber]struct{}
+}
+
+// subscriber is a peer relay receiving the parked rendezvous of this relay
+type subscriber struct {
+	conn  *tls.Conn
+	queue chan api.Parked
+}
+
+func newFederation(peers []string) *federation {
+	return &federation{
+		peers:       peers,
+		remote:      make(map[string]map[string]api.Rendezvous),
+		subscribers: make(map[*subscriber]struct{}),
+	}
+}
+
+// rendezvousKey identifies a rendezvous like the keys of the store
+func rendezvousKey(user, srcParty, dstParty, tag string) string {
+	return user + "/" + srcParty + ":" + dstParty + ":" + tag
+}
+
+// endpointRendezvous returns the rendezvous of a parked endpoint
+func endpointRendezvous(ep *store.Endpoint) api.Rendezvous {
+	return api.Rendezvous{User: ep.User, SrcParty: ep.SrcParty, DstParty: ep.DstParty, Tag: ep.Tag}
+}
+
+// startFederation subscribes to the parked rendezvous of every peer relay and sends the parked rendezvous
+// of this relay to its subscribers, until ctx is done
+func (s *Server) startFederation(ctx context.Context) {
+	for _, peer := range s.federation.peers {
+		go s.subscribe(ctx, peer)
+	}
+	ticker := time.NewTicker(peerSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.federation.closeSubscribers()
+			return
+		case <-ticker.C:
+			snapshot := api.Parked{Rendezvous: []api.Rendezvous{}, Snapshot: true}
+			for _, ep := range s.states.ParkedEndpoints("", "", "", "") {
+				if ep.Group {
+					// Group rendezvous are not federated
+					continue
+				}
+				snapshot.Rendezvous = append(snapshot.Rendezvous, endpointRendezvous(ep))
+			}
+			s.federation.publish(snapshot)
+		}
+	}
+}
+
+// dialPeer connects to a peer relay, authenticated with the relay certificate, and opens its control session
+func (s *Server) dialPeer(peer string) (*tls.Conn, error) {
+	network, address := "tcp", peer
+	if path, ok := strings.CutPrefix(peer, unixPrefix); ok {
+		network, address = "unix", path
+	}
+	conn, err := net.DialTimeout(network, address, peerDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(s.opts.HandshakeTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, s.opts.Credentials.ClientConfig())
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := api.WriteMessage(tlsConn, api.MsgHello, api.Hello{Agent: peerAgent}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// subscribe receives the parked rendezvous of a peer relay, reconnecting whenever the link is lost, until ctx is done
+func (s *Server) subscribe(ctx context.Context, peer string) {
+	for {
+		err := s.receiveParked(ctx, peer)
+		s.federation.forget(peer)
+		if ctx.Err() != nil {
+			return
+		}
+		s.logger.Warnf("Lost the link to peer relay %s, retrying in %v: %v", peer, peerRetryInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(peerRetryInterval):
+		}
+	}
+}
+
+// receiveParked subscribes to a peer relay and tracks its parked rendezvous until the link fails or ctx is done
+func (s *Server) receiveParked(ctx context.Context, peer string) error {
+	conn, err := s.dialPeer(peer)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	if err := api.WriteMessage(conn, api.MsgSubscribe, nil); err != nil {
+		return err
+	}
+	s.logger.Infof("Subscribed to peer relay %s", peer)
+	for {
+		// A peer sends a snapshot every sync interval, so a silent link is gone
+		if err := conn.SetReadDeadline(time.Now().Add(3 * peerSyncInterval)); err != nil {
+			return err
+		}
+		parked := api.Parked{}
+		if err := api.ReadMessageOf(conn, api.MsgParked, &parked); err != nil {
+			return err
+		}
+		s.federation.update(peer, parked)
+		for _, r := range parked.Rendezvous {
+			// The party of this relay waits for the remote party, and claims it if its name is the smaller
+			if r.DstParty < r.SrcParty {
+				if ep := s.states.Take(r.User, r.DstParty, r.SrcParty, r.Tag); ep != nil {
+					go s.claim(peer, ep)
+				}
+			}
+		}
+	}
+}
+
+// update records the rendezvous parked on a peer relay
+func (f *federation) update(peer string, parked api.Parked) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	rendezvous := f.remote[peer]
+	if rendezvous == nil || parked.Snapshot {
+		rendezvous = make(map[string]api.Rendezvous, len(parked.Rendezvous))
+		f.remote[peer] = rendezvous
+	}
+	for _, r := range parked.Rendezvous {
+		rendezvous[rendezvousKey(r.User, r.SrcParty, r.DstParty, r.Tag)] = r
+	}
+}
+
+// forget drops the rendezvous of a peer relay whose link was lost
+func (f *federation) forget(peer string) {
+	f.mutex.Lock()
+	delete(f.remote, peer)
+	f.mutex.Unlock()
+}
+
+// lookup returns the peer relay on which dstParty is parked waiting for srcParty, empty if none
+func (f *federation) lookup(user, srcParty, dstParty, tag string) string {
+	key := rendezvousKey(user, dstParty, srcParty, tag)
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, peer := range f.peers {
+		if _, ok := f.remote[peer][key]; ok {
+			return peer
+		}
+	}
+	return ""
+}
+
+// publish queues a Parked message to every subscriber, dropping it for the subscribers that fell behind
+func (f *federation) publish(parked api.Parked) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for sub := range f.subscribers {
+		select {
+		case sub.queue <- parked:
+		default:
+		}
+	}
+}
+
+// closeSubscribers disconnects the subscribed peer relays
+func (f *federation) closeSubscribers() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for sub := range f.subscribers {
+		sub.conn.Close()
+	}
+}
+
+// parked announces a party parked on this relay to the peer relays, and claims its peer if it is parked on one of them
+func (s *Server) parked(ep *store.Endpoint) {
+	s.federation.publish(api.Parked{Rendezvous: []api.Rendezvous{endpointRendezvous(ep)}})
+	if ep.SrcParty >= ep.DstParty {
+		// The relay of the peer claims this party once it learns it is parked
+		return
+	}
+	peer := s.federation.lookup(ep.User, ep.SrcParty, ep.DstParty, ep.Tag)
+	if peer == "" {
+		return
+	}
+	if taken := s.states.Take(ep.User, ep.SrcParty, ep.DstParty, ep.Tag); taken != nil {
+		go s.claim(peer, taken)
+	}
+}
+
+// servePeer serves a peer relay, which either subscribes to the parked rendezvous or claims a parked party
+func (s *Server) servePeer(tcpConn net.Conn, tlsConn *tls.Conn) {
+	peer := tlsConn.RemoteAddr().String()
+	if s.federation == nil {
+		s.replyError(tlsConn, &api.Error{Code: api.ErrAccessDenied, Message: "federation is not enabled on this relay"})
+		tlsConn.Close()
+		return
+	}
+	err := api.ReadMessageOf(tlsConn, api.MsgHello, &api.Hello{})
+	var t api.MessageType
+	var payload []byte
+	if err == nil {
+		t, payload, err = api.ReadMessage(tlsConn)
+	}
+	if err == nil {
+		// The handshake deadline no longer applies to the subscription or the tunnel
+		err = tcpConn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		var relayErr *api.Error
+		if errors.As(err, &relayErr) {
+			s.replyError(tlsConn, relayErr)
+		}
+		s.logger.Errorf("Failed to read request of peer relay %s: %v", peer, err)
+		tlsConn.Close()
+		return
+	}
+
+	switch t {
+	case api.MsgSubscribe:
+		sub := &subscriber{conn: tlsConn, queue: make(chan api.Parked, subscriberQueueSize)}
+		s.federation.mutex.Lock()
+		s.federation.subscribers[sub] = struct{}{}
+		s.federation.mutex.Unlock()
+		s.logger.Infof("Peer relay %s subscribed", peer)
+		go s.sendParked(sub)
+	case api.MsgClaim:
+		claim := api.Claim{}
+		if err := api.DecodeMessage(t, payload, api.MsgClaim, &claim); err != nil {
+			s.logger.Errorf("Failed to read claim of peer relay %s: %v", peer, err)
+			s.replyError(tlsConn, &api.Error{Code: api.ErrBadRequest, Message: err.Error()})
+			tlsConn.Close()
+			return
+		}
+		s.acceptClaim(peer, tlsConn, claim)
+	default:
+		s.replyError(tlsConn, &api.Error{Code: api.ErrBadRequest, Message: fmt.Sprintf("unexpected %v message", t)})
+		tlsConn.Close()
+	}
+}
+
+// sendParked writes the queued Parked messages to a subscriber until its link fails
+func (s *Server) sendParked(sub *subscriber) {
+	gone := make(chan struct{})
+	go func() {
+		// The subscriber sends nothing, reading only detects that it went away
+		io.Copy(io.Discard, sub.conn)
+		close(gone)
+	}()
+	defer func() {
+		s.federation.mutex.Lock()
+		delete(s.federation.subscribers, sub)
+		s.federation.mutex.Unlock()
+		sub.conn.Close()
+		s.logger.Infof("Peer relay %s unsubscribed", sub.conn.RemoteAddr().String())
+	}()
+	for {
+		select {
+		case <-gone:
+			return
+		case parked := <-sub.queue:
+			if err := s.sendMessage(sub.conn, api.MsgParked, parked); err != nil {
+				s.logger.Debugf("Failed to send parked rendezvous to %s: %v", sub.conn.RemoteAddr().String(), err)
+				return
+			}
+		}
+	}
+}
+
+// claim pairs a party of this relay, taken from the parked set, with its peer parked on a peer relay.
+// The party is parked again when the claim fails, e.g. because its peer was paired or left meanwhile.
+func (s *Server) claim(peer string, ep *store.Endpoint) {
+	conn, err := s.dialPeer(peer)
+	if err != nil {
+		s.metrics.peerClaims.WithLabelValues("failed").Inc()
+		s.logger.Errorf("Failed to reach peer relay %s: %v", peer, err)
+		s.repark(ep)
+		return
+	}
+	tunnel := &store.Endpoint{Conn: conn, TLSConn: conn, Since: time.Now(), Relay: peer}
+	if err := s.states.Attach(ep.User, ep.SrcParty, ep.DstParty, ep.Tag, ep, tunnel, s.quota(ep.User)); err != nil {
+		s.logger.Errorf("Failed to pair %s/%s:%s(%s) with peer relay %s: %v", ep.User, ep.SrcParty, ep.DstParty, ep.Tag, peer, err)
+		s.metrics.peerClaims.WithLabelValues("failed").Inc()
+		conn.Close()
+		s.closeParked(ep, s.rendezvousError(err))
+		return
+	}
+	ready, err := s.sendClaim(conn, ep)
+	if err != nil {
+		conn.Close()
+		s.states.Release(ep.User, ep.SrcParty, ep.DstParty, ep.Tag)
+		var relayErr *api.Error
+		if errors.As(err, &relayErr) && relayErr.Code == api.ErrNotParked {
+			s.metrics.peerClaims.WithLabelValues("not_parked").Inc()
+		} else {
+			s.metrics.peerClaims.WithLabelValues("failed").Inc()
+			s.logger.Errorf("Failed to claim %s/%s from peer relay %s: %v", ep.User, ep.DstParty, peer, err)
+		}
+		s.repark(ep)
+		return
+	}
+	if err := s.handoverParked(ep, api.Ready{Mode: ready.Mode}); err != nil {
+		conn.Close()
+		closeEndpoint(ep)
+		s.states.Release(ep.User, ep.SrcParty, ep.DstParty, ep.Tag)
+		return
+	}
+	s.logger.Infof("Paired %s/%s:%s(%s) with its peer on relay %s", ep.User, ep.SrcParty, ep.DstParty, ep.Tag, peer)
+	s.metrics.peerClaims.WithLabelValues("paired").Inc()
+	s.metrics.timeToPair.Observe(ep.PairedAt.Sub(ep.Since).Seconds())
+	go s.startForwarding(ep, tunnel)
+}
+
+// sendClaim claims the peer of ep over the connection to its relay, and returns the TLS role of ep
+func (s *Server) sendClaim(conn *tls.Conn, ep *store.Endpoint) (*api.Ready, error) {
+	claim := api.Claim{Rendezvous: api.Rendezvous{User: ep.User, SrcParty: ep.DstParty, DstParty: ep.SrcParty, Tag: ep.Tag}}
+	ready := &api.Ready{}
+	err := api.WriteMessage(conn, api.MsgClaim, claim)
+	if err == nil {
+		// The peer relay hands its party over before it replies
+		err = conn.SetDeadline(time.Now().Add(2 * replyTimeout))
+	}
+	if err == nil {
+		err = api.ReadMessageOf(conn, api.MsgReady, ready)
+	}
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	return ready, err
+}
+
+// acceptClaim pairs a parked party claimed by a peer relay with the tunnel of the claim
+func (s *Server) acceptClaim(peer string, tlsConn *tls.Conn, claim api.Claim) {
+	tunnel := &store.Endpoint{Conn: tlsConn, TLSConn: tlsConn, Since: time.Now(), Relay: peer}
+	r := claim.Rendezvous
+	ep, err := s.states.Claim(r.User, r.DstParty, r.SrcParty, r.Tag, tunnel, s.quota(r.User))
+	if err != nil {
+		relayErr := s.rendezvousError(err)
+		if errors.Is(err, store.ErrNotParked) {
+			relayErr.Code = api.ErrNotParked
+		}
+		s.replyError(tlsConn, relayErr)
+		tlsConn.Close()
+		return
+	}
+	err = s.handoverParked(ep, api.Ready{Mode: api.TLSModeClient})
+	if err == nil {
+		err = s.sendMessage(tlsConn, api.MsgReady, api.Ready{Mode: api.TLSModeServer})
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to pair %s/%s:%s(%s) with peer relay %s: %v", r.User, r.SrcParty, r.DstParty, r.Tag, peer, err)
+		closeEndpoint(ep)
+		tlsConn.Close()
+		s.states.Release(r.User, r.DstParty, r.SrcParty, r.Tag)
+		return
+	}
+	s.logger.Infof("Paired %s/%s:%s(%s) with its peer on relay %s", ep.User, ep.SrcParty, ep.DstParty, ep.Tag, peer)
+	s.metrics.timeToPair.Observe(tunnel.PairedAt.Sub(ep.Since).Seconds())
+	go s.startForwarding(tunnel, ep)
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/flock-org/flock/relay/config"
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/client"
+)
+
+func TestIsRelayCertificate(t *testing.T) {
+	tests := []struct {
+		cn, ou string
+		relay  bool
+	}{
+		{config.FlockrelayServerName, config.FlockrelayServerName, true},
+		// A party named after the relay stays a party of its user
+		{config.FlockrelayServerName, "user1", false},
+		{"0", config.FlockrelayServerName, false},
+		{config.FlockrelayServerName, "", false},
+	}
+	for _, test := range tests {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: test.cn}}
+		if test.ou != "" {
+			cert.Subject.OrganizationalUnit = []string{test.ou}
+		}
+		if isRelayCertificate(cert) != test.relay {
+			t.Errorf("CN=%s, OU=%s: expected relay %v", test.cn, test.ou, test.relay)
+		}
+	}
+}
+
+// createCerts creates the relay certificates and parties 0 and 1 of user1 in the certs directory
+func createCerts(t *testing.T) {
+	if err := api.CreateRelay(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.CreateUser("user1", false); err != nil {
+		t.Fatal(err)
+	}
+	for _, party := range []string{"0", "1"} {
+		if err := api.CreateParty(party, "user1", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := api.CreateParty(config.FlockrelayServerName, "user1", false); err == nil {
+		t.Fatal("expected the party name of the relay to be reserved")
+	}
+}
+
+// startRelay starts a relay listening on address with the given peer relays, until ctx is done
+func startRelay(ctx context.Context, t *testing.T, address string, peers []string) {
+	creds, err := NewCredentials(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewRelay(nil, Options{Credentials: creds, Peers: peers})
+	go s.StartRelaySSLServer(ctx, []string{address})
+	path := strings.TrimPrefix(address, unixPrefix)
+	for i := 0; ; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return
+		}
+		if i == 100 {
+			t.Fatalf("relay %s did not start", address)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// e2eSession is the E2E session of a party, or the error that prevented it
+type e2eSession struct {
+	conn *tls.Conn
+	err  error
+}
+
+// connectParty opens the E2E session of a party of user1 with dest through relay
+func connectParty(name, dest, relay string) e2eSession {
+	tcpConn, _, ready, err := client.StartRelayAuthGo("user1", name, dest, "federation", relay)
+	if err != nil {
+		return e2eSession{err: err}
+	}
+	conn, err := client.GetSessionE2EGo(tcpConn, ready, "user1", name, dest)
+	if err != nil {
+		tcpConn.Close()
+	}
+	return e2eSession{conn: conn, err: err}
+}
+
+// TestFederation pairs two parties connected to two peer relays on localhost
+func TestFederation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("creates certificates and runs two relays")
+	}
+	dir := t.TempDir()
+	defer config.SetCertsDirectory(config.BaseDirectory())
+	config.SetCertsDirectory(filepath.Join(dir, "certs"))
+	createCerts(t)
+
+	relays := []string{unixPrefix + filepath.Join(dir, "relay0.sock"), unixPrefix + filepath.Join(dir, "relay1.sock")}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	startRelay(ctx, t, relays[0], relays[1:])
+	startRelay(ctx, t, relays[1], relays[:1])
+
+	sessions := make(chan e2eSession, 1)
+	go func() {
+		sessions <- connectParty("1", "0", relays[1])
+	}()
+	s0 := connectParty("0", "1", relays[0])
+	s1 := <-sessions
+	if s0.err != nil || s1.err != nil {
+		t.Fatalf("failed to pair the parties across the relays: %v, %v", s0.err, s1.err)
+	}
+	defer s0.conn.Close()
+	defer s1.conn.Close()
+
+	s0.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	s1.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	go s0.conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(s1.conn, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("expected hello over the E2E session, got %q: %v", buf, err)
+	}
+	if peer := s1.conn.ConnectionState().PeerCertificates[0].Subject.CommonName; peer != "0" {
+		t.Fatalf("expected the E2E peer to be party 0, got %s", peer)
+	}
+}
@@ -14,103 +14,163 @@
 package server
 
 import (
+	"errors"
 	"io"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 )
 
 const (
 	dataBufferSize = 64 * 1024
-	readDeadline   = 10 * time.Millisecond
+	// idleChecksPerTimeout is how many times per idle timeout each direction reports its activity
+	idleChecksPerTimeout = 4
+	// progressInterval bounds how stale the forwarded byte counts of a session may be
+	progressInterval = time.Second
 )
 
+// EndReason records why a forwarded session ended
+type EndReason string
+
+const (
+	// EndEOF is a session whose parties both closed their side
+	EndEOF EndReason = "eof"
+	// EndReset is a session torn down by a connection error of either party
+	EndReset EndReason = "reset"
+	// EndIdle is a session closed after carrying no data for the idle timeout
+	EndIdle EndReason = "idle"
+	// EndLifetime is a session closed after reaching the maximum session lifetime
+	EndLifetime EndReason = "lifetime"
+	// EndTerminated is a session terminated by an operator over the admin API
+	EndTerminated EndReason = "terminated"
+)
+
+// bufferPool holds the copy buffers of connections that cannot be forwarded in the kernel
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, dataBufferSize)
+		return &buf
+	},
+}
+
 type forwarder struct {
 	workloadConn net.Conn
 	peerConn     net.Conn
-	closeSignal  atomic.Bool
+	idleTimeout  time.Duration
+	maxLifetime  time.Duration
+	lastActive   atomic.Int64
+	reasonOnce   sync.Once
+	reason       EndReason
 	logger       *logrus.Entry
-	b1           int
-	b2           int
+	b1           *atomic.Int64
+	b2           *atomic.Int64
+	// l1 and l2 limit the bandwidth of the workload and of the peer
+	l1 []*rate.Limiter
+	l2 []*rate.Limiter
+	// m1 and m2 count the bytes sent by the workload and by the peer as they are forwarded
+	m1 []prometheus.Counter
+	m2 []prometheus.Counter
 }
 
-type connDialer struct {
-	c net.Conn
+// onlyWriter hides the ReaderFrom of a connection so that io.CopyBuffer uses the given buffer
+type onlyWriter struct {
+	io.Writer
 }
 
-func (cd connDialer) Dial(_, _ string) (net.Conn, error) {
-	return cd.c, nil
+// onlyReader hides the WriterTo of a connection so that io.CopyBuffer uses the given buffer
+type onlyReader struct {
+	io.Reader
 }
 
-func (f *forwarder) peerToWorkload() error {
-	bufData := make([]byte, dataBufferSize)
-	var err error
-	var n int
-	numBytes := 0
-	for {
-		// if f.closeSignal.Load() {
-		// 	return nil
-		// }
-		// err = f.peerConn.SetReadDeadline(time.Now().Add(readDeadline))
-		// if err != nil {
-		// 	return err
-		// }
-		numBytes, err = f.peerConn.Read(bufData)
-		if err != nil {
-			if err1, ok := err.(net.Error); ok && err1.Timeout() {
-				continue
+// closeWriter is a connection that can shut down its write side, such as *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// copyConn forwards src to dst until src ends, fails or hits its read deadline, returning the number of bytes written to dst.
+// Two TCP connections without bandwidth limits are forwarded with TCPConn.ReadFrom, which splices in the kernel
+// on Linux; any other pair of connections is copied through a pooled buffer, throttled by the limiters.
+func copyConn(dst, src net.Conn, limiters []*rate.Limiter) (int64, error) {
+	if len(limiters) == 0 {
+		if dstTCP, ok := dst.(*net.TCPConn); ok {
+			switch src.(type) {
+			case *net.TCPConn, *net.UnixConn:
+				return dstTCP.ReadFrom(src)
 			}
-			break
 		}
-		n, err = f.workloadConn.Write(bufData[:numBytes])
-		if err != nil {
-			break
-		}
-		f.b2 += n
 	}
-	f.closeConnections()
-	//f.closeSignal.Swap(true)
-	if err != io.EOF {
-		return err
+	var w io.Writer = onlyWriter{dst}
+	if len(limiters) > 0 {
+		w = throttledWriter{w: dst, limiters: limiters}
 	}
-	return err
+	buf := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(buf)
+	return io.CopyBuffer(w, onlyReader{src}, *buf)
 }
 
-func (f *forwarder) workloadToPeer() error {
-	bufData := make([]byte, dataBufferSize)
-	var err error
-	var n int
-	numBytes := 0
+// end records the reason the session ends, the first reason recorded wins
+func (f *forwarder) end(reason EndReason) {
+	f.reasonOnce.Do(func() { f.reason = reason })
+}
+
+// forward copies src to dst until src closes its side, which is propagated to dst as a half-close.
+// The copy is interrupted periodically to update the byte counts and note activity, and the session
+// is closed once neither direction has carried data for the idle timeout.
+func (f *forwarder) forward(dst, src net.Conn, total *atomic.Int64, limiters []*rate.Limiter, counters []prometheus.Counter) {
+	interval := progressInterval
+	if f.idleTimeout > 0 && f.idleTimeout/idleChecksPerTimeout < interval {
+		interval = f.idleTimeout / idleChecksPerTimeout
+	}
 	for {
-		// if f.closeSignal.Load() {
-		// 	return nil
-		// }
-		// err = f.workloadConn.SetReadDeadline(time.Now().Add(readDeadline))
-		// if err != nil {
-		// 	return err
-		// }
-		numBytes, err = f.workloadConn.Read(bufData)
-		if err != nil {
-			if err1, ok := err.(net.Error); ok && err1.Timeout() {
-				continue
+		if err := src.SetReadDeadline(time.Now().Add(interval)); err != nil {
+			f.end(EndReset)
+			f.closeConnections()
+			return
+		}
+		n, err := copyConn(dst, src, limiters)
+		total.Add(n)
+		if n > 0 {
+			f.lastActive.Store(time.Now().UnixNano())
+			for _, c := range counters {
+				c.Add(float64(n))
 			}
-			break
 		}
-		n, err = f.peerConn.Write(bufData[:numBytes]) // TODO: track actually written byte count
-		if err != nil {
-			break
+		switch {
+		case err == nil:
+			// src sent FIN, let the peer read what is left and keep forwarding its reply
+			if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+				return
+			}
+			f.end(EndEOF)
+			f.closeConnections()
+			return
+		case errors.Is(err, os.ErrDeadlineExceeded):
+			if f.idleTimeout <= 0 || time.Since(time.Unix(0, f.lastActive.Load())) < f.idleTimeout {
+				continue
+			}
+			f.end(EndIdle)
+			f.closeConnections()
+			return
+		default:
+			f.end(EndReset)
+			f.closeConnections()
+			return
 		}
-		f.b1 += n
-	}
-	f.closeConnections()
-	//f.closeSignal.Swap(true)
-	if err != io.EOF { // don't log EOF
-		return err
 	}
-	return err
+}
+
+func (f *forwarder) peerToWorkload() {
+	f.forward(f.workloadConn, f.peerConn, f.b2, f.l2, f.m2)
+}
+
+func (f *forwarder) workloadToPeer() {
+	f.forward(f.peerConn, f.workloadConn, f.b1, f.l1, f.m1)
 }
 
 func (f *forwarder) closeConnections() {
@@ -122,37 +182,46 @@ func (f *forwarder) closeConnections() {
 	}
 }
 
-func (f *forwarder) run() (int, int) {
+// run forwards the session in both directions until it ends, returning the bytes forwarded each way and the end reason
+func (f *forwarder) run() (int64, int64, EndReason) {
 	var wg sync.WaitGroup
 
+	f.lastActive.Store(time.Now().UnixNano())
+	if f.maxLifetime > 0 {
+		lifetime := time.AfterFunc(f.maxLifetime, func() {
+			f.end(EndLifetime)
+			f.closeConnections()
+		})
+		defer lifetime.Stop()
+	}
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		f.workloadToPeer()
-		// if err != nil {
-		// 	f.logger.Errorf("Error in workload to peer connection: %v.", err)
-		// }
 	}()
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		f.peerToWorkload()
-		// if err != nil {
-		// 	f.logger.Errorf("Error in peer to workload connection: %v.", err)
-		// }
 	}()
 
 	wg.Wait()
-	//f.closeConnections()
-	return f.b1, f.b2
+	// Both parties closed their side
+	f.end(EndEOF)
+	f.closeConnections()
+	return f.b1.Load(), f.b2.Load(), f.reason
 }
 
-func newForwarder(workloadConn net.Conn, peerConn net.Conn) *forwarder {
+// newForwarder returns a forwarder that counts the bytes sent by the workload and by the peer into b1 and b2
+func newForwarder(workloadConn net.Conn, peerConn net.Conn, b1, b2 *atomic.Int64, idleTimeout, maxLifetime time.Duration) *forwarder {
 	return &forwarder{workloadConn: workloadConn,
-		peerConn: peerConn,
-		logger:   logrus.WithField("component", "forwarder"+workloadConn.RemoteAddr().String()+"-"+peerConn.RemoteAddr().String()),
-		b1:       0,
-		b2:       0,
+		peerConn:    peerConn,
+		b1:          b1,
+		b2:          b2,
+		idleTimeout: idleTimeout,
+		maxLifetime: maxLifetime,
+		logger:      logrus.WithField("component", "forwarder"+workloadConn.RemoteAddr().String()+"-"+peerConn.RemoteAddr().String()),
 	}
 }
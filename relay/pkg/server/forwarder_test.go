@@ -0,0 +1,141 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// benchPayload is the number of bytes forwarded by each benchmark iteration
+const benchPayload = 4 << 20
+
+// legacyCopy is the copy loop of the forwarder before it used kernel splicing and pooled buffers
+func legacyCopy(dst, src net.Conn, _ []*rate.Limiter) (int64, error) {
+	buf := make([]byte, dataBufferSize)
+	var total int64
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			if err == io.EOF {
+				return total, nil
+			}
+			return total, err
+		}
+		written, err := dst.Write(buf[:n])
+		total += int64(written)
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// connPair returns both ends of a connection over network, "tcp" on the loopback or "unix" in a temporary directory
+func connPair(tb testing.TB, network string) (net.Conn, net.Conn) {
+	address := "127.0.0.1:0"
+	if network == "unix" {
+		address = filepath.Join(tb.TempDir(), "relay.sock")
+	}
+	l, err := net.Listen(network, address)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial(network, l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		tb.Fatal("accept failed")
+	}
+	return client, server
+}
+
+// cpuTime returns the user and system CPU time used by the process so far
+func cpuTime(tb testing.TB) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		tb.Fatal(err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// benchmarkCopy forwards benchPayload bytes per iteration from a sender to a receiver through a relay
+// connected to each of them over network, reporting the CPU time used by the whole process per iteration
+func benchmarkCopy(b *testing.B, network string, copyFunc func(dst, src net.Conn, limiters []*rate.Limiter) (int64, error)) {
+	sender, relaySrc := connPair(b, network)
+	relayDst, receiver := connPair(b, network)
+	defer relaySrc.Close()
+	defer relayDst.Close()
+	defer receiver.Close()
+
+	forwarded := make(chan error, 1)
+	go func() {
+		_, err := copyFunc(relayDst, relaySrc, nil)
+		forwarded <- err
+	}()
+	received := make(chan error, 1)
+	go func() {
+		_, err := io.CopyN(io.Discard, receiver, int64(b.N)*benchPayload)
+		received <- err
+	}()
+
+	chunk := make([]byte, dataBufferSize)
+	b.SetBytes(benchPayload)
+	b.ResetTimer()
+	start := cpuTime(b)
+	for i := 0; i < b.N; i++ {
+		for sent := 0; sent < benchPayload; sent += len(chunk) {
+			if _, err := sender.Write(chunk); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err := <-received; err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(cpuTime(b)-start)/float64(b.N), "cpu-ns/op")
+	sender.Close()
+	if err := <-forwarded; err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkForwarder(b *testing.B) {
+	for _, network := range []string{"tcp", "unix"} {
+		b.Run("legacy/"+network, func(b *testing.B) {
+			benchmarkCopy(b, network, legacyCopy)
+		})
+		b.Run("copyConn/"+network, func(b *testing.B) {
+			benchmarkCopy(b, network, copyConn)
+		})
+	}
+}
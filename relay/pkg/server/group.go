@@ -0,0 +1,107 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/store"
+)
+
+// joinGroup parks ep, the connection or the stream of a member of a group rendezvous to another member. Once
+// every member has one to every other member, they are paired and handed over together. A member usually joins
+// with a stream per other member, all over its multiplexed session.
+func (s *Server) joinGroup(user, srcParty string, join *api.GroupJoin, ep *store.Endpoint) error {
+	members, err := s.states.JoinGroup(user, srcParty, join.ID, join.Index, join.Peer, join.Size, ep, s.quota(user))
+	if members == nil {
+		if err != nil {
+			relayErr := s.rendezvousError(err)
+			s.closeParked(ep, relayErr)
+			return relayErr
+		}
+		ep.CtrlMutex.Lock()
+		if !ep.Paired {
+			err = s.sendControl(ep, api.MsgWaiting, api.Waiting{Deadline: ep.Deadline})
+		}
+		ep.CtrlMutex.Unlock()
+		if err != nil {
+			s.logger.Debugf("Failed to send waiting to %s/%s in group %s: %v", user, srcParty, join.ID, err)
+		}
+		return nil
+	}
+
+	var relayErr *api.Error
+	if err != nil {
+		relayErr = s.rendezvousError(err)
+	} else if relayErr = s.authorizeGroup(members); relayErr != nil {
+		for _, m := range members {
+			if m.Index < m.PeerIndex {
+				s.states.Release(m.User, m.SrcParty, m.DstParty, m.Tag)
+			}
+		}
+	}
+	if relayErr != nil {
+		s.logger.Errorf("Group %s/%s of %d members failed: %v", user, join.ID, join.Size, relayErr)
+		for _, m := range members {
+			s.closeParked(m, relayErr)
+		}
+		return relayErr
+	}
+
+	s.logger.Infof("Group %s/%s of %d members complete, pairing %d connections", user, join.ID, join.Size, len(members))
+	seats := make(map[[2]int]*store.Endpoint, len(members))
+	for _, m := range members {
+		seats[[2]int{m.Index, m.PeerIndex}] = m
+	}
+	for seat, m := range seats {
+		if seat[0] < seat[1] {
+			go s.pairGroup(m, seats[[2]int{seat[1], seat[0]}])
+		}
+	}
+	return nil
+}
+
+// authorizeGroup checks every pair of a complete group against the policy of its user
+func (s *Server) authorizeGroup(members []*store.Endpoint) *api.Error {
+	if s.opts.Policy == nil {
+		return nil
+	}
+	for _, m := range members {
+		if denial := s.opts.Policy.Authorize(m.User, m.SrcParty, m.DstParty, m.Tag); denial != nil {
+			return denial
+		}
+	}
+	return nil
+}
+
+// pairGroup hands two members of a complete group over to their E2E session, the member of the lower index
+// being the TLS client, and starts forwarding between them
+func (s *Server) pairGroup(ep, peer *store.Endpoint) {
+	err := s.handoverParked(ep, api.Ready{Mode: api.TLSModeClient, Peer: peer.SrcParty})
+	if err == nil {
+		err = s.handoverParked(peer, api.Ready{Mode: api.TLSModeServer, Peer: ep.SrcParty})
+	}
+	if err != nil {
+		s.logger.Errorf("Failed to hand over members %d and %d of group %s/%s: %v", ep.Index, peer.Index, ep.User, ep.Tag, err)
+		closeEndpoint(ep)
+		closeEndpoint(peer)
+		s.states.Release(ep.User, ep.SrcParty, ep.DstParty, ep.Tag)
+		return
+	}
+	since := ep.Since
+	if peer.Since.Before(since) {
+		since = peer.Since
+	}
+	s.metrics.timeToPair.Observe(ep.PairedAt.Sub(since).Seconds())
+	s.startForwarding(ep, peer)
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/mux"
+)
+
+// joinMember opens the multiplexed session of member index of a group of size, and a stream per other member
+func joinMember(t *testing.T, s *Server, index, size int) []*mux.Stream {
+	c, r := net.Pipe()
+	client := mux.Client(c)
+	t.Cleanup(func() { client.Close() })
+	go s.acceptStreams("user1", fmt.Sprint(index), mux.Server(r, 0))
+
+	var streams []*mux.Stream
+	for peer := 0; peer < size; peer++ {
+		if peer == index {
+			continue
+		}
+		var req bytes.Buffer
+		join := &api.GroupJoin{ID: "group", Index: index, Size: size, Peer: peer}
+		if err := api.WriteMessage(&req, api.MsgAuthReq, api.AuthReq{Group: join}); err != nil {
+			t.Fatal(err)
+		}
+		stream, err := client.Open(req.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, stream)
+	}
+	return streams
+}
+
+// awaitParked waits for the relay to park n endpoints
+func awaitParked(t *testing.T, s *Server, n int) {
+	for i := 0; s.states.Parked() != n; i++ {
+		if i == 100 {
+			t.Fatalf("expected %d parked endpoints, got %d", n, s.states.Parked())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestGroupOverStreams joins every member of a group with a single multiplexed session
+func TestGroupOverStreams(t *testing.T) {
+	s := NewRelay(nil, Options{RendezvousTimeout: time.Minute})
+	const size = 3
+	var streams []*mux.Stream
+	for index := 0; index < size-1; index++ {
+		streams = append(streams, joinMember(t, s, index, size)...)
+	}
+	awaitParked(t, s, (size-1)*(size-1))
+	// Each waiting member counts once, whatever the number of its streams
+	if usage := s.states.UserUsage()["user1"]; usage.Parked != size-1 {
+		t.Fatalf("expected %d parked members, got %+v", size-1, usage)
+	}
+
+	streams = append(streams, joinMember(t, s, size-1, size)...)
+	for _, stream := range streams {
+		stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			reply, err := stream.ReadControl()
+			if err != nil {
+				t.Fatalf("expected stream %d to be paired: %v", stream.ID(), err)
+			}
+			msgType, _, err := api.ReadMessage(bytes.NewReader(reply))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msgType == api.MsgReady {
+				break
+			}
+		}
+	}
+	if s.states.Parked() != 0 || s.states.Paired() != size*(size-1)/2 {
+		t.Fatalf("expected %d pairs and no parked member, got %d and %d", size*(size-1)/2, s.states.Paired(), s.states.Parked())
+	}
+}
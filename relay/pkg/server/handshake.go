@@ -0,0 +1,133 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/flock-org/flock/relay/config"
+)
+
+// handshakeStats counts the outcome of the connections handed to the handshake workers
+type handshakeStats struct {
+	rejected atomic.Int64 // dropped because too many handshakes were in flight
+	timedOut atomic.Int64 // did not finish the handshake and auth request within the timeout
+	failed   atomic.Int64 // failed the handshake or the party lookup for any other reason
+}
+
+// startHandshakeWorkers starts the handshake worker pool and returns the queue accepted connections are handed to
+func (s *Server) startHandshakeWorkers(tlsConfig *tls.Config) chan<- net.Conn {
+	pending := make(chan net.Conn, s.opts.MaxPendingHandshakes)
+	for i := 0; i < s.opts.HandshakeWorkers; i++ {
+		go s.handshakeWorker(tlsConfig, pending)
+	}
+	return pending
+}
+
+// admit queues an accepted connection for the handshake workers, or rejects it when the queue is full
+func (s *Server) admit(pending chan<- net.Conn, tcpConn net.Conn) {
+	select {
+	case pending <- tcpConn:
+	default:
+		s.hsStats.rejected.Add(1)
+		s.logger.Warnf("Too many handshakes in flight, rejecting connection from %s", tcpConn.RemoteAddr().String())
+		tcpConn.Close()
+	}
+}
+
+func (s *Server) handshakeWorker(tlsConfig *tls.Config, pending <-chan net.Conn) {
+	for tcpConn := range pending {
+		s.handshake(tlsConfig, tcpConn)
+	}
+}
+
+// handshake runs the relay TLS handshake, identifies the party and reads its auth request.
+// The whole exchange is bounded by the handshake timeout, whose deadline is cleared once the
+// auth request has been read and the request is served outside of the worker.
+func (s *Server) handshake(tlsConfig *tls.Config, tcpConn net.Conn) {
+	deadline := time.Now().Add(s.opts.HandshakeTimeout)
+	if err := tcpConn.SetDeadline(deadline); err != nil {
+		s.logger.Errorf("Failed to set handshake deadline: %v.", err)
+		tcpConn.Close()
+		return
+	}
+	tlsConn := tls.Server(&handoverConn{Conn: tcpConn}, tlsConfig)
+	err := tlsConn.Handshake()
+	if err != nil {
+		s.handshakeFailed(deadline, err)
+		s.logger.Errorf("Handshake failed: %v.", err)
+		tlsConn.Close()
+		return
+	}
+	s.logger.Info("Accept incoming connection from ", tlsConn.RemoteAddr().String())
+	reqParty, err := getPartyName(tlsConn)
+	if err != nil {
+		s.hsStats.failed.Add(1)
+		s.logger.Errorf("Failed to get party name: %v.", err)
+		tlsConn.Close()
+		return
+	}
+	if cert, _ := peerCertificate(tlsConn); isRelayCertificate(cert) {
+		s.logger.Infof("Got connection from peer relay %s", tlsConn.RemoteAddr().String())
+		// Its requests are still read within the handshake deadline
+		go s.servePeer(tcpConn, tlsConn)
+		return
+	}
+	if reqParty == config.FlockrelayServerName {
+		// The party lookup fails, rejected only counts the handshakes dropped under load
+		s.hsStats.failed.Add(1)
+		s.logger.Errorf("Rejected party %s from %s, the name is reserved for the relay", reqParty, tlsConn.RemoteAddr().String())
+		tlsConn.Close()
+		return
+	}
+	reqUser, err := getUserName(tlsConn)
+	if err != nil {
+		s.hsStats.failed.Add(1)
+		s.logger.Errorf("Failed to get user of party %s: %v.", reqParty, err)
+		tlsConn.Close()
+		return
+	}
+	s.logger.Infof("Got connection from %s/%s requesting access to %s", reqUser, reqParty, tlsConn.ConnectionState().ServerName)
+
+	authReq, err := s.readAuthRequest(tlsConn)
+	if err == nil {
+		// The handshake deadline no longer applies once the party waits for its peer
+		err = tcpConn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		s.metrics.authFailures.Inc()
+		if time.Now().After(deadline) {
+			s.hsStats.timedOut.Add(1)
+		}
+		s.logger.Errorf("Failed to read auth request of %s/%s: %v", reqUser, reqParty, err)
+		tlsConn.Close()
+		return
+	}
+	// The worker is released once the party is authenticated
+	go s.serveParty(reqUser, reqParty, authReq, tcpConn, tlsConn)
+}
+
+// handshakeFailed accounts a failed handshake as timed out or failed
+func (s *Server) handshakeFailed(deadline time.Time, err error) {
+	var netErr net.Error
+	if (errors.As(err, &netErr) && netErr.Timeout()) || time.Now().After(deadline) {
+		s.hsStats.timedOut.Add(1)
+		return
+	}
+	s.hsStats.failed.Add(1)
+}
@@ -14,43 +14,114 @@
 package server
 
 import (
-	"fmt"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"sync"
+	"time"
 
 	"github.com/clusterlink-net/clusterlink/pkg/util"
 	cutil "github.com/clusterlink-net/clusterlink/pkg/util"
 	"github.com/clusterlink-net/clusterlink/pkg/utils/netutils"
 	"github.com/go-chi/chi"
 	"github.com/sirupsen/logrus"
+
+	"github.com/flock-org/flock/relay/pkg/policy"
 )
 
+// apiWriteTimeout leaves room for minting the RSA keys of all the parties of a user
+const apiWriteTimeout = 5 * time.Minute
+
 type APIServer struct {
 	router         *chi.Mux
 	parsedCertData *util.ParsedCertData
-	logger         *logrus.Entry
+	relayTarget    string
+	policy         *policy.Engine
+	credentials    *Credentials
+	provisionMutex sync.Mutex
+	// webhookNetworks are the networks webhooks may target besides public addresses
+	webhookNetworks []*net.IPNet
+	logger          *logrus.Entry
 }
 
-// StartFlockAPIServer starts the Dataplane server
-func (s *APIServer) StartFlockAPIServer() error {
-	address := fmt.Sprintf(":%d", apiPort)
+// StartFlockAPIServer starts the provisioning API server on address, host:port
+func (s *APIServer) StartFlockAPIServer(address string) error {
 	s.logger.Infof("Flock API server starting at %s.", address)
-	server := netutils.CreateResilientHTTPServer(address, s.router, s.parsedCertData.ServerConfig(), nil, nil, nil)
+	writeTimeout := apiWriteTimeout
+	server := netutils.CreateResilientHTTPServer(address, s.router, s.credentials.ServerConfig(), nil, &writeTimeout, nil)
 
 	return server.ListenAndServeTLS("", "")
 }
 
+// addAPIHandlers routes the API requests. Provisioning is reserved to the relay certificate, and the
+// resources of a user to the relay certificate and to the parties of that user.
 func (s *APIServer) addAPIHandlers() {
+	s.router.Get("/crl", s.getRelayCRL)
 	s.router.Route("/user", func(r chi.Router) {
-		s.router.Get("/", s.addUser)
-		s.router.Post("/", s.addUser)
+		r.With(relayOnly).Post("/", s.addUser)
+		r.With(relayOnly).Get("/{user}/party/{party}", s.getPartyBundle)
+		r.Group(func(r chi.Router) {
+			r.Use(sameUserOnly)
+			r.Get("/{user}/crl", s.getUserCRL)
+			r.Get("/{user}/policy", s.getPolicy)
+			r.Put("/{user}/policy", s.setPolicy)
+			r.Get("/{user}/webhook", s.getWebhook)
+			r.Put("/{user}/webhook", s.setWebhook)
+			r.Delete("/{user}/webhook", s.deleteWebhook)
+		})
+	})
+}
+
+// callerCertificate returns the verified client certificate of an API request, or nil
+func callerCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.TLS.PeerCertificates[0]
+}
+
+// relayOnly rejects the clients that did not authenticate with the relay certificate
+func relayOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cert := callerCertificate(r); cert == nil || !isRelayCertificate(cert) {
+			http.Error(w, "this API requires the relay certificate", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameUserOnly rejects the clients that are neither the relay nor a party of the user of the request
+func sameUserOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cert := callerCertificate(r)
+		if cert == nil {
+			http.Error(w, "a client certificate is required", http.StatusForbidden)
+			return
+		}
+		if !isRelayCertificate(cert) {
+			ou := cert.Subject.OrganizationalUnit
+			if len(ou) == 0 || ou[0] != chi.URLParam(r, "user") {
+				http.Error(w, "parties may only access the resources of their own user", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
 	})
-	s.router.Mount("/", s.router)
 }
 
-func NewAPIServer(parsedCertData *cutil.ParsedCertData) *APIServer {
+// NewAPIServer returns the provisioning API server, relayTarget is the dataplane address handed out to parties,
+// policyEngine holds the access-control policies managed over the API and credentials authenticate its clients.
+// The webhooks registered over the API may target public addresses and webhookNetworks.
+func NewAPIServer(parsedCertData *cutil.ParsedCertData, relayTarget string, policyEngine *policy.Engine, credentials *Credentials, webhookNetworks []*net.IPNet) *APIServer {
 	s := &APIServer{
-		router:         chi.NewRouter(),
-		parsedCertData: parsedCertData,
-		logger:         logrus.WithField("component", "server.flockrelay"),
+		router:          chi.NewRouter(),
+		parsedCertData:  parsedCertData,
+		relayTarget:     relayTarget,
+		policy:          policyEngine,
+		credentials:     credentials,
+		webhookNetworks: webhookNetworks,
+		logger:          logrus.WithField("component", "server.flockrelay"),
 	}
 
 	s.addAPIHandlers()
@@ -0,0 +1,209 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/mailbox"
+)
+
+// mailboxError returns the error sent to a party whose mailbox session failed
+func (s *Server) mailboxError(err error) *api.Error {
+	var fullErr *mailbox.FullError
+	var quotaErr *mailbox.QuotaError
+	switch {
+	case errors.As(err, &fullErr):
+		return &api.Error{Code: api.ErrMailboxFull, Message: err.Error()}
+	case errors.As(err, &quotaErr):
+		s.metrics.quotaRejections.WithLabelValues(quotaErr.Limit).Inc()
+		return &api.Error{Code: api.ErrQuotaExceeded, Message: err.Error()}
+	case errors.Is(err, mailbox.ErrClosed):
+		return &api.Error{Code: api.ErrShuttingDown, Message: err.Error()}
+	case errors.Is(err, mailbox.ErrAttached):
+		return &api.Error{Code: api.ErrAlreadyWaiting, Message: err.Error()}
+	}
+	return &api.Error{Code: api.ErrBadRequest, Message: err.Error()}
+}
+
+// mailboxUsage returns the number of messages and bytes buffered in the mailboxes
+func (s *Server) mailboxUsage() (int, int) {
+	if s.mailboxes == nil {
+		return 0, 0
+	}
+	return s.mailboxes.Usage()
+}
+
+// serveMailbox starts the mailbox session of srcParty with the peer of its auth request. The messages the peer
+// left for srcParty are delivered, and the messages srcParty sends are buffered until the peer attaches in turn.
+// A mailbox session counts against the session quota of the user and of srcParty like a paired session.
+func (s *Server) serveMailbox(user, srcParty string, authReq *api.AuthReq, tlsConn *tls.Conn) error {
+	if s.mailboxes == nil {
+		relayErr := &api.Error{Code: api.ErrBadRequest, Message: "the mailbox is not enabled on this relay"}
+		s.replyError(tlsConn, relayErr)
+		return relayErr
+	}
+	quota := s.quota(user)
+	if err := s.states.AcquireSession(user, srcParty, quota); err != nil {
+		relayErr := s.rendezvousError(err)
+		s.replyError(tlsConn, relayErr)
+		return relayErr
+	}
+	reader, err := s.mailboxes.Attach(user, authReq.DestParty, srcParty, authReq.Tag)
+	if err != nil {
+		s.states.ReleaseSession(user, srcParty)
+		relayErr := s.mailboxError(err)
+		s.replyError(tlsConn, relayErr)
+		return relayErr
+	}
+	pending := reader.Pending()
+	err = s.sendMessage(tlsConn, api.MsgMailbox, api.Mailbox{Pending: pending, MaxBytes: s.opts.MailboxSize, TTL: s.opts.MailboxTTL})
+	if err != nil {
+		reader.Detach()
+		s.states.ReleaseSession(user, srcParty)
+		return err
+	}
+	s.logger.Infof("Mailbox session of %s/%s:%s(%s) started with %d pending messages", user, srcParty, authReq.DestParty, authReq.Tag, pending)
+	go s.runMailbox(user, srcParty, authReq.DestParty, authReq.Tag, tlsConn, reader, quota)
+	return nil
+}
+
+// runMailbox delivers the messages of the mailbox of srcParty while buffering the messages it sends to dstParty,
+// until srcParty ends the session. The relay then ends it too, confirming that every message was buffered.
+// The messages srcParty sends are received within the bandwidth quota of the user and of srcParty.
+func (s *Server) runMailbox(user, srcParty, dstParty, tag string, tlsConn *tls.Conn, reader *mailbox.Reader, quota api.Quota) {
+	defer s.states.ReleaseSession(user, srcParty)
+	limiters := s.limiters.get(user, srcParty, quota)
+	defer s.limiters.put(user, srcParty, limiters)
+	var writeMutex sync.Mutex
+	done := make(chan struct{})
+	delivered := make(chan struct{})
+	go func() {
+		defer close(delivered)
+		s.deliverMail(tlsConn, &writeMutex, reader, done)
+	}()
+	err := s.receiveMail(user, srcParty, dstParty, tag, tlsConn, reader, limiters)
+	close(done)
+	<-delivered
+	reader.Detach()
+	var relayErr *api.Error
+	if errors.As(err, &relayErr) {
+		s.replyError(tlsConn, relayErr)
+		s.discardMail(tlsConn)
+	}
+	if err != nil {
+		s.logger.Errorf("Mailbox session of %s/%s:%s(%s) failed: %v", user, srcParty, dstParty, tag, err)
+	} else {
+		s.logger.Infof("Mailbox session of %s/%s:%s(%s) finished", user, srcParty, dstParty, tag)
+	}
+	tlsConn.Close()
+}
+
+// receiveMail buffers the messages srcParty sends to dstParty and applies its acknowledgments, until it ends the session
+func (s *Server) receiveMail(user, srcParty, dstParty, tag string, tlsConn *tls.Conn, reader *mailbox.Reader, limiters []*rate.Limiter) error {
+	buffered := 0
+	for {
+		if s.opts.IdleTimeout > 0 {
+			if err := tlsConn.SetReadDeadline(time.Now().Add(s.opts.IdleTimeout)); err != nil {
+				return err
+			}
+		}
+		t, payload, err := api.ReadMessage(tlsConn)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t {
+		case api.MsgMail:
+			_, data, err := api.DecodeMail(payload)
+			if err != nil {
+				return err
+			}
+			// Waits for the tokens of the message before it is buffered
+			if _, err := (throttledWriter{w: io.Discard, limiters: limiters}).Write(data); err != nil {
+				return err
+			}
+			if err := s.mailboxes.Put(user, srcParty, dstParty, tag, data); err != nil {
+				relayErr := s.mailboxError(err)
+				relayErr.Message = fmt.Sprintf("%s, %d messages of this session were buffered", relayErr.Message, buffered)
+				return relayErr
+			}
+			buffered++
+		case api.MsgMailAck:
+			ack := api.MailAck{}
+			if err := api.DecodeMessage(t, payload, api.MsgMailAck, &ack); err != nil {
+				return err
+			}
+			reader.Ack(ack.Seq)
+		default:
+			return &api.Error{Code: api.ErrBadRequest, Message: fmt.Sprintf("unexpected %v message in a mailbox session", t)}
+		}
+	}
+}
+
+// deliverMail sends the messages of the mailbox to the attached party as they arrive, until done is closed
+func (s *Server) deliverMail(tlsConn *tls.Conn, writeMutex *sync.Mutex, reader *mailbox.Reader, done <-chan struct{}) {
+	for {
+		messages, err := reader.Next(done)
+		if err != nil {
+			writeMutex.Lock()
+			s.replyError(tlsConn, s.mailboxError(err))
+			writeMutex.Unlock()
+			tlsConn.Close()
+			return
+		}
+		if messages == nil {
+			return
+		}
+		for _, m := range messages {
+			writeMutex.Lock()
+			err := tlsConn.SetWriteDeadline(time.Now().Add(replyTimeout))
+			if err == nil {
+				err = api.WriteMail(tlsConn, m.Seq, m.Data)
+			}
+			writeMutex.Unlock()
+			if err != nil {
+				s.logger.Debugf("Failed to deliver mail to %s: %v", tlsConn.RemoteAddr().String(), err)
+				tlsConn.Close()
+				return
+			}
+		}
+	}
+}
+
+// discardMail ends the session after an error and drops what the party still sends until it ends the session too,
+// so that the party reads the error instead of a reset connection
+func (s *Server) discardMail(tlsConn *tls.Conn) {
+	if err := tlsConn.CloseWrite(); err != nil {
+		return
+	}
+	if err := tlsConn.SetReadDeadline(time.Now().Add(replyTimeout)); err != nil {
+		return
+	}
+	for {
+		if _, _, err := api.ReadMessage(tlsConn); err != nil {
+			return
+		}
+	}
+}
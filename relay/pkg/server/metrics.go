@@ -0,0 +1,178 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "flock_relay"
+
+// metrics holds the Prometheus collectors of the relay dataplane
+type metrics struct {
+	registry         *prometheus.Registry
+	acceptedConns    prometheus.Counter
+	authFailures     prometheus.Counter
+	timeToPair       prometheus.Histogram
+	sessionDuration  prometheus.Histogram
+	bytesForwarded   *prometheus.CounterVec
+	sessionsFinished *prometheus.CounterVec
+	// userBytesForwarded and quotaRejections account the usage of each user against its quota
+	userBytesForwarded *prometheus.CounterVec
+	quotaRejections    *prometheus.CounterVec
+	// peerClaims counts the claims of parties parked on peer relays, by result
+	peerClaims *prometheus.CounterVec
+	// webhookInvocations counts the invocations of absent parties through the webhook of their user, by result
+	webhookInvocations *prometheus.CounterVec
+}
+
+// userUsageCollector exports the parked rendezvous and paired sessions of every user
+type userUsageCollector struct {
+	s    *Server
+	desc *prometheus.Desc
+}
+
+func (c *userUsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *userUsageCollector) Collect(ch chan<- prometheus.Metric) {
+	for user, usage := range c.s.states.UserUsage() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(usage.Parked), user, "parked")
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(usage.Sessions), user, "paired")
+	}
+}
+
+func newMetrics(s *Server) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		acceptedConns: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "accepted_connections_total",
+			Help:      "Number of TCP connections accepted by the relay.",
+		}),
+		authFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "auth_failures_total",
+			Help:      "Number of parties whose auth request was rejected or could not be read.",
+		}),
+		timeToPair: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "time_to_pair_seconds",
+			Help:      "Time a party was parked before its peer arrived.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+		}),
+		sessionDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "session_duration_seconds",
+			Help:      "Duration of forwarded sessions between paired parties.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+		}),
+		bytesForwarded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "forwarded_bytes_total",
+			Help:      "Bytes forwarded between paired parties, by direction relative to the party that completed the pair.",
+		}, []string{"direction"}),
+		sessionsFinished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sessions_finished_total",
+			Help:      "Number of forwarded sessions that have ended, by end reason.",
+		}, []string{"reason"}),
+		userBytesForwarded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "user_forwarded_bytes_total",
+			Help:      "Bytes forwarded in both directions by the sessions of each user.",
+		}, []string{"user"}),
+		quotaRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "quota_rejections_total",
+			Help:      "Number of rendezvous rejected because the user or the party reached a limit of its quota.",
+		}, []string{"limit"}),
+		peerClaims: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "peer_claims_total",
+			Help:      "Number of parties claimed from peer relays, by result (paired, not_parked or failed).",
+		}, []string{"result"}),
+		webhookInvocations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "webhook_invocations_total",
+			Help:      "Number of invocations of absent parties through the webhook of their user, by result (delivered, abandoned or failed).",
+		}, []string{"result"}),
+	}
+
+	handshakeFailures := func(reason string, value func() float64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "handshake_failures_total",
+			Help:        "Number of connections that did not complete the relay TLS handshake.",
+			ConstLabels: prometheus.Labels{"reason": reason},
+		}, value)
+	}
+	sessions := func(state string, value func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace:   metricsNamespace,
+			Name:        "sessions",
+			Help:        "Number of rendezvous entries, parked waiting for a peer or paired and forwarding.",
+			ConstLabels: prometheus.Labels{"state": state},
+		}, value)
+	}
+
+	m.registry.MustRegister(
+		m.acceptedConns,
+		m.authFailures,
+		m.timeToPair,
+		m.sessionDuration,
+		m.bytesForwarded,
+		m.sessionsFinished,
+		m.userBytesForwarded,
+		m.quotaRejections,
+		m.peerClaims,
+		m.webhookInvocations,
+		&userUsageCollector{s: s, desc: prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", "user_sessions"),
+			"Number of rendezvous of each user, parked waiting for a peer or paired and forwarding.", []string{"user", "state"}, nil)},
+		handshakeFailures("rejected", func() float64 { return float64(s.hsStats.rejected.Load()) }),
+		handshakeFailures("timeout", func() float64 { return float64(s.hsStats.timedOut.Load()) }),
+		handshakeFailures("failed", func() float64 { return float64(s.hsStats.failed.Load()) }),
+		sessions("parked", func() float64 { return float64(s.states.Parked()) }),
+		sessions("paired", func() float64 { return float64(s.states.Paired()) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "mailbox_messages",
+			Help:      "Number of messages buffered in the mailboxes.",
+		}, func() float64 {
+			messages, _ := s.mailboxUsage()
+			return float64(messages)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "mailbox_bytes",
+			Help:      "Bytes of the messages buffered in the mailboxes.",
+		}, func() float64 {
+			_, bytes := s.mailboxUsage()
+			return float64(bytes)
+		}),
+	)
+	return m
+}
+
+// StartMetricsServer serves the relay Prometheus metrics over HTTP at /metrics on address, host:port
+func (s *Server) StartMetricsServer(address string) error {
+	s.logger.Infof("Relay metrics server starting at %s.", address)
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+	return http.ListenAndServe(address, mux)
+}
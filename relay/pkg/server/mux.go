@@ -0,0 +1,187 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/mux"
+	"github.com/flock-org/flock/relay/pkg/store"
+)
+
+// serveMux keeps the connection of a party as a multiplexed session. Each stream the party opens is a
+// rendezvous of its own, or the join of a group, paired with a connection or a stream of its peer and
+// forwarded over the session.
+func (s *Server) serveMux(user, srcParty string, tlsConn *tls.Conn) error {
+	if err := s.sendMessage(tlsConn, api.MsgMux, api.Mux{MaxStreams: mux.DefaultMaxStreams, Window: mux.DefaultWindow}); err != nil {
+		return err
+	}
+	s.logger.Infof("Multiplexed session of %s/%s started", user, srcParty)
+	go s.acceptStreams(user, srcParty, mux.Server(tlsConn, mux.DefaultMaxStreams))
+	return nil
+}
+
+// muxSessions tracks the multiplexed sessions of the relay, which Drain closes
+type muxSessions struct {
+	mutex    sync.Mutex
+	sessions map[*mux.Session]struct{}
+	closed   bool
+}
+
+// add tracks a session, it reports false once the sessions are closed
+func (m *muxSessions) add(session *mux.Session) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return false
+	}
+	if m.sessions == nil {
+		m.sessions = make(map[*mux.Session]struct{})
+	}
+	m.sessions[session] = struct{}{}
+	return true
+}
+
+func (m *muxSessions) remove(session *mux.Session) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.sessions, session)
+}
+
+// close refuses new sessions and returns the sessions tracked
+func (m *muxSessions) close() []*mux.Session {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.closed = true
+	sessions := make([]*mux.Session, 0, len(m.sessions))
+	for session := range m.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// closeMuxSessions closes the multiplexed sessions of the relay, and those started later on
+func (s *Server) closeMuxSessions() {
+	var wg sync.WaitGroup
+	for _, session := range s.muxes.close() {
+		wg.Add(1)
+		go func(session *mux.Session) {
+			defer wg.Done()
+			session.Close()
+		}(session)
+	}
+	wg.Wait()
+}
+
+// acceptStreams serves the streams of a multiplexed session until its connection ends, which fails its streams
+func (s *Server) acceptStreams(user, srcParty string, session *mux.Session) {
+	defer session.Close()
+	if !s.muxes.add(session) {
+		s.logger.Infof("Multiplexed session of %s/%s refused, the relay is shutting down", user, srcParty)
+		return
+	}
+	defer s.muxes.remove(session)
+	go s.superviseMux(user, srcParty, session)
+	for {
+		stream, request, err := session.Accept()
+		if err != nil {
+			s.logger.Infof("Multiplexed session of %s/%s ended: %v", user, srcParty, err)
+			return
+		}
+		go s.openStream(user, srcParty, stream, request)
+	}
+}
+
+// superviseMux closes a multiplexed session once it had no open stream for the idle timeout, or once it reached
+// the maximum session lifetime. The streams it carries are held to both limits by their own forwarders.
+func (s *Server) superviseMux(user, srcParty string, session *mux.Session) {
+	var lifetime, idle <-chan time.Time
+	if s.opts.MaxSessionLifetime > 0 {
+		timer := time.NewTimer(s.opts.MaxSessionLifetime)
+		defer timer.Stop()
+		lifetime = timer.C
+	}
+	if s.opts.IdleTimeout > 0 {
+		ticker := time.NewTicker(s.opts.IdleTimeout / idleChecksPerTimeout)
+		defer ticker.Stop()
+		idle = ticker.C
+	}
+	lastActive := time.Now()
+	for {
+		var reason EndReason
+		select {
+		case <-session.Done():
+			return
+		case <-lifetime:
+			reason = EndLifetime
+		case now := <-idle:
+			if session.NumStreams() > 0 {
+				lastActive = now
+				continue
+			}
+			if now.Sub(lastActive) < s.opts.IdleTimeout {
+				continue
+			}
+			reason = EndIdle
+		}
+		s.logger.Infof("Closing multiplexed session of %s/%s, reason: %s", user, srcParty, reason)
+		session.Close()
+		return
+	}
+}
+
+// openStream runs the rendezvous or the group join requested by the AuthReq a party sent on a new stream
+func (s *Server) openStream(user, srcParty string, stream *mux.Stream, request []byte) {
+	now := time.Now()
+	ep := &store.Endpoint{User: user, SrcParty: srcParty, Conn: stream, Stream: stream, Since: now, Deadline: now.Add(s.opts.RendezvousTimeout)}
+	authReq := &api.AuthReq{}
+	t, payload, err := api.ReadMessage(bytes.NewReader(request))
+	if err == nil {
+		err = api.DecodeMessage(t, payload, api.MsgAuthReq, authReq)
+	}
+	if err == nil && (authReq.Mux || authReq.Mailbox) {
+		err = &api.Error{Code: api.ErrBadRequest, Message: "a stream pairs with a peer, it cannot be a mailbox or a multiplexed session"}
+	}
+	// The policy applies to each pair of a group once its members are known
+	if err == nil && authReq.Group == nil && s.opts.Policy != nil {
+		if denial := s.opts.Policy.Authorize(user, srcParty, authReq.DestParty, authReq.Tag); denial != nil {
+			err = denial
+		}
+	}
+	if err != nil {
+		relayErr := &api.Error{}
+		if !errors.As(err, &relayErr) {
+			relayErr = &api.Error{Code: api.ErrBadRequest, Message: err.Error()}
+		}
+		s.metrics.authFailures.Inc()
+		s.logger.Errorf("Failed to authorize stream %d of %s/%s; %v", stream.ID(), user, srcParty, relayErr)
+		s.closeParked(ep, relayErr)
+		return
+	}
+	if authReq.Group != nil {
+		err = s.joinGroup(user, srcParty, authReq.Group, ep)
+	} else {
+		err = s.rendezvous(user, srcParty, authReq, ep)
+	}
+	if err != nil {
+		s.metrics.authFailures.Inc()
+		closeEndpoint(ep)
+		s.logger.Errorf("Failed to pair stream %d of %s/%s; %v", stream.ID(), user, srcParty, err)
+	}
+}
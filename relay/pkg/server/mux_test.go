@@ -0,0 +1,88 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/mux"
+)
+
+// startMux starts a multiplexed session of party 0 of user1 on s, and returns its client side
+func startMux(t *testing.T, s *Server) *mux.Session {
+	c, r := net.Pipe()
+	client := mux.Client(c)
+	t.Cleanup(func() { client.Close() })
+	go s.acceptStreams("user1", "0", mux.Server(r, 0))
+	return client
+}
+
+// parkStream opens a stream of session that parks waiting for party 1
+func parkStream(t *testing.T, session *mux.Session) {
+	var req bytes.Buffer
+	if err := api.WriteMessage(&req, api.MsgAuthReq, api.AuthReq{DestParty: "1", Tag: "tag"}); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := session.Open(req.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.ReadControl(); err != nil {
+		t.Fatalf("expected the stream to be parked: %v", err)
+	}
+}
+
+// awaitClosed fails the test unless session is closed within timeout
+func awaitClosed(t *testing.T, session *mux.Session, timeout time.Duration) {
+	select {
+	case <-session.Done():
+	case <-time.After(timeout):
+		t.Fatal("expected the multiplexed session to be closed")
+	}
+}
+
+func TestMuxIdleTimeout(t *testing.T) {
+	s := NewRelay(nil, Options{IdleTimeout: 200 * time.Millisecond})
+	busy, idle := startMux(t, s), startMux(t, s)
+	parkStream(t, busy)
+	awaitClosed(t, idle, 2*time.Second)
+	// A session with an open stream is not idle
+	if busy.Err() != nil {
+		t.Fatalf("expected the session of an open stream to stay open: %v", busy.Err())
+	}
+}
+
+func TestMuxLifetime(t *testing.T) {
+	s := NewRelay(nil, Options{MaxSessionLifetime: 200 * time.Millisecond})
+	client := startMux(t, s)
+	parkStream(t, client)
+	awaitClosed(t, client, 2*time.Second)
+}
+
+func TestDrainClosesMux(t *testing.T) {
+	s := NewRelay(nil, Options{})
+	client := startMux(t, s)
+	// The parked stream ensures the session is tracked before the drain
+	parkStream(t, client)
+	s.Drain()
+	awaitClosed(t, client, 2*time.Second)
+
+	// A session started once the relay drained is refused
+	awaitClosed(t, startMux(t, s), 2*time.Second)
+}
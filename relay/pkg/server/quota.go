@@ -0,0 +1,144 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+)
+
+// bandwidthLimiters holds the token buckets shared by all the sessions of a user and of a party. A bucket
+// is evicted once the last session using it ends, so idle users and parties hold no bucket.
+type bandwidthLimiters struct {
+	mutex   sync.Mutex
+	users   map[string]*bucket // User -> bucket of the user
+	parties map[string]*bucket // User/Party -> bucket of the party
+}
+
+// bucket is a token bucket with the number of forwarded sessions it limits
+type bucket struct {
+	limiter  *rate.Limiter
+	sessions int
+}
+
+// acquire returns the bucket of key in m refilled at bytesPerSec for one more session, or nil when the
+// bandwidth is unlimited
+func acquire(m map[string]*bucket, key string, bytesPerSec int64) *rate.Limiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+	// A burst of one second of traffic, so a chunk never waits for more than a second of tokens
+	limit, burst := rate.Limit(bytesPerSec), int(bytesPerSec)
+	b, ok := m[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(limit, burst)}
+		m[key] = b
+	} else if b.limiter.Limit() != limit {
+		// The quota changed, running sessions pick up the new rate
+		b.limiter.SetLimit(limit)
+		b.limiter.SetBurst(burst)
+	}
+	b.sessions++
+	return b.limiter
+}
+
+// release gives back the bucket of key in m if it is one of limiters, evicting it once no session uses it
+func release(m map[string]*bucket, key string, limiters []*rate.Limiter) {
+	b, ok := m[key]
+	if !ok {
+		return
+	}
+	for _, l := range limiters {
+		if l == b.limiter {
+			b.sessions--
+			if b.sessions <= 0 {
+				delete(m, key)
+			}
+			return
+		}
+	}
+}
+
+// get returns the buckets limiting the traffic sent by party of user under quota, which the session
+// gives back with put once it ends
+func (b *bandwidthLimiters) get(user, party string, quota api.Quota) []*rate.Limiter {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	var limiters []*rate.Limiter
+	if l := acquire(b.users, user, quota.Bandwidth); l != nil {
+		limiters = append(limiters, l)
+	}
+	if l := acquire(b.parties, user+"/"+party, quota.PartyBandwidth); l != nil {
+		limiters = append(limiters, l)
+	}
+	return limiters
+}
+
+// put gives back the buckets get returned for a session of party of user
+func (b *bandwidthLimiters) put(user, party string, limiters []*rate.Limiter) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	release(b.users, user, limiters)
+	release(b.parties, user+"/"+party, limiters)
+}
+
+// throttledWriter writes to w no faster than every one of its limiters allows
+type throttledWriter struct {
+	w        io.Writer
+	limiters []*rate.Limiter
+}
+
+func (t throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		for _, l := range t.limiters {
+			if burst := l.Burst(); burst > 0 && len(chunk) > burst {
+				chunk = chunk[:burst]
+			}
+		}
+		for _, l := range t.limiters {
+			if err := l.WaitN(context.Background(), len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// quota returns the quota of user, which is unlimited without a policy
+func (s *Server) quota(user string) api.Quota {
+	if s.opts.Policy == nil {
+		return api.Quota{}
+	}
+	return s.opts.Policy.Quota(user)
+}
+
+func newBandwidthLimiters() *bandwidthLimiters {
+	return &bandwidthLimiters{
+		users:   make(map[string]*bucket),
+		parties: make(map[string]*bucket),
+	}
+}
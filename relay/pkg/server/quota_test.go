@@ -0,0 +1,69 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+)
+
+func TestBandwidthLimitersEviction(t *testing.T) {
+	b := newBandwidthLimiters()
+	quota := api.Quota{Bandwidth: 1000, PartyBandwidth: 100}
+
+	l1 := b.get("user1", "0", quota)
+	l2 := b.get("user1", "1", quota)
+	if len(l1) != 2 || len(l2) != 2 {
+		t.Fatalf("expected a user and a party bucket per session, got %d and %d", len(l1), len(l2))
+	}
+	if l1[0] != l2[0] {
+		t.Fatal("the parties of a user must share the bucket of the user")
+	}
+	if len(b.users) != 1 || len(b.parties) != 2 {
+		t.Fatalf("expected 1 user and 2 party buckets, got %d and %d", len(b.users), len(b.parties))
+	}
+
+	b.put("user1", "0", l1)
+	if len(b.users) != 1 || len(b.parties) != 1 {
+		t.Fatalf("expected the bucket of party 0 only to be evicted, got %d user and %d party buckets", len(b.users), len(b.parties))
+	}
+	b.put("user1", "1", l2)
+	if len(b.users) != 0 || len(b.parties) != 0 {
+		t.Fatalf("expected every bucket to be evicted, got %d user and %d party buckets", len(b.users), len(b.parties))
+	}
+
+	if l := b.get("user1", "0", api.Quota{}); len(l) != 0 || len(b.users) != 0 || len(b.parties) != 0 {
+		t.Fatal("an unlimited quota must not create buckets")
+	}
+}
+
+func TestBandwidthLimitersQuotaChange(t *testing.T) {
+	b := newBandwidthLimiters()
+	old := b.get("user1", "0", api.Quota{Bandwidth: 1000})
+	// A session started while the user is unlimited takes no bucket
+	b.get("user1", "1", api.Quota{})
+	current := b.get("user1", "1", api.Quota{Bandwidth: 2000})
+	if old[0] != current[0] {
+		t.Fatal("a session must share the bucket of the running sessions of its user")
+	}
+	if current[0].Limit() != 2000 {
+		t.Fatalf("expected the bucket to pick up the new rate, got %v", current[0].Limit())
+	}
+	b.put("user1", "0", old)
+	b.put("user1", "1", current)
+	if len(b.users) != 0 {
+		t.Fatalf("expected the bucket of the user to be evicted, got %d", len(b.users))
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/store"
+)
+
+// ReapRendezvous periodically evicts parties whose peer did not arrive before the rendezvous deadline,
+// and drops the expired mailbox messages, until ctx is done
+func (s *Server) ReapRendezvous(ctx context.Context) {
+	interval := s.opts.RendezvousTimeout / 4
+	if s.mailboxes != nil && s.opts.MailboxTTL/4 < interval {
+		interval = s.opts.MailboxTTL / 4
+	}
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, r := range s.states.EvictExpired(now) {
+				s.evict(r)
+			}
+			if s.mailboxes != nil {
+				if expired := s.mailboxes.Expire(now); expired > 0 {
+					s.logger.Infof("Dropped %d mailbox messages after %v", expired, s.opts.MailboxTTL)
+				}
+			}
+		}
+	}
+}
+
+// evict notifies a parked party that its peer did not arrive and closes its connections
+func (s *Server) evict(r *store.Endpoint) {
+	if r.Group {
+		s.logger.Infof("Group %s/%s did not complete within %v, evicting member %d (%s)", r.User, r.Tag, s.opts.RendezvousTimeout, r.Index, r.SrcParty)
+		s.closeParked(r, &api.Error{
+			Code:    api.ErrPeerTimeout,
+			Message: fmt.Sprintf("group %s did not complete within %v, member %d did not connect to member %d", r.Tag, s.opts.RendezvousTimeout, r.Index, r.PeerIndex),
+		})
+		return
+	}
+	s.logger.Infof("Peer %s did not arrive for %s/%s (%s) within %v, evicting", r.DstParty, r.User, r.SrcParty, r.Tag, s.opts.RendezvousTimeout)
+	s.closeParked(r, &api.Error{
+		Code:    api.ErrPeerTimeout,
+		Message: fmt.Sprintf("peer %s did not arrive within %v", r.DstParty, s.opts.RendezvousTimeout),
+	})
+}
+
+// closeParked sends relayErr to a party removed from the parked set and closes its connections
+func (s *Server) closeParked(r *store.Endpoint, relayErr *api.Error) {
+	if r.TLSConn != nil || r.Stream != nil {
+		r.CtrlMutex.Lock()
+		if err := s.sendControl(r, api.MsgError, relayErr); err != nil {
+			s.logger.Debugf("Failed to send error to %s/%s: %v", r.User, r.SrcParty, err)
+		}
+		r.CtrlMutex.Unlock()
+	}
+	closeEndpoint(r)
+}
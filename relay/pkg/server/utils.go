@@ -14,24 +14,65 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net"
+	"sync/atomic"
 
-	"github.com/praveingk/openssl"
+	"github.com/flock-org/flock/relay/config"
 )
 
+// handoverConn is the TCP connection under the relay TLS session of a party. Once exact is set it
+// reads a byte at a time, so the TLS session never consumes bytes past its last record.
+type handoverConn struct {
+	net.Conn
+	exact atomic.Bool
+}
+
+func (c *handoverConn) Read(b []byte) (int, error) {
+	if c.exact.Load() && len(b) > 1 {
+		b = b[:1]
+	}
+	return c.Conn.Read(b)
+}
+
+// peerCertificate returns the verified X509 certificate of the party
+func peerCertificate(tlsConn *tls.Conn) (*x509.Certificate, error) {
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("unable to get certificates: no peer certificate")
+	}
+	return certs[0], nil
+}
+
 // getPartyName returns the Common Name from the X509 certificate
-func getPartyName(tlsConn *openssl.Conn) (string, error) {
-	cert, err := tlsConn.PeerCertificate()
+func getPartyName(tlsConn *tls.Conn) (string, error) {
+	cert, err := peerCertificate(tlsConn)
 	if err != nil {
-		return "", fmt.Errorf("unable to get certificates: %v", err)
+		return "", err
+	}
+	if cert.Subject.CommonName == "" {
+		return "", fmt.Errorf("unable to get CommonName")
 	}
-	subjName, err := cert.GetSubjectName()
+	return cert.Subject.CommonName, nil
+}
+
+// getUserName returns the user domain of a party, carried as the Organizational Unit of its X509 certificate
+func getUserName(tlsConn *tls.Conn) (string, error) {
+	cert, err := peerCertificate(tlsConn)
 	if err != nil {
-		return "", fmt.Errorf("unable to get subject name: %v", err)
+		return "", err
 	}
-	party, ok := subjName.GetEntry(openssl.NID_commonName)
-	if !ok {
-		return "", fmt.Errorf("unable to get CommonName :%v", err)
+	if len(cert.Subject.OrganizationalUnit) == 0 || cert.Subject.OrganizationalUnit[0] == "" {
+		return "", fmt.Errorf("certificate carries no user domain, re-create the party with fr-adm")
 	}
-	return party, nil
+	return cert.Subject.OrganizationalUnit[0], nil
+}
+
+// isRelayCertificate reports whether cert identifies a relay rather than a party: its Common Name is the relay
+// server name and its Organizational Unit, which carries the user domain of parties, is the name reserved for the relay
+func isRelayCertificate(cert *x509.Certificate) bool {
+	ou := cert.Subject.OrganizationalUnit
+	return cert.Subject.CommonName == config.FlockrelayServerName && len(ou) == 1 && ou[0] == config.FlockrelayServerName
 }
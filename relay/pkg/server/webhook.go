@@ -0,0 +1,73 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/store"
+	"github.com/flock-org/flock/relay/pkg/webhook"
+)
+
+// invokePeer asks the webhook of the user of a parked party to start the peer it waits for, unless the peer
+// is already connected to this relay or parked on a peer relay
+func (s *Server) invokePeer(ep *store.Endpoint) {
+	if s.opts.Policy == nil {
+		return
+	}
+	hook, ok := s.opts.Policy.Webhook(ep.User)
+	if !ok || !s.isParked(ep) || s.connected(ep.User, ep.DstParty) {
+		return
+	}
+	if s.federation != nil && s.federation.lookup(ep.User, ep.SrcParty, ep.DstParty, ep.Tag) != "" {
+		return
+	}
+	go s.invoke(hook, ep)
+}
+
+// invoke delivers the invocation of the peer of a parked party until the party is no longer parked
+func (s *Server) invoke(hook api.Webhook, ep *store.Endpoint) {
+	inv := api.Invocation{User: ep.User, Party: ep.DstParty, Requester: ep.SrcParty, Tag: ep.Tag, Deadline: ep.Deadline}
+	ctx, cancel := context.WithDeadline(context.Background(), ep.Deadline)
+	defer cancel()
+	attempts, err := s.opts.Webhooks.Invoke(ctx, hook, inv, func() bool { return s.isParked(ep) })
+	switch {
+	case err == nil:
+		s.logger.Infof("Invoked %s/%s for %s(%s) after %d attempts", ep.User, ep.DstParty, ep.SrcParty, ep.Tag, attempts)
+		s.metrics.webhookInvocations.WithLabelValues("delivered").Inc()
+	case errors.Is(err, webhook.ErrAbandoned):
+		s.logger.Debugf("Invocation of %s/%s for %s(%s) abandoned after %d attempts, the rendezvous ended", ep.User, ep.DstParty, ep.SrcParty, ep.Tag, attempts)
+		s.metrics.webhookInvocations.WithLabelValues("abandoned").Inc()
+	default:
+		s.logger.Errorf("Failed to invoke %s/%s for %s(%s) after %d attempts: %v", ep.User, ep.DstParty, ep.SrcParty, ep.Tag, attempts, err)
+		s.metrics.webhookInvocations.WithLabelValues("failed").Inc()
+	}
+}
+
+// isParked reports whether a party still waits for its peer
+func (s *Server) isParked(ep *store.Endpoint) bool {
+	for _, parked := range s.states.ParkedEndpoints(ep.User, ep.SrcParty, ep.DstParty, ep.Tag) {
+		if parked == ep {
+			return true
+		}
+	}
+	return false
+}
+
+// connected reports whether a party of user is parked or paired on this relay
+func (s *Server) connected(user, party string) bool {
+	return len(s.states.ParkedEndpoints(user, party, "", "")) > 0 || len(s.states.PairedEndpoints(user, party, "", "")) > 0
+}
@@ -0,0 +1,31 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net"
+
+	"github.com/flock-org/flock/relay/pkg/websocket"
+)
+
+// listenAddress opens the listener of a listen address. A ws:// or wss:// URL accepts the parties behind an
+// HTTP-only ingress as WebSocket upgrades on its path; their connections then carry the same relay TLS session,
+// control protocol and E2E session as a TCP connection. A wss:// listener serves the relay certificate itself,
+// a ws:// listener is meant for an ingress terminating HTTPS in front of the relay.
+func (s *Server) listenAddress(address string) (net.Listener, error) {
+	if websocket.IsURL(address) {
+		return websocket.Listen(address, s.opts.Credentials.WebConfig())
+	}
+	return listen(address)
+}
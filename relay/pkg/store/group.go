@@ -0,0 +1,173 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+)
+
+// MaxGroupSize bounds the members of a group rendezvous
+const MaxGroupSize = 32
+
+// ErrGroupMismatch is returned by JoinGroup when a join does not agree with the members that already joined
+var ErrGroupMismatch = errors.New("group join does not match the group")
+
+// group gathers the endpoints of the members of a group rendezvous until every member has one to every other member
+type group struct {
+	size     int
+	deadline time.Time
+	members  map[int]string       // Index -> Party of the member
+	conns    map[[2]int]*Endpoint // Index, peer index -> Endpoint of the member to its peer
+	parked   map[int]int          // Index -> Number of endpoints of the member parked
+}
+
+func getGroupKey(user, id string) string {
+	return user + "/" + id
+}
+
+// JoinGroup parks ep, the connection of srcParty as member index of group id to the member peer of the group.
+// A group has size members, indexed from 0, and a single deadline set when its first member joins.
+// Once every member has a connection to every other member, the group is removed and its endpoints are returned
+// paired: the endpoint of member i to member j is paired with the endpoint of member j to member i, keyed by the
+// lower index, and its DstParty is set to the party of its peer. When the pairs exceed the quota of the user,
+// the endpoints are returned with the *QuotaError. A nil result with a nil error means ep was parked.
+// A member counts once against the parked quotas, however many of its endpoints are parked.
+func (s *State) JoinGroup(user, srcParty, id string, index, peer, size int, ep *Endpoint, quota api.Quota) ([]*Endpoint, error) {
+	if size < 2 || size > MaxGroupSize {
+		return nil, fmt.Errorf("%w: a group has 2 to %d members, not %d", ErrGroupMismatch, MaxGroupSize, size)
+	}
+	if index < 0 || index >= size || peer < 0 || peer >= size || index == peer {
+		return nil, fmt.Errorf("%w: member %d cannot connect to member %d of a group of %d", ErrGroupMismatch, index, peer, size)
+	}
+	ep.User, ep.SrcParty, ep.DstParty, ep.Tag = user, srcParty, "", id
+	ep.Group, ep.Index, ep.PeerIndex = true, index, peer
+	key := getGroupKey(user, id)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	g, exists := s.groups[key]
+	if !exists {
+		g = &group{size: size, deadline: ep.Deadline, members: make(map[int]string), conns: make(map[[2]int]*Endpoint), parked: make(map[int]int)}
+	}
+	if g.size != size {
+		return nil, fmt.Errorf("%w: group %s has %d members, not %d", ErrGroupMismatch, id, g.size, size)
+	}
+	if party, ok := g.members[index]; ok && party != srcParty {
+		return nil, fmt.Errorf("%w: member %d of group %s is %s", ErrGroupMismatch, index, id, party)
+	}
+	for i, party := range g.members {
+		if party == srcParty && i != index {
+			return nil, fmt.Errorf("%w: %s is member %d of group %s", ErrGroupMismatch, srcParty, i, id)
+		}
+	}
+	if _, ok := g.conns[[2]int{index, peer}]; ok {
+		return nil, fmt.Errorf("member %d of group %s already waits for member %d", index, id, peer)
+	}
+	partyKey := getPartyKey(user, srcParty)
+	if g.parked[index] == 0 {
+		if err := checkQuota(s.users[user].parked(), quota.MaxParked, "user_parked", "user "+user); err != nil {
+			return nil, err
+		}
+		if err := checkQuota(s.parties[partyKey].parked(), quota.MaxPartyParked, "party_parked", "party "+partyKey); err != nil {
+			return nil, err
+		}
+		adjust(s.users, user, 1, 0)
+		adjust(s.parties, partyKey, 1, 0)
+	}
+	s.groups[key] = g
+	ep.Deadline = g.deadline
+	g.members[index] = srcParty
+	g.conns[[2]int{index, peer}] = ep
+	g.parked[index]++
+	if len(g.conns) < size*(size-1) {
+		return nil, nil
+	}
+
+	delete(s.groups, key)
+	endpoints := make([]*Endpoint, 0, len(g.conns))
+	for seat, member := range g.conns {
+		member.DstParty = g.members[seat[1]]
+		if seat[1] == (seat[0]+1)%size {
+			// Once per member
+			s.unparked(member)
+		}
+		endpoints = append(endpoints, member)
+	}
+	var paired []string
+	for seat, member := range g.conns {
+		if seat[0] > seat[1] {
+			continue
+		}
+		pairKey := getKey(user, member.SrcParty, member.DstParty, id)
+		if err := s.pair(pairKey, member, g.conns[[2]int{seat[1], seat[0]}], quota); err != nil {
+			for _, k := range paired {
+				s.release(k)
+			}
+			return endpoints, err
+		}
+		paired = append(paired, pairKey)
+	}
+	return endpoints, nil
+}
+
+// parkedGroupEndpoints returns the endpoints of the groups waiting for members that match the filters
+func (s *State) parkedGroupEndpoints(user, srcParty, dstParty, tag string) []*Endpoint {
+	var parked []*Endpoint
+	for _, g := range s.groups {
+		for _, ep := range g.conns {
+			if ep.matches(user, srcParty, dstParty, tag) {
+				parked = append(parked, ep)
+			}
+		}
+	}
+	return parked
+}
+
+// groupEndpoints returns the number of endpoints of the groups waiting for members
+func (s *State) groupEndpoints() int {
+	n := 0
+	for _, g := range s.groups {
+		n += len(g.conns)
+	}
+	return n
+}
+
+// unparkGroupEndpoints removes and returns the endpoints of the groups waiting for members that match remove.
+// A group is dropped once none of its endpoints is left.
+func (s *State) unparkGroupEndpoints(remove func(*Endpoint) bool) []*Endpoint {
+	var removed []*Endpoint
+	for key, g := range s.groups {
+		for seat, ep := range g.conns {
+			if remove(ep) {
+				removed = append(removed, ep)
+				delete(g.conns, seat)
+				if g.parked[seat[0]]--; g.parked[seat[0]] == 0 {
+					delete(g.parked, seat[0])
+					s.unparked(ep)
+				}
+			}
+		}
+		if len(g.conns) == 0 {
+			delete(s.groups, key)
+		}
+	}
+	return removed
+}
@@ -14,107 +14,447 @@
 package store
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/praveingk/openssl"
+	"github.com/flock-org/flock/relay/pkg/api"
+	"github.com/flock-org/flock/relay/pkg/mux"
 )
 
+// Endpoint is a party's connection to the relay, the TCP socket together with the TLS session on top of it
+type Endpoint struct {
+	User     string
+	SrcParty string
+	DstParty string
+	Tag      string
+	Conn     net.Conn
+	TLSConn  *tls.Conn
+	// Stream is set for the stream of a multiplexed connection, which is then Conn, and TLSConn is nil
+	Stream *mux.Stream
+	// Since is the time the endpoint arrived at the relay
+	Since time.Time
+	// Deadline is the time by which the peer must arrive while the endpoint is parked
+	Deadline time.Time
+	// PairedAt is the time the endpoint met its peer
+	PairedAt time.Time
+	// Forwarded counts the bytes forwarded from this endpoint to its peer
+	Forwarded atomic.Int64
+	// Terminated is set when an operator ends the session of the endpoint
+	Terminated atomic.Bool
+	// Relay is the address of the peer relay the party is connected to, empty for the parties of this relay.
+	// Conn and TLSConn of such an endpoint are the tunnel to the peer relay.
+	Relay string
+	// Group marks the endpoints of a group rendezvous, whose Tag is the group id. Index and PeerIndex are the
+	// indexes of the member and of the member it connects to, its DstParty is only set once the group completes.
+	Group            bool
+	Index, PeerIndex int
+
+	// CtrlMutex serializes the control messages written to TLSConn or Stream by the parked party and its peer
+	CtrlMutex sync.Mutex
+	// Paired is set, under CtrlMutex, once the peer has taken over the control session
+	Paired bool
+}
+
+// pair is a matched rendezvous whose endpoints are being forwarded
+type pair struct {
+	endpoint *Endpoint
+	peer     *Endpoint
+}
+
+// Usage counts the parked rendezvous and the paired sessions of a user or a party
+type Usage struct {
+	Parked   int
+	Sessions int
+}
+
+// QuotaError is returned by Rendezvous when the user or a party has reached a limit of the user quota
+type QuotaError struct {
+	// Limit names the limit that was reached, e.g. user_sessions or party_parked
+	Limit   string
+	Max     int
+	Subject string
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s has reached its quota of %d (%s)", e.Subject, e.Max, e.Limit)
+}
+
+// ErrClosed is returned by Rendezvous once the relay is shutting down
+var ErrClosed = errors.New("the relay is shutting down")
+
+// ErrNotParked is returned by Claim when the claimed party is not parked
+var ErrNotParked = errors.New("the party is not parked")
+
 // State stores all the connection states in the store
 type State struct {
-	tlsMutex  sync.RWMutex
-	openMutex sync.RWMutex
-	openConns map[string]net.Conn      // SrcParty:DstParty -> Sockets mapping
-	tlsConns  map[string]*openssl.Conn // SrcParty -> Open TLS connections
+	mutex sync.Mutex
+	// closed is set when the relay shuts down, after which no party is parked or paired
+	closed  bool
+	parked  map[string]*Endpoint // User/SrcParty:DstParty:Tag -> Party waiting for its peer
+	active  map[string]*pair     // User/SrcParty:DstParty:Tag -> Paired parties, keyed by the party that completed the pair
+	users   map[string]*Usage    // User -> Usage of the user
+	parties map[string]*Usage    // User/Party -> Usage of the party
+	groups  map[string]*group    // User/Group -> Group waiting for its members
+}
+
+func getKey(user, srcParty, dstParty, tag string) string {
+	return user + "/" + srcParty + ":" + dstParty + ":" + tag
 }
 
-var state State
+func getPartyKey(user, party string) string {
+	return user + "/" + party
+}
+
+// adjust adds parked and sessions to the usage entry of key in m, dropping the entry once it is back to zero
+func adjust(m map[string]*Usage, key string, parked, sessions int) {
+	u, ok := m[key]
+	if !ok {
+		u = &Usage{}
+		m[key] = u
+	}
+	u.Parked += parked
+	u.Sessions += sessions
+	if u.Parked == 0 && u.Sessions == 0 {
+		delete(m, key)
+	}
+}
 
-func getKey(srcParty, dstParty, tag string) string {
-	return srcParty + ":" + dstParty + ":" + tag
+// unparked updates the usage of a party removed from the parked set
+func (s *State) unparked(ep *Endpoint) {
+	adjust(s.users, ep.User, -1, 0)
+	adjust(s.parties, getPartyKey(ep.User, ep.SrcParty), -1, 0)
 }
 
-// StoreConnection stores the connection between srcParty->dstParty
-func (s *State) StoreConnection(srcParty string, dstParty string, tag string, conn net.Conn) error {
-	key := getKey(srcParty, dstParty, tag)
-	if _, exists := s.openConns[key]; exists {
-		return fmt.Errorf("connection %s already exists", key)
+// checkQuota returns a *QuotaError when count, the current usage of subject, has reached max; a zero max is unlimited
+func checkQuota(count, max int, limit, subject string) error {
+	if max > 0 && count >= max {
+		return &QuotaError{Limit: limit, Max: max, Subject: subject}
 	}
-	s.openMutex.Lock()
-	s.openConns[key] = conn
-	s.openMutex.Unlock()
 	return nil
 }
 
-// GetConnection gets the connection between srcParty->dstParty
-func (s *State) GetConnection(srcParty, dstParty, tag string) (net.Conn, error) {
-	key := getKey(srcParty, dstParty, tag)
-	s.openMutex.RLock()
-	if conn, exists := s.openConns[key]; exists {
-		s.openMutex.RUnlock()
-		return conn, nil
+// Rendezvous atomically either parks ep as srcParty->dstParty, or, when dstParty is already
+// parked waiting for srcParty, removes it from the parked set and returns it as the peer.
+// A nil peer with a nil error means ep was parked. Parties only meet parties of the same user.
+// Parking or pairing beyond the quota of the user fails with a *QuotaError.
+func (s *State) Rendezvous(user, srcParty, dstParty, tag string, ep *Endpoint, quota api.Quota) (*Endpoint, error) {
+	ep.User, ep.SrcParty, ep.DstParty, ep.Tag = user, srcParty, dstParty, tag
+	key := getKey(user, srcParty, dstParty, tag)
+	peerKey := getKey(user, dstParty, srcParty, tag)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if peer, exists := s.parked[peerKey]; exists {
+		if err := s.pair(key, ep, peer, quota); err != nil {
+			return nil, err
+		}
+		delete(s.parked, peerKey)
+		s.unparked(peer)
+		return peer, nil
+	}
+	if _, exists := s.parked[key]; exists {
+		return nil, fmt.Errorf("connection %s already exists", key)
+	}
+	if err := checkQuota(s.users[user].parked(), quota.MaxParked, "user_parked", "user "+user); err != nil {
+		return nil, err
+	}
+	partyKey := getPartyKey(user, srcParty)
+	if err := checkQuota(s.parties[partyKey].parked(), quota.MaxPartyParked, "party_parked", "party "+partyKey); err != nil {
+		return nil, err
 	}
-	s.openMutex.RUnlock()
-	return nil, fmt.Errorf("no open connections")
+	s.parked[key] = ep
+	adjust(s.users, user, 1, 0)
+	adjust(s.parties, partyKey, 1, 0)
+	return nil, nil
 }
 
-// RemoveConnection gets the original TLS connection of srcParty
-func (s *State) RemoveConnection(srcParty, dstParty, tag string) {
-	key := getKey(srcParty, dstParty, tag)
-	s.openMutex.Lock()
-	delete(s.openConns, key)
-	s.openMutex.Unlock()
+// Claim pairs ep as srcParty->dstParty with dstParty when it is parked waiting for srcParty, and returns it as the peer.
+// Unlike Rendezvous, ep is never parked: ErrNotParked is returned instead.
+func (s *State) Claim(user, srcParty, dstParty, tag string, ep *Endpoint, quota api.Quota) (*Endpoint, error) {
+	ep.User, ep.SrcParty, ep.DstParty, ep.Tag = user, srcParty, dstParty, tag
+	key := getKey(user, srcParty, dstParty, tag)
+	peerKey := getKey(user, dstParty, srcParty, tag)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil, ErrClosed
+	}
+	peer, exists := s.parked[peerKey]
+	if !exists {
+		return nil, ErrNotParked
+	}
+	if err := s.pair(key, ep, peer, quota); err != nil {
+		return nil, err
+	}
+	delete(s.parked, peerKey)
+	s.unparked(peer)
+	return peer, nil
 }
 
-// StoreTLSConnection stores the original TLS connection of srcParty->dstParty
-func (s *State) StoreTLSConnection(srcParty, dstParty, tag string, conn *openssl.Conn) error {
-	key := getKey(srcParty, dstParty, tag)
-	if _, exists := s.tlsConns[key]; exists {
-		return fmt.Errorf("TLS connection already exists")
+// Attach pairs ep as srcParty->dstParty with peer, an endpoint that was not parked on this relay,
+// such as the tunnel to a party claimed on a peer relay
+func (s *State) Attach(user, srcParty, dstParty, tag string, ep, peer *Endpoint, quota api.Quota) error {
+	ep.User, ep.SrcParty, ep.DstParty, ep.Tag = user, srcParty, dstParty, tag
+	peer.User, peer.SrcParty, peer.DstParty, peer.Tag = user, dstParty, srcParty, tag
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrClosed
 	}
-	s.tlsMutex.Lock()
-	s.tlsConns[key] = conn
-	s.tlsMutex.Unlock()
+	return s.pair(getKey(user, srcParty, dstParty, tag), ep, peer, quota)
+}
 
+// pair records ep and peer as the active pair completed by key
+func (s *State) pair(key string, ep, peer *Endpoint, quota api.Quota) error {
+	if _, exists := s.active[key]; exists {
+		return fmt.Errorf("connection %s is already active", key)
+	}
+	if err := s.checkSessions(ep.User, ep.SrcParty, ep.DstParty, quota); err != nil {
+		return err
+	}
+	// A pair is a single session of the user, and a session of each of the two parties
+	adjust(s.users, ep.User, 0, 1)
+	adjust(s.parties, getPartyKey(ep.User, ep.SrcParty), 0, 1)
+	adjust(s.parties, getPartyKey(ep.User, ep.DstParty), 0, 1)
+	now := time.Now()
+	ep.PairedAt, peer.PairedAt = now, now
+	s.active[key] = &pair{endpoint: ep, peer: peer}
 	return nil
 }
 
-// GetTLSConnection gets the original TLS connection of srcParty-> dstParty
-func (s *State) GetTLSConnection(srcParty, dstParty, tag string) (*openssl.Conn, error) {
-	key := getKey(srcParty, dstParty, tag)
-	s.tlsMutex.RLock()
-	if conn, exists := s.tlsConns[key]; exists {
-		s.tlsMutex.RUnlock()
-		return conn, nil
+// AcquireSession counts a session of party that is served by the relay rather than paired, such as a
+// mailbox session, against the session quota of user and of the party. It is given back with ReleaseSession.
+func (s *State) AcquireSession(user, party string, quota api.Quota) error {
+	partyKey := getPartyKey(user, party)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	if err := checkQuota(s.users[user].sessions(), quota.MaxSessions, "user_sessions", "user "+user); err != nil {
+		return err
+	}
+	if err := checkQuota(s.parties[partyKey].sessions(), quota.MaxPartySessions, "party_sessions", "party "+partyKey); err != nil {
+		return err
 	}
-	s.tlsMutex.RUnlock()
-	return nil, fmt.Errorf("Already existing connection from same party")
+	adjust(s.users, user, 0, 1)
+	adjust(s.parties, partyKey, 0, 1)
+	return nil
 }
 
-// RemoveTLSConnection gets the original TLS connection of srcParty
-func (s *State) RemoveTLSConnection(srcParty, dstParty, tag string) {
-	key := getKey(srcParty, dstParty, tag)
-	s.tlsMutex.Lock()
-	delete(s.tlsConns, key)
-	s.tlsMutex.Unlock()
+// ReleaseSession gives back a session acquired with AcquireSession
+func (s *State) ReleaseSession(user, party string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	adjust(s.users, user, 0, -1)
+	adjust(s.parties, getPartyKey(user, party), 0, -1)
+}
+
+// Take removes and returns the endpoint parked as srcParty->dstParty, nil if it is no longer parked
+func (s *State) Take(user, srcParty, dstParty, tag string) *Endpoint {
+	key := getKey(user, srcParty, dstParty, tag)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	ep, exists := s.parked[key]
+	if !exists {
+		return nil
+	}
+	delete(s.parked, key)
+	s.unparked(ep)
+	return ep
+}
+
+// checkSessions checks that pairing srcParty with dstParty keeps user and both parties within quota
+func (s *State) checkSessions(user, srcParty, dstParty string, quota api.Quota) error {
+	if err := checkQuota(s.users[user].sessions(), quota.MaxSessions, "user_sessions", "user "+user); err != nil {
+		return err
+	}
+	for _, party := range []string{srcParty, dstParty} {
+		partyKey := getPartyKey(user, party)
+		if err := checkQuota(s.parties[partyKey].sessions(), quota.MaxPartySessions, "party_sessions", "party "+partyKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *Usage) parked() int {
+	if u == nil {
+		return 0
+	}
+	return u.Parked
+}
+
+func (u *Usage) sessions() int {
+	if u == nil {
+		return 0
+	}
+	return u.Sessions
+}
+
+// Release removes the pair completed by srcParty->dstParty of user once forwarding is over
+func (s *State) Release(user, srcParty, dstParty, tag string) {
+	s.mutex.Lock()
+	s.release(getKey(user, srcParty, dstParty, tag))
+	s.mutex.Unlock()
+}
+
+// release removes the pair completed by key, the mutex must be held
+func (s *State) release(key string) {
+	p, exists := s.active[key]
+	if !exists {
+		return
+	}
+	delete(s.active, key)
+	adjust(s.users, p.endpoint.User, 0, -1)
+	adjust(s.parties, getPartyKey(p.endpoint.User, p.endpoint.SrcParty), 0, -1)
+	adjust(s.parties, getPartyKey(p.endpoint.User, p.endpoint.DstParty), 0, -1)
+}
+
+// EvictExpired removes and returns the parked endpoints whose deadline is before now
+func (s *State) EvictExpired(now time.Time) []*Endpoint {
+	var expired []*Endpoint
+	s.mutex.Lock()
+	for key, ep := range s.parked {
+		if ep.Deadline.IsZero() || ep.Deadline.After(now) {
+			continue
+		}
+		expired = append(expired, ep)
+		delete(s.parked, key)
+		s.unparked(ep)
+	}
+	expired = append(expired, s.unparkGroupEndpoints(func(ep *Endpoint) bool { return !ep.Deadline.After(now) })...)
+	s.mutex.Unlock()
+	return expired
+}
+
+// matches reports whether ep belongs to user and, for the non-empty filters, connects srcParty, dstParty and tag
+func (ep *Endpoint) matches(user, srcParty, dstParty, tag string) bool {
+	return (user == "" || ep.User == user) &&
+		(srcParty == "" || ep.SrcParty == srcParty) &&
+		(dstParty == "" || ep.DstParty == dstParty) &&
+		(tag == "" || ep.Tag == tag)
+}
+
+// Unpark removes and returns the parked endpoints matching the filters, empty filters match any value
+func (s *State) Unpark(user, srcParty, dstParty, tag string) []*Endpoint {
+	var removed []*Endpoint
+	s.mutex.Lock()
+	for key, ep := range s.parked {
+		if ep.matches(user, srcParty, dstParty, tag) {
+			removed = append(removed, ep)
+			delete(s.parked, key)
+			s.unparked(ep)
+		}
+	}
+	removed = append(removed, s.unparkGroupEndpoints(func(ep *Endpoint) bool { return ep.matches(user, srcParty, dstParty, tag) })...)
+	s.mutex.Unlock()
+	return removed
+}
+
+// Close stops parking and pairing parties, and removes and returns the parked endpoints.
+// The paired endpoints are left to finish their forwarding.
+func (s *State) Close() []*Endpoint {
+	var removed []*Endpoint
+	s.mutex.Lock()
+	s.closed = true
+	for key, ep := range s.parked {
+		removed = append(removed, ep)
+		delete(s.parked, key)
+		s.unparked(ep)
+	}
+	removed = append(removed, s.unparkGroupEndpoints(func(*Endpoint) bool { return true })...)
+	s.mutex.Unlock()
+	return removed
+}
+
+// ParkedEndpoints returns the parked endpoints matching the filters, empty filters match any value
+func (s *State) ParkedEndpoints(user, srcParty, dstParty, tag string) []*Endpoint {
+	var parked []*Endpoint
+	s.mutex.Lock()
+	for _, ep := range s.parked {
+		if ep.matches(user, srcParty, dstParty, tag) {
+			parked = append(parked, ep)
+		}
+	}
+	parked = append(parked, s.parkedGroupEndpoints(user, srcParty, dstParty, tag)...)
+	s.mutex.Unlock()
+	return parked
+}
+
+// PairedEndpoints returns the paired endpoints, as endpoint and peer, whose pair matches the filters in either
+// direction, empty filters match any value
+func (s *State) PairedEndpoints(user, srcParty, dstParty, tag string) [][2]*Endpoint {
+	var paired [][2]*Endpoint
+	s.mutex.Lock()
+	for _, p := range s.active {
+		if p.endpoint.matches(user, srcParty, dstParty, tag) || p.peer.matches(user, srcParty, dstParty, tag) {
+			paired = append(paired, [2]*Endpoint{p.endpoint, p.peer})
+		}
+	}
+	s.mutex.Unlock()
+	return paired
 }
 
 // Dump prints the existing open connections
 func (s *State) Dump() {
-	log.Printf("Open Connections : %+v", s.openConns)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	log.Printf("Parked Connections : %+v", s.parked)
+	log.Printf("Active Connections : %+v", s.active)
 }
 
+// Conns returns the number of parties connected to the relay, parked or paired
 func (s *State) Conns() int {
-	return len(s.openConns)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.parked) + s.groupEndpoints() + 2*len(s.active)
+}
+
+// Parked returns the number of parties waiting for their peer
+func (s *State) Parked() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.parked) + s.groupEndpoints()
+}
+
+// Paired returns the number of paired rendezvous being forwarded
+func (s *State) Paired() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.active)
+}
+
+// UserUsage returns a copy of the usage of every user that has parked or paired parties
+func (s *State) UserUsage() map[string]Usage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	usage := make(map[string]Usage, len(s.users))
+	for user, u := range s.users {
+		usage[user] = *u
+	}
+	return usage
 }
 
 // GetState initializes the state
 func GetState() *State {
 	state := &State{
-		openConns: make(map[string]net.Conn),
-		tlsConns:  make(map[string]*openssl.Conn),
+		parked:  make(map[string]*Endpoint),
+		active:  make(map[string]*pair),
+		users:   make(map[string]*Usage),
+		parties: make(map[string]*Usage),
+		groups:  make(map[string]*group),
 	}
 	return state
 }
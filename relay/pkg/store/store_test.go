@@ -0,0 +1,192 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+)
+
+// rendezvousResult is the outcome of a Rendezvous call
+type rendezvousResult struct {
+	ep, peer *Endpoint
+	err      error
+}
+
+// rendezvousPairs runs the Rendezvous of both parties of n tags concurrently
+func rendezvousPairs(s *State, n int, quota api.Quota) []rendezvousResult {
+	results := make([]rendezvousResult, 2*n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		for side, parties := range [][2]string{{"0", "1"}, {"1", "0"}} {
+			wg.Add(1)
+			go func(slot int, src, dst, tag string) {
+				defer wg.Done()
+				ep := &Endpoint{}
+				peer, err := s.Rendezvous("user1", src, dst, tag, ep, quota)
+				results[slot] = rendezvousResult{ep: ep, peer: peer, err: err}
+			}(2*i+side, parties[0], parties[1], fmt.Sprintf("tag-%d", i))
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+func TestRendezvousRace(t *testing.T) {
+	s := GetState()
+	const n = 200
+	results := rendezvousPairs(s, n, api.Quota{})
+	for i := 0; i < n; i++ {
+		a, b := results[2*i], results[2*i+1]
+		if a.err != nil || b.err != nil {
+			t.Fatalf("tag-%d: %v, %v", i, a.err, b.err)
+		}
+		// Exactly one of the two parties is parked, and the other one is paired with it
+		if !(a.peer == nil && b.peer == a.ep) && !(b.peer == nil && a.peer == b.ep) {
+			t.Fatalf("tag-%d: expected one party to be paired with the other, got %p and %p", i, a.peer, b.peer)
+		}
+	}
+	if s.Parked() != 0 || s.Paired() != n {
+		t.Fatalf("expected %d pairs and no parked party, got %d and %d", n, s.Paired(), s.Parked())
+	}
+	if usage := s.UserUsage()["user1"]; usage.Sessions != n || usage.Parked != 0 {
+		t.Fatalf("expected %d sessions of user1, got %+v", n, usage)
+	}
+
+	for i := 0; i < n; i++ {
+		completer := results[2*i].ep
+		if results[2*i].peer == nil {
+			completer = results[2*i+1].ep
+		}
+		s.Release(completer.User, completer.SrcParty, completer.DstParty, completer.Tag)
+	}
+	if s.Paired() != 0 || len(s.UserUsage()) != 0 {
+		t.Fatalf("expected every pair to be released, got %d pairs and %v", s.Paired(), s.UserUsage())
+	}
+}
+
+func TestRendezvousRaceQuota(t *testing.T) {
+	s := GetState()
+	const n, max = 50, 5
+	results := rendezvousPairs(s, n, api.Quota{MaxSessions: max})
+	paired, refused := 0, 0
+	for _, r := range results {
+		var quotaErr *QuotaError
+		switch {
+		case r.peer != nil:
+			paired++
+		case errors.As(r.err, &quotaErr):
+			refused++
+		case r.err != nil:
+			t.Fatal(r.err)
+		}
+	}
+	if paired != max || refused != n-max {
+		t.Fatalf("expected %d pairs and %d refused, got %d and %d", max, n-max, paired, refused)
+	}
+	// The party waiting for a refused peer stays parked
+	if s.Paired() != max || s.Parked() != n-max {
+		t.Fatalf("expected %d pairs and %d parked, got %d and %d", max, n-max, s.Paired(), s.Parked())
+	}
+	if usage := s.UserUsage()["user1"]; usage.Sessions != max || usage.Parked != n-max {
+		t.Fatalf("expected the usage of user1 to match, got %+v", usage)
+	}
+}
+
+func TestJoinGroupRace(t *testing.T) {
+	s := GetState()
+	const size = 5
+	var completions atomic.Int32
+	var members []*Endpoint
+	var wg sync.WaitGroup
+	for index := 0; index < size; index++ {
+		for peer := 0; peer < size; peer++ {
+			if peer == index {
+				continue
+			}
+			wg.Add(1)
+			go func(index, peer int) {
+				defer wg.Done()
+				ep := &Endpoint{}
+				endpoints, err := s.JoinGroup("user1", fmt.Sprint(index), "group", index, peer, size, ep, api.Quota{})
+				if err != nil {
+					t.Error(err)
+				}
+				if endpoints != nil {
+					completions.Add(1)
+					members = endpoints
+				}
+			}(index, peer)
+		}
+	}
+	wg.Wait()
+	if completions.Load() != 1 || len(members) != size*(size-1) {
+		t.Fatalf("expected the group to complete once with %d endpoints, got %d completions", size*(size-1), completions.Load())
+	}
+	for _, m := range members {
+		if m.DstParty != fmt.Sprint(m.PeerIndex) {
+			t.Fatalf("member %d expected to be paired with %d, got party %s", m.Index, m.PeerIndex, m.DstParty)
+		}
+	}
+	if s.Parked() != 0 || s.Paired() != size*(size-1)/2 {
+		t.Fatalf("expected %d pairs and no parked member, got %d and %d", size*(size-1)/2, s.Paired(), s.Parked())
+	}
+}
+
+// joinGroup joins every endpoint of the members of a group of size, the members in order
+func joinGroup(s *State, id string, size int, quota api.Quota) ([]*Endpoint, error) {
+	for index := 0; index < size; index++ {
+		for peer := 0; peer < size; peer++ {
+			if peer == index {
+				continue
+			}
+			members, err := s.JoinGroup("user1", fmt.Sprint(index), id, index, peer, size, &Endpoint{}, quota)
+			if members != nil || err != nil {
+				return members, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+func TestJoinGroupQuota(t *testing.T) {
+	s := GetState()
+	const size = 5
+	// A member counts once against the parked quotas, not once per endpoint
+	members, err := joinGroup(s, "group", size, api.Quota{MaxParked: size, MaxPartyParked: 1})
+	if err != nil || len(members) != size*(size-1) {
+		t.Fatalf("expected the group to complete within a quota of %d parked, got %d endpoints: %v", size, len(members), err)
+	}
+	if usage := s.UserUsage()["user1"]; usage.Parked != 0 || usage.Sessions != size*(size-1)/2 {
+		t.Fatalf("expected the members to be unparked and their pairs counted, got %+v", usage)
+	}
+
+	var quotaErr *QuotaError
+	if _, err := joinGroup(s, "small", size, api.Quota{MaxParked: size - 1}); !errors.As(err, &quotaErr) {
+		t.Fatalf("expected the member beyond the quota to be refused, got %v", err)
+	}
+	if usage := s.UserUsage()["user1"]; usage.Parked != size-1 {
+		t.Fatalf("expected %d parked members, got %+v", size-1, usage)
+	}
+	// The parked quotas are released with the last endpoint of each member
+	s.Unpark("user1", "", "", "small")
+	if usage := s.UserUsage()["user1"]; usage.Parked != 0 {
+		t.Fatalf("expected no parked member once the group is unparked, got %+v", usage)
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package webhook posts signed invocations to the webhooks users register, so the relay can start a party
+// its peer waits for.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+)
+
+// SignatureHeader carries the signature of an invocation, "t=<unix time>,v1=<hex HMAC-SHA256>", where the HMAC
+// of the user secret is computed over the unix time, a dot and the request body
+const SignatureHeader = "X-Flock-Signature"
+
+const (
+	// DefaultMaxAttempts bounds the deliveries of an invocation
+	DefaultMaxAttempts = 5
+	// DefaultInitialBackoff is the wait before the first retry, doubled on each retry
+	DefaultInitialBackoff = 500 * time.Millisecond
+	// DefaultMaxBackoff caps the wait between retries
+	DefaultMaxBackoff = 8 * time.Second
+	// requestTimeout bounds each delivery
+	requestTimeout = 10 * time.Second
+	// dialTimeout bounds the connection to a webhook
+	dialTimeout = 5 * time.Second
+)
+
+// ErrAbandoned is returned when an invocation is no longer wanted before it was delivered
+var ErrAbandoned = errors.New("invocation abandoned")
+
+// ParseNetworks parses the CIDR notation of the networks webhooks may target besides public addresses
+func ParseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid webhook network: %v", err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// checkTarget rejects the loopback, link-local, private, unspecified and multicast addresses, which would let
+// users reach the relay host or its internal network, unless one of the allowed networks contains them
+func checkTarget(ip net.IP, allowed []*net.IPNet) error {
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("webhook address %s is not public", ip)
+	}
+	return nil
+}
+
+// Validate checks that a webhook has an http(s) URL and a secret to sign its invocations. A host that is
+// an address outside of the public and the allowed networks, or localhost, is rejected.
+func Validate(hook api.Webhook, allowed []*net.IPNet) error {
+	u, err := url.Parse(hook.URL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook URL: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook URL %q must be an absolute http or https URL", hook.URL)
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		host = "127.0.0.1"
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if err := checkTarget(ip, allowed); err != nil {
+			return err
+		}
+	}
+	if hook.Secret == "" {
+		return fmt.Errorf("webhook secret is required")
+	}
+	return nil
+}
+
+// Sign returns the signature header of body sent at t
+func Sign(secret string, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	return fmt.Sprintf("t=%s,v1=%s", timestamp, mac(secret, timestamp, body))
+}
+
+// Verify checks the signature header of body, rejecting signatures made more than maxAge away from now
+func Verify(secret, header string, body []byte, maxAge time.Duration, now time.Time) error {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || signature == "" {
+		return fmt.Errorf("malformed signature header")
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > maxAge || age < -maxAge {
+		return fmt.Errorf("signature is %v old, beyond %v", age.Round(time.Second), maxAge)
+	}
+	if !hmac.Equal([]byte(signature), []byte(mac(secret, timestamp, body))) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+func mac(secret, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Notifier delivers invocations, retrying failed deliveries with exponential backoff
+type Notifier struct {
+	// Client sends the invocations, it may be replaced to reach a test server
+	Client         *http.Client
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// New returns a notifier with the default retries. It connects to public addresses and to the allowed networks
+// only, whatever the webhook host resolves to, also when following redirects.
+func New(allowed []*net.IPNet) *Notifier {
+	dialer := &net.Dialer{
+		Timeout: dialTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("webhook address %s is not an IP address", host)
+			}
+			return checkTarget(ip, allowed)
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// A proxy would connect to the webhook on behalf of the relay, out of reach of the address checks
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &Notifier{
+		Client:         &http.Client{Timeout: requestTimeout, Transport: transport},
+		MaxAttempts:    DefaultMaxAttempts,
+		InitialBackoff: DefaultInitialBackoff,
+		MaxBackoff:     DefaultMaxBackoff,
+	}
+}
+
+// Invoke delivers inv to hook and returns the number of attempts. It retries until a delivery is accepted,
+// the attempts are exhausted, ctx is done, or wanted reports that the invocation is no longer needed.
+func (n *Notifier) Invoke(ctx context.Context, hook api.Webhook, inv api.Invocation, wanted func() bool) (int, error) {
+	backoff := n.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		if !wanted() {
+			return attempt - 1, ErrAbandoned
+		}
+		inv.Attempt = attempt
+		retryAfter, err := n.post(ctx, hook, inv)
+		if err == nil {
+			return attempt, nil
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) || attempt >= n.MaxAttempts {
+			return attempt, err
+		}
+		wait := backoff
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		if wait > n.MaxBackoff {
+			wait = n.MaxBackoff
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, fmt.Errorf("%v, giving up: %v", err, ctx.Err())
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// permanentError is a rejection of the webhook that retries would not change
+type permanentError struct {
+	status int
+}
+
+func (e *permanentError) Error() string {
+	return fmt.Sprintf("webhook rejected the invocation with status %d", e.status)
+}
+
+// post delivers inv once, returning the wait the webhook asked for before a retry
+func (n *Notifier) post(ctx context.Context, hook api.Webhook, inv api.Invocation) (time.Duration, error) {
+	body, err := json.Marshal(inv)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("unable to create webhook request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, time.Now(), body))
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return 0, nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return time.Duration(retryAfter) * time.Second, fmt.Errorf("webhook failed with status %d", resp.StatusCode)
+	}
+	return 0, &permanentError{status: resp.StatusCode}
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package webhook
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flock-org/flock/relay/pkg/api"
+)
+
+func TestValidate(t *testing.T) {
+	allowed, err := ParseNetworks([]string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url   string
+		valid bool
+	}{
+		{"https://functions.example.com/party", true},
+		{"http://203.0.113.7:8080/party", true},
+		{"http://10.1.2.3/party", true},
+		{"http://10.2.0.1/party", false},
+		{"http://127.0.0.1:8080/party", false},
+		{"http://localhost/party", false},
+		{"http://[::1]/party", false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{"http://192.168.1.1/party", false},
+		{"http://0.0.0.0/party", false},
+		{"ftp://functions.example.com/party", false},
+	}
+	for _, test := range tests {
+		err := Validate(api.Webhook{URL: test.url, Secret: "secret"}, allowed)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: expected valid %v, got %v", test.url, test.valid, err)
+		}
+	}
+}
+
+func TestInvokeRejectsPrivateAddresses(t *testing.T) {
+	invoked := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		invoked++
+	}))
+	defer server.Close()
+	hook := api.Webhook{URL: server.URL, Secret: "secret"}
+	wanted := func() bool { return true }
+
+	n := New(nil)
+	n.MaxAttempts = 1
+	if _, err := n.Invoke(context.Background(), hook, api.Invocation{}, wanted); err == nil || invoked != 0 {
+		t.Fatalf("expected the loopback webhook to be rejected, got %v after %d invocations", err, invoked)
+	}
+
+	allowed, err := ParseNetworks([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n = New(allowed)
+	n.MaxAttempts = 1
+	if _, err := n.Invoke(context.Background(), hook, api.Invocation{}, wanted); err != nil || invoked != 1 {
+		t.Fatalf("expected the allowed webhook to be invoked, got %v after %d invocations", err, invoked)
+	}
+}
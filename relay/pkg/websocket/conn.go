@@ -0,0 +1,323 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package websocket carries a byte stream over a WebSocket connection (RFC 6455), so that parties behind an
+// HTTP-only ingress reach the relay with the same bytes they would send on a TCP connection.
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xa
+
+	finBit  = 0x80
+	maskBit = 0x80
+	// maxControlPayload bounds the payload of the control frames
+	maxControlPayload = 125
+	// maxHeaderSize is the size of a frame header with a 64 bits length and a mask key
+	maxHeaderSize = 14
+	// closeNormal is the status of the Close frames ending a stream
+	closeNormal = 1000
+	// closeTimeout bounds the Close frame sent by Close
+	closeTimeout = 5 * time.Second
+)
+
+// ErrProtocol is returned when the other side sends frames that break RFC 6455 or carry text
+var ErrProtocol = errors.New("websocket protocol error")
+
+// Conn is a WebSocket connection carrying a byte stream in binary messages. It implements net.Conn, and
+// CloseWrite like a TCP connection: a Close frame ends the bytes a side sends and reads as EOF on the other side.
+// The deadlines are those of the underlying connection, a read interrupted by its deadline may be retried.
+// A write past its deadline fails before reaching the underlying connection, which a TLS connection would not
+// survive. Close and the deadlines do not wait for a write in progress, they interrupt it.
+type Conn struct {
+	net.Conn
+	br *bufio.Reader
+	// client masks the frames it sends and expects the frames it receives unmasked, the server the other way around
+	client bool
+
+	// remaining, mask and maskPos describe the payload of the data frame being read
+	remaining  uint64
+	mask       [4]byte
+	masked     bool
+	maskPos    int
+	readClosed bool
+
+	writeMutex  sync.Mutex
+	writeClosed bool
+
+	deadlineMutex sync.Mutex
+	writeDeadline time.Time
+
+	// pongMutex guards the pong owed to the last ping
+	pongMutex   sync.Mutex
+	pongPayload []byte
+	pongPending bool
+}
+
+func newConn(conn net.Conn, br *bufio.Reader, client bool) *Conn {
+	return &Conn{Conn: conn, br: br, client: client}
+}
+
+// Read reads the payload of the binary messages of the other side, until it sends a Close frame
+func (c *Conn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.readClosed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+	c.remaining -= uint64(n)
+	return n, err
+}
+
+// nextFrame reads the header of the next data frame, handling the control frames before it. The header is only
+// consumed once it was read whole, so a read interrupted by a deadline resumes at the same frame.
+func (c *Conn) nextFrame() error {
+	head, err := c.br.Peek(2)
+	if err != nil {
+		return err
+	}
+	fin, opcode, masked, length := head[0]&finBit != 0, head[0]&0x0f, head[1]&maskBit != 0, uint64(head[1]&0x7f)
+	if head[0]&0x70 != 0 {
+		return fmt.Errorf("%w: reserved bits set", ErrProtocol)
+	}
+	if masked == c.client {
+		return fmt.Errorf("%w: unexpected masking of a frame from the %s", ErrProtocol, c.otherSide())
+	}
+	headerSize := 2
+	switch length {
+	case 126:
+		headerSize += 2
+	case 127:
+		headerSize += 8
+	}
+	if masked {
+		headerSize += 4
+	}
+	head, err = c.br.Peek(headerSize)
+	if err != nil {
+		return err
+	}
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(head[2:4]))
+	case 127:
+		length = binary.BigEndian.Uint64(head[2:10])
+	}
+	var mask [4]byte
+	if masked {
+		copy(mask[:], head[headerSize-4:headerSize])
+	}
+
+	switch opcode {
+	case opBinary, opContinuation:
+		if _, err := c.br.Discard(headerSize); err != nil {
+			return err
+		}
+		c.remaining, c.mask, c.masked, c.maskPos = length, mask, masked, 0
+		return nil
+	case opText:
+		return fmt.Errorf("%w: text messages are not supported", ErrProtocol)
+	case opClose, opPing, opPong:
+	default:
+		return fmt.Errorf("%w: unknown opcode %d", ErrProtocol, opcode)
+	}
+	if !fin || length > maxControlPayload {
+		return fmt.Errorf("%w: fragmented or oversized control frame", ErrProtocol)
+	}
+	frame, err := c.br.Peek(headerSize + int(length))
+	if err != nil {
+		return err
+	}
+	payload := append([]byte(nil), frame[headerSize:]...)
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+	}
+	if _, err := c.br.Discard(len(frame)); err != nil {
+		return err
+	}
+	switch opcode {
+	case opPing:
+		c.pong(payload)
+	case opClose:
+		c.readClosed = true
+	}
+	return nil
+}
+
+func (c *Conn) otherSide() string {
+	if c.client {
+		return "server"
+	}
+	return "client"
+}
+
+// Write sends p as a binary message
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func closePayload() []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, closeNormal)
+	return payload
+}
+
+// CloseWrite sends a Close frame, after which the other side reads EOF
+func (c *Conn) CloseWrite() error {
+	return c.writeFrame(opClose, closePayload())
+}
+
+// Close closes the underlying connection, after a Close frame unless CloseWrite sent one. The Close frame is
+// best effort: it is skipped while a write is in progress, which closing the connection interrupts, and it is
+// given up after closeTimeout when the other side does not read.
+func (c *Conn) Close() error {
+	if c.writeMutex.TryLock() {
+		if !c.writeClosed && c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout)) == nil {
+			_ = c.writeFrameLocked(opClose, closePayload())
+		}
+		c.writeMutex.Unlock()
+	}
+	return c.Conn.Close()
+}
+
+// SetDeadline sets the read and write deadlines of the connection
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.writeDeadline = t
+	c.deadlineMutex.Unlock()
+	return c.Conn.SetDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of the writes of the connection
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.writeDeadline = t
+	c.deadlineMutex.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// pong answers a ping aside, so that Read waits neither for a write in progress nor for the other side to
+// read. Only the last of the pings received meanwhile is answered, its failure is left to the next write.
+func (c *Conn) pong(payload []byte) {
+	c.pongMutex.Lock()
+	defer c.pongMutex.Unlock()
+	c.pongPayload = payload
+	if c.pongPending {
+		return
+	}
+	c.pongPending = true
+	go func() {
+		c.writeMutex.Lock()
+		defer c.writeMutex.Unlock()
+		c.pongMutex.Lock()
+		payload := c.pongPayload
+		c.pongPayload, c.pongPending = nil, false
+		c.pongMutex.Unlock()
+		_ = c.writeFrameLocked(opPong, payload)
+	}()
+}
+
+// writeFrame writes a single frame, masked by the client
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.writeFrameLocked(opcode, payload)
+}
+
+// writeFrameLocked writes a frame under the write mutex
+func (c *Conn) writeFrameLocked(opcode byte, payload []byte) error {
+	if c.writeClosed {
+		if opcode == opClose {
+			return nil
+		}
+		return net.ErrClosed
+	}
+	c.deadlineMutex.Lock()
+	deadline := c.writeDeadline
+	c.deadlineMutex.Unlock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	frame := make([]byte, 0, maxHeaderSize+len(payload))
+	frame = append(frame, finBit|opcode)
+	var maskFlag byte
+	if c.client {
+		maskFlag = maskBit
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskFlag|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskFlag|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskFlag|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	if _, err := c.Conn.Write(frame); err != nil {
+		return err
+	}
+	if opcode == opClose {
+		c.writeClosed = true
+	}
+	return nil
+}
@@ -0,0 +1,287 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// rawFrame encodes a frame, masked with mask unless it is nil
+func rawFrame(fin bool, opcode byte, mask []byte, payload []byte) []byte {
+	b0 := opcode
+	if fin {
+		b0 |= finBit
+	}
+	frame := []byte{b0}
+	var maskFlag byte
+	if mask != nil {
+		maskFlag = maskBit
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskFlag|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskFlag|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskFlag|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if mask == nil {
+		return append(frame, payload...)
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i&3])
+	}
+	return frame
+}
+
+// readRawFrame reads a whole frame from r, unmasking its payload
+func readRawFrame(r io.Reader) (byte, bool, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, false, nil, err
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, false, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, false, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	masked := head[1]&maskBit != 0
+	mask := make([]byte, 4)
+	if masked {
+		if _, err := io.ReadFull(r, mask); err != nil {
+			return 0, false, nil, err
+		}
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, false, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i&3]
+		}
+	}
+	return head[0] & 0x0f, masked, payload, nil
+}
+
+// pipe returns a Conn of the given side and the raw connection of the other side
+func pipe(t *testing.T, client bool) (*Conn, net.Conn) {
+	c, raw := net.Pipe()
+	t.Cleanup(func() {
+		c.Close()
+		raw.Close()
+	})
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	raw.SetDeadline(time.Now().Add(5 * time.Second))
+	return newConn(c, bufio.NewReader(c), client), raw
+}
+
+func TestReadFragmentedMessage(t *testing.T) {
+	server, raw := pipe(t, false)
+	mask := []byte{1, 2, 3, 4}
+	go func() {
+		// A ping interleaved in a fragmented message is answered with a pong
+		raw.Write(rawFrame(false, opBinary, mask, []byte("hel")))
+		raw.Write(rawFrame(true, opPing, mask, []byte("ping")))
+		raw.Write(rawFrame(false, opContinuation, mask, []byte("lo ")))
+		raw.Write(rawFrame(true, opPong, mask, nil))
+		raw.Write(rawFrame(true, opContinuation, []byte{0xff, 0, 0x80, 7}, []byte("world")))
+		raw.Write(rawFrame(true, opClose, mask, []byte{0x03, 0xe8}))
+	}()
+	pong := make(chan []byte, 1)
+	go func() {
+		opcode, masked, payload, err := readRawFrame(raw)
+		if err != nil || opcode != opPong || masked {
+			t.Errorf("expected an unmasked pong, got opcode %d masked %v: %v", opcode, masked, err)
+		}
+		pong <- payload
+	}()
+
+	received, err := io.ReadAll(server)
+	if err != nil || string(received) != "hello world" {
+		t.Fatalf("expected the fragments to read as one stream, got %q: %v", received, err)
+	}
+	if payload := <-pong; string(payload) != "ping" {
+		t.Fatalf("expected the pong to echo the ping, got %q", payload)
+	}
+}
+
+func TestReadLargeFrames(t *testing.T) {
+	client, raw := pipe(t, true)
+	medium := bytes.Repeat([]byte("m"), 300)
+	large := bytes.Repeat([]byte("l"), 70000)
+	go func() {
+		raw.Write(rawFrame(true, opBinary, nil, medium))
+		raw.Write(rawFrame(true, opBinary, nil, large))
+		raw.Write(rawFrame(true, opClose, nil, nil))
+	}()
+	received, err := io.ReadAll(client)
+	if err != nil || !bytes.Equal(received, append(medium, large...)) {
+		t.Fatalf("expected %d bytes, got %d: %v", len(medium)+len(large), len(received), err)
+	}
+}
+
+func TestReadProtocolErrors(t *testing.T) {
+	mask := []byte{1, 2, 3, 4}
+	tests := []struct {
+		name   string
+		client bool
+		frame  []byte
+	}{
+		{"unmasked client frame", false, rawFrame(true, opBinary, nil, []byte("x"))},
+		{"masked server frame", true, rawFrame(true, opBinary, mask, []byte("x"))},
+		{"text message", false, rawFrame(true, opText, mask, []byte("x"))},
+		{"fragmented control frame", false, rawFrame(false, opPing, mask, []byte("x"))},
+		{"oversized control frame", false, rawFrame(true, opPing, mask, bytes.Repeat([]byte("x"), maxControlPayload+1))},
+		{"reserved bits", false, append([]byte{finBit | 0x40 | opBinary}, rawFrame(true, opBinary, mask, nil)[1:]...)},
+		{"unknown opcode", false, rawFrame(true, 0x3, mask, nil)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, raw := pipe(t, test.client)
+			go raw.Write(test.frame)
+			if _, err := c.Read(make([]byte, 1)); !errors.Is(err, ErrProtocol) {
+				t.Fatalf("expected a protocol error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteMasking(t *testing.T) {
+	for _, client := range []bool{true, false} {
+		c, raw := pipe(t, client)
+		go c.Write([]byte("hello"))
+		opcode, masked, payload, err := readRawFrame(raw)
+		if err != nil || opcode != opBinary || string(payload) != "hello" {
+			t.Fatalf("expected a binary frame of hello, got opcode %d %q: %v", opcode, payload, err)
+		}
+		if masked != client {
+			t.Fatalf("expected the frames of the client only to be masked, client %v masked %v", client, masked)
+		}
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	c, raw := pipe(t, true)
+	go c.CloseWrite()
+	opcode, _, payload, err := readRawFrame(raw)
+	if err != nil || opcode != opClose || binary.BigEndian.Uint16(payload) != closeNormal {
+		t.Fatalf("expected a normal close frame, got opcode %d %v: %v", opcode, payload, err)
+	}
+	if _, err := c.Write([]byte("x")); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected writes to fail once the stream is closed for writing, got %v", err)
+	}
+	// The other direction stays open
+	go raw.Write(rawFrame(true, opBinary, nil, []byte("x")))
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockedWrite starts a write that blocks since the other side does not read, and returns its error
+func blockedWrite(c *Conn) <-chan error {
+	written := make(chan error, 1)
+	go func() {
+		_, err := c.Write([]byte("blocked"))
+		written <- err
+	}()
+	// Let the write take the write mutex
+	time.Sleep(50 * time.Millisecond)
+	return written
+}
+
+// waitUnblocked fails the test unless the blocked write returns an error shortly
+func waitUnblocked(t *testing.T, written <-chan error) {
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Fatal("expected the blocked write to fail")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the blocked write was not interrupted")
+	}
+}
+
+func TestCloseDuringBlockedWrite(t *testing.T) {
+	c, _ := pipe(t, true)
+	written := blockedWrite(c)
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close waited for the blocked write")
+	}
+	waitUnblocked(t, written)
+}
+
+func TestDeadlineDuringBlockedWrite(t *testing.T) {
+	c, _ := pipe(t, true)
+	written := blockedWrite(c)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.SetWriteDeadline(time.Now())
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("SetWriteDeadline waited for the blocked write")
+	}
+	waitUnblocked(t, written)
+}
+
+func TestPingDuringBlockedWrite(t *testing.T) {
+	c, raw := pipe(t, true)
+	written := blockedWrite(c)
+	go func() {
+		raw.Write(rawFrame(true, opPing, nil, []byte("ping")))
+		raw.Write(rawFrame(true, opBinary, nil, []byte("x")))
+	}()
+	// Read goes on past the ping while the write is blocked
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	// The pong follows the blocked write once the other side reads
+	for _, expected := range []byte{opBinary, opPong} {
+		opcode, _, _, err := readRawFrame(raw)
+		if err != nil || opcode != expected {
+			t.Fatalf("expected opcode %d, got %d: %v", expected, opcode, err)
+		}
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2024 The Flock Authors.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package websocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subprotocol is offered by the clients and echoed by the relay, to tell the relay tunnel from other WebSockets
+const Subprotocol = "flock-relay"
+
+// acceptGUID is appended to the key of the client to compute the accept key of the server
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// readHeaderTimeout bounds the upgrade request of a client
+const readHeaderTimeout = 10 * time.Second
+
+// IsURL reports whether address is a ws:// or wss:// URL
+func IsURL(address string) bool {
+	return strings.HasPrefix(address, "ws://") || strings.HasPrefix(address, "wss://")
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerHas reports whether the comma separated values of a header contain token, ignoring case
+func headerHas(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Upgrade completes the WebSocket handshake of r and returns its connection. The error response is written
+// when the request is not a WebSocket upgrade.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet || !headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "expected a WebSocket upgrade", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("not a WebSocket upgrade request")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, fmt.Errorf("unsupported WebSocket version %q", r.Header.Get("Sec-WebSocket-Version"))
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "invalid Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, fmt.Errorf("invalid Sec-WebSocket-Key %q", key)
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket upgrades are not supported over this connection", http.StatusHTTPVersionNotSupported)
+		return nil, fmt.Errorf("unable to hijack a %s connection", r.Proto)
+	}
+	conn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, fmt.Errorf("unable to hijack the connection: %v", err)
+	}
+	// The deadlines of the HTTP server no longer apply
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp := "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: " + acceptKey(key) + "\r\n"
+	if headerHas(r.Header, "Sec-WebSocket-Protocol", Subprotocol) {
+		resp += "Sec-WebSocket-Protocol: " + Subprotocol + "\r\n"
+	}
+	if _, err := conn.Write([]byte(resp + "\r\n")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("unable to complete the WebSocket handshake: %v", err)
+	}
+	return newConn(conn, brw.Reader, false), nil
+}
+
+// Dial opens a WebSocket connection to a ws:// or wss:// URL. The HTTPS server of a wss:// URL is verified
+// with tlsConfig, whose ServerName defaults to the host of the URL.
+func Dial(ctx context.Context, rawURL string, tlsConfig *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebSocket URL: %v", err)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	switch u.Scheme {
+	case "ws":
+	case "wss":
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		// Upgrades need HTTP/1.1, the server must not pick HTTP/2
+		config.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to establish the HTTPS connection: %v", err)
+		}
+		conn = tlsConn
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("unsupported WebSocket URL scheme %q", u.Scheme)
+	}
+
+	ws, err := handshake(conn, u)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ws, nil
+}
+
+// handshake sends the upgrade request of a client and checks the response of the server
+func handshake(conn net.Conn, u *url.URL) (*Conn, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Host:       u.Host,
+		Header: http.Header{
+			"Upgrade":                {"websocket"},
+			"Connection":             {"Upgrade"},
+			"Sec-WebSocket-Key":      {key},
+			"Sec-WebSocket-Version":  {"13"},
+			"Sec-WebSocket-Protocol": {Subprotocol},
+		},
+	}
+	if req.URL.Path == "" {
+		req.URL.Path = "/"
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, fmt.Errorf("unable to send the WebSocket upgrade: %v", err)
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the WebSocket upgrade response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("WebSocket upgrade refused with status %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, fmt.Errorf("WebSocket upgrade response has an invalid Sec-WebSocket-Accept")
+	}
+	return newConn(conn, br, true), nil
+}
+
+// Listener accepts the WebSocket connections upgraded by an HTTP server on the path of its URL
+type Listener struct {
+	l         net.Listener
+	server    *http.Server
+	path      string
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Listen serves WebSocket upgrades on a ws:// or wss:// URL, host:port/path. The HTTPS server of a wss:// URL
+// uses tlsConfig, the clients authenticate inside the connections they upgrade.
+func Listen(rawURL string, tlsConfig *tls.Config) (*Listener, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebSocket URL: %v", err)
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("unsupported WebSocket URL scheme %q", u.Scheme)
+	}
+	l, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	wl := &Listener{l: l, path: u.Path, conns: make(chan net.Conn), done: make(chan struct{})}
+	if wl.path == "" {
+		wl.path = "/"
+	}
+	wl.server = &http.Server{
+		Handler:           wl,
+		ReadHeaderTimeout: readHeaderTimeout,
+		// Upgrades need HTTP/1.1, so HTTP/2 is not offered
+		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	}
+	if u.Scheme == "wss" {
+		config := tlsConfig.Clone()
+		config.NextProtos = []string{"http/1.1"}
+		go func() { _ = wl.server.Serve(tls.NewListener(l, config)) }()
+	} else {
+		go func() { _ = wl.server.Serve(l) }()
+	}
+	return wl, nil
+}
+
+// ServeHTTP upgrades the requests on the path of the listener and queues their connections for Accept
+func (wl *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != wl.path {
+		http.NotFound(w, r)
+		return
+	}
+	conn, err := Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	select {
+	case wl.conns <- conn:
+	case <-wl.done:
+		conn.Close()
+	}
+}
+
+// Accept returns the next upgraded connection
+func (wl *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-wl.conns:
+		return conn, nil
+	case <-wl.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the HTTP server, the connections already upgraded are left open
+func (wl *Listener) Close() error {
+	wl.closeOnce.Do(func() { close(wl.done) })
+	return wl.server.Close()
+}
+
+// Addr returns the address of the listener
+func (wl *Listener) Addr() net.Addr {
+	return wl.l.Addr()
+}